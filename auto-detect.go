@@ -2,15 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"go/ast"
+	"go/parser"
 	"go/token"
-	"go/types"
+	"log"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
-	"github.com/golang/dep/gps/paths"
+	"github.com/github/depstubber/autodetect"
 	"golang.org/x/tools/go/packages"
-	"golang.org/x/tools/go/vcs"
 )
 
 type CombinedErrors struct {
@@ -46,34 +51,6 @@ func CombineErrors(errs ...error) error {
 	}
 }
 
-func loadPackage(startPkg string, dir string) (*packages.Package, error) {
-	config := &packages.Config{
-		Mode: packages.LoadSyntax | packages.NeedModule,
-	}
-
-	// Set the package loader Dir to the `dir`; that will force
-	// the package loader to use the `go.mod` file and thus
-	// load the wanted version of the package:
-	config.Dir = dir
-
-	pkgs, err := packages.Load(config, startPkg)
-	if err != nil {
-		return nil, fmt.Errorf("error while running packages.Load: %s", err)
-	}
-
-	var errs []error
-	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
-		for _, err := range pkg.Errors {
-			errs = append(errs, err)
-		}
-	})
-	if len(errs) > 0 {
-		return nil, fmt.Errorf("error while packages.Load: %s", CombineErrors(errs...))
-	}
-
-	return pkgs[0], nil
-}
-
 // DeduplicateStrings returns a new slice with duplicate values removed.
 func DeduplicateStrings(slice []string) []string {
 	if len(slice) <= 1 {
@@ -91,143 +68,152 @@ func DeduplicateStrings(slice []string) []string {
 	return result
 }
 
-// removeBlankIdentifier returns a new slice with blank identifier `_` removed.
-func removeBlankIdentifier(slice []string) []string {
-	result := []string{}
-	for _, val := range slice {
-		if val != "_" {
-			result = append(result, val)
-		}
+// autoDetect finds the symbols of external packages used by the Go package
+// in `dir`, by package path. It also returns the modules providing them, and
+// the files using each symbol.
+func autoDetect(dir string) (map[string][]string, map[string][]string, map[string][]*packages.Module, map[string]map[string][]string, error) {
+	defer timePhase(phaseDetection, time.Now())
+	result, err := autodetect.ScanContext(runContext, dir, autodetect.Options{
+		Env:           childEnv(),
+		Tests:         true,
+		SkipGenerated: *skipGenerated,
+		SkipTags:      split(*skipBuildTags),
+	})
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-	return result
-}
 
-// removeUnexported returns a new slice with all unexported identifiers removed.
-func removeUnexported(slice []string) []string {
-	result := []string{}
-	for _, val := range slice {
-		if token.IsExported(val) {
-			result = append(result, val)
-		}
+	pathToTypeNames := make(map[string][]string)
+	pathToFuncAndVarNames := make(map[string][]string)
+	pathToModule := make(map[string][]*packages.Module)
+	pathToFiles := make(map[string]map[string][]string)
+	detectedInstances = make(map[string][]autodetect.Instance)
+	detectedPackages = make(map[string]bool)
+	for _, pkg := range result.Packages {
+		pathToTypeNames[pkg.Path] = pkg.Types
+		pathToFuncAndVarNames[pkg.Path] = pkg.Values
+		pathToModule[pkg.Path] = pkg.Modules
+		pathToFiles[pkg.Path] = pkg.Files
+		detectedInstances[pkg.Path] = pkg.Instances
+		detectedPackages[pkg.Path] = true
 	}
-	return result
+	return pathToTypeNames, pathToFuncAndVarNames, pathToModule, pathToFiles, nil
 }
 
-func autoDetect(startPkg string, dir string) (map[string][]string, map[string][]string, map[string][]string, error) {
-	pk, err := loadPackage(startPkg, dir)
+// detectedInstances holds the instantiations of generic types and functions
+// found by autoDetect, by package path.
+var detectedInstances map[string][]autodetect.Instance
+
+// detectedPackages holds the paths of the packages autoDetect found, which
+// are stubbed along with each other.
+var detectedPackages map[string]bool
+
+// checkInstances warns about the instantiations found by autoDetect of the
+// generic types and functions of the package `pkgPath` that its stub `src`
+// doesn't declare with as many type parameters.
+func checkInstances(pkgPath string, src []byte) {
+	instances := detectedInstances[pkgPath]
+	if len(instances) == 0 {
+		return
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, 0)
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("error while loading package: %s", err)
+		return
 	}
-
-	rootOfStartPkg, _ := vcs.RepoRootForImportPath(pk.Types.Path(), false)
-
-	pathToTypeNames := make(map[string][]string)
-	pathToFuncAndVarNames := make(map[string][]string)
-	pathToDirTmp := make(map[string][]string)
-
-	for path, v := range pk.Imports {
-		if v.Module != nil && v.Module.Dir != "" {
-			pathToDirTmp[path] = append(pathToDirTmp[path], v.Module.Dir)
+	typeParams := make(map[string]int)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil {
+				typeParams[decl.Name.Name] = typeParamCount(decl)
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				if spec, ok := spec.(*ast.TypeSpec); ok {
+					typeParams[spec.Name.Name] = typeParamCount(spec)
+				}
+			}
 		}
 	}
-
-	for _, obj := range pk.TypesInfo.Uses {
-		if obj.Pkg() == nil || obj.Pkg().Path() == "" {
-			// Skip objects that don't belong to a package.
-			continue
+	for _, inst := range instances {
+		n, ok := typeParams[inst.Name]
+		switch {
+		case !ok:
+			log.Printf("WARNING: %s: the stub of %s doesn't declare %s, instantiated as %s", inst.Position, pkgPath, inst.Name, inst.Expr)
+		case n == 0:
+			log.Printf("WARNING: %s: the stub of %s declares %s without type parameters, but it is instantiated as %s", inst.Position, pkgPath, inst.Name, inst.Expr)
+		case inst.TypeArgs > n || !inst.Func && inst.TypeArgs < n:
+			// The trailing type arguments of functions may be inferred.
+			log.Printf("WARNING: %s: the stub of %s declares %s with %d type parameters, but it is instantiated as %s", inst.Position, pkgPath, inst.Name, n, inst.Expr)
 		}
+	}
+}
 
-		if isStd := paths.IsStandardImportPath(obj.Pkg().Path()); isStd {
-			// Skip objects that belong to a Go standard library (supposedly).
-			continue
-		}
+// fatalDetectionError exits with the error `err` of autoDetect. With -json,
+// the errors in the loaded packages are printed to standard output as JSON.
+func fatalDetectionError(err error) {
+	loadErr, ok := err.(*autodetect.LoadError)
+	if !ok || !*jsonOutput {
+		log.Fatalf("Error while auto-detecting imported objects: %s", err)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(struct {
+		Errors []autodetect.Diagnostic `json:"errors"`
+	}{loadErr.Diagnostics})
+	os.Exit(1)
+}
 
-		if packageIsSamePath := obj.Pkg().Path() == pk.Types.Path(); packageIsSamePath {
-			// Skip objects that belong to the initial package that was scanned.
-			continue
-		}
+// detectionMapName is the name of the file in the vendor directory that
+// records why each stub of -auto exists.
+const detectionMapName = "depstubber.map.json"
 
-		if notExported := !obj.Exported(); notExported {
-			panic(fmt.Sprintf("Encountered unexpected unexported type %v, which should not be accessible by this package (%s).", obj, obj.Pkg().Path()))
-		}
+// detectionMap records the symbols stubbed by -auto, with the source files
+// using them, relative to the module root.
+type detectionMap struct {
+	Packages map[string]detectedPackage `json:"packages"`
+}
 
-		// Check whether obj.Pkg().Path() is a subpath of pk.Types.Path() (or the other way round), i.e. they belong to the same root package.
-		// Skip objects belonging to packages that have the same root as the initial package.
-		pathsOverlap := strings.HasPrefix(obj.Pkg().Path(), pk.Types.Path()+"/") || strings.HasPrefix(pk.Types.Path(), obj.Pkg().Path()+"/")
-		if rootOfStartPkg != nil {
-			// Check with root:
-			rootOfThisObjPkg, err := vcs.RepoRootForImportPath(obj.Pkg().Path(), false)
-			if err == nil && rootOfStartPkg.Root == rootOfThisObjPkg.Root {
-				continue
-			} else {
-				// Check with string prefix:
-				if pathsOverlap {
-					continue
-				}
-			}
-		} else {
-			// Check with string prefix:
-			if pathsOverlap {
-				continue
-			}
-		}
+type detectedPackage struct {
+	Types  map[string][]string `json:"types"`
+	Values map[string][]string `json:"values"`
+}
 
-		pkgPath := obj.Pkg().Path()
-		switch thing := obj.(type) {
-		case *types.TypeName:
-			pathToTypeNames[pkgPath] = append(pathToTypeNames[pkgPath], obj.Name())
-		case *types.Const:
-			pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
-		case *types.Var:
-			// Ignore fields
-			if isNotAField := !thing.IsField(); isNotAField {
-				pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
-			}
-		case *types.Func:
-			switch sig := thing.Type().(type) {
-			case *types.Signature:
-				if notAMethod := sig.Recv() == nil; notAMethod {
-					// This is a normal function.
-					pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
+// writeDetectionMap writes the detection map of the module in `modRoot`.
+func writeDetectionMap(modRoot string, pathToTypeNames map[string][]string, pathToFuncAndVarNames map[string][]string, pathToFiles map[string]map[string][]string) error {
+	files := func(pkgPath string, names []string) map[string][]string {
+		byName := make(map[string][]string)
+		for _, name := range names {
+			byName[name] = []string{}
+			for _, file := range pathToFiles[pkgPath][name] {
+				if rel, err := filepath.Rel(modRoot, file); err == nil {
+					file = filepath.ToSlash(rel)
 				}
-			default:
-				panic(fmt.Sprintf("non-signature type %T for function %s", thing.Type(), obj.String()))
+				byName[name] = append(byName[name], file)
 			}
-		default:
-			panic(fmt.Sprintf("unknown type %T for object %s", obj, obj.String()))
 		}
+		return byName
 	}
 
-	{
-		// Deduplicate and sort:
-		for pkgPath := range pathToTypeNames {
-			dedup := DeduplicateStrings(pathToTypeNames[pkgPath])
-			dedup = removeBlankIdentifier(dedup)
-			dedup = removeUnexported(dedup)
-			sort.Strings(dedup)
-			pathToTypeNames[pkgPath] = dedup
-		}
-		for pkgPath := range pathToFuncAndVarNames {
-			dedup := DeduplicateStrings(pathToFuncAndVarNames[pkgPath])
-			dedup = removeBlankIdentifier(dedup)
-			dedup = removeUnexported(dedup)
-			sort.Strings(dedup)
-			pathToFuncAndVarNames[pkgPath] = dedup
+	m := detectionMap{Packages: make(map[string]detectedPackage)}
+	for pkgPath, names := range pathToTypeNames {
+		m.Packages[pkgPath] = detectedPackage{
+			Types:  files(pkgPath, names),
+			Values: files(pkgPath, pathToFuncAndVarNames[pkgPath]),
 		}
 	}
-
-	pathToDir := make(map[string][]string)
-	// Select only used paths:
-	{
-		for pkgPath := range pathToTypeNames {
-			pathToDir[pkgPath] = pathToDirTmp[pkgPath]
-		}
-		for pkgPath := range pathToFuncAndVarNames {
-			pathToDir[pkgPath] = pathToDirTmp[pkgPath]
+	for pkgPath, names := range pathToFuncAndVarNames {
+		if _, ok := m.Packages[pkgPath]; !ok {
+			m.Packages[pkgPath] = detectedPackage{Types: map[string][]string{}, Values: files(pkgPath, names)}
 		}
 	}
 
-	return pathToTypeNames, pathToFuncAndVarNames, pathToDir, nil
+	data, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(modRoot, "vendor", detectionMapName), append(data, '\n'), nil, fileAction{})
 }
 
 // FormatDepstubberComment returns the `depstubber` comment that will be used to stub types.
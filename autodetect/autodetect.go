@@ -0,0 +1,640 @@
+// Package autodetect finds the symbols of external packages that a Go package
+// uses, which are the symbols that depstubber needs to stub for it.
+package autodetect
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/dep/gps/paths"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/vcs"
+)
+
+// Options configures Scan.
+type Options struct {
+	// Env is the environment of the go command used to load the package;
+	// if nil, the environment of the current process is used.
+	Env []string
+
+	// Tests includes the test files of the package in the scan.
+	Tests bool
+
+	// SkipGenerated leaves out the files marked as generated with a
+	// `// Code generated ... DO NOT EDIT.` comment.
+	SkipGenerated bool
+
+	// SkipTags leaves out the files whose build constraints require one of
+	// these tags, like `//go:build tools`, even if the tags are enabled.
+	SkipTags []string
+}
+
+// Package holds the symbols of an external package that are used.
+type Package struct {
+	Path string
+
+	// Types holds the used types, and the methods used on values of
+	// unexported types as `type.Method`.
+	Types []string
+
+	// Values holds the used functions, variables and constants.
+	Values []string
+
+	// Modules holds the modules that provide the package.
+	Modules []*packages.Module
+
+	// Files holds the sorted source files using each of the Types and Values.
+	Files map[string][]string
+
+	// Positions holds the positions of the uses of each of the Types and
+	// Values, in the file set of the scanned package.
+	Positions map[string][]token.Pos
+
+	// Instances holds the instantiations of generic types and functions,
+	// like `pkg.List[int]`, in the order in which they are written.
+	Instances []Instance
+}
+
+// Instance is an instantiation of a generic type or function of an external
+// package.
+type Instance struct {
+	Name     string // the name of the generic type or function
+	Func     bool   // whether it is a function, whose type arguments may be inferred
+	Expr     string // the instantiation as written, like `pkg.List[int]`
+	TypeArgs int    // the number of type arguments written
+	Position token.Position
+}
+
+// Result is the result of Scan.
+type Result struct {
+	// Path is the import path of the scanned package.
+	Path string
+
+	// Packages holds the used external packages, sorted by path.
+	Packages []*Package
+}
+
+// Package returns the used external package with import path `path`,
+// or nil if it is not used.
+func (r *Result) Package(path string) *Package {
+	for _, pkg := range r.Packages {
+		if pkg.Path == path {
+			return pkg
+		}
+	}
+	return nil
+}
+
+// Scan finds the symbols of external packages used by the Go package in
+// `dir`. Packages of the standard library, and packages that belong to the
+// same repository as the scanned package, are not external.
+func Scan(dir string, opts Options) (*Result, error) {
+	return ScanContext(context.Background(), dir, opts)
+}
+
+// ScanContext is like Scan, but stops loading the package, and kills the go
+// command it runs for that, when `ctx` is done.
+func ScanContext(ctx context.Context, dir string, opts Options) (*Result, error) {
+	results, err := ScanPackagesContext(ctx, dir, []string{"."}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+// ScanPackagesContext is like ScanContext, but scans each of the packages
+// matched by `patterns` in `dir`, and returns their results in the order in
+// which the go command lists them. The packages are loaded together, so that
+// the dependencies they have in common are only loaded once.
+func ScanPackagesContext(ctx context.Context, dir string, patterns []string, opts Options) ([]*Result, error) {
+	groups, err := loadPackages(ctx, patterns, dir, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, ok := err.(*LoadError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error while loading package: %s", err)
+	}
+
+	results := make([]*Result, 0, len(groups))
+	for _, scanned := range groups {
+		result, err := scan(ctx, scanned, opts)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// ScanTypes is like Scan, but finds the symbols used by the package `pkg`
+// that is already type-checked, with the syntax `files` parsed into `fset`
+// and the type information `info`, as in an analysis pass. The Modules of
+// the result are not set.
+func ScanTypes(pkg *types.Package, fset *token.FileSet, files []*ast.File, info *types.Info, opts Options) (*Result, error) {
+	scanned := &packages.Package{
+		ID:        pkg.Path(),
+		Name:      pkg.Name(),
+		PkgPath:   pkg.Path(),
+		Fset:      fset,
+		Syntax:    files,
+		Types:     pkg,
+		TypesInfo: info,
+	}
+	return scan(context.Background(), []*packages.Package{scanned}, opts)
+}
+
+// scan finds the symbols of external packages used by `scanned`, which are
+// a package and its test packages, as returned by loadPackages.
+func scan(ctx context.Context, scanned []*packages.Package, opts Options) (*Result, error) {
+	// The external test package (`package foo_test`) is scanned like the
+	// package itself, which its uses of the package don't make external.
+	startPath := scanned[0].Types.Path()
+	rootOfStartPkg, _ := vcs.RepoRootForImportPath(startPath, false)
+
+	pathToTypeNames := make(map[string][]string)
+	pathToFuncAndVarNames := make(map[string][]string)
+	pathToModules := make(map[string][]*packages.Module)
+	pathToFiles := make(map[string]map[string][]string)
+	pathToPositions := make(map[string]map[string][]token.Pos)
+	usedIn := func(pkgPath string, name string, pk *packages.Package, pos token.Pos) {
+		if pathToFiles[pkgPath] == nil {
+			pathToFiles[pkgPath] = make(map[string][]string)
+			pathToPositions[pkgPath] = make(map[string][]token.Pos)
+		}
+		file := pk.Fset.Position(pos).Filename
+		pathToFiles[pkgPath][name] = append(pathToFiles[pkgPath][name], file)
+		pathToPositions[pkgPath][name] = append(pathToPositions[pkgPath][name], pos)
+	}
+
+	// local reports whether the package `path` belongs to the repository of
+	// the scanned package, or to the standard library, so that its symbols
+	// aren't stubbed.
+	local := func(path string) bool {
+		if isStd := paths.IsStandardImportPath(path); isStd {
+			// Objects that belong to a Go standard library (supposedly).
+			return true
+		}
+
+		if packageIsSamePath := path == startPath || path == startPath+"_test"; packageIsSamePath {
+			// Objects that belong to the initial package that was scanned.
+			return true
+		}
+
+		// Check whether path is a subpath of startPath (or the other way round), i.e. they belong to the same root package.
+		// Skip objects belonging to packages that have the same root as the initial package.
+		pathsOverlap := strings.HasPrefix(path, startPath+"/") || strings.HasPrefix(startPath, path+"/")
+		if rootOfStartPkg != nil {
+			// Check with root:
+			rootOfThisObjPkg, err := vcs.RepoRootForImportPath(path, false)
+			if err == nil && rootOfStartPkg.Root == rootOfThisObjPkg.Root {
+				return true
+			}
+		}
+		// Check with string prefix:
+		return pathsOverlap
+	}
+
+	skipped := skippedFiles(scanned, opts)
+
+	for _, pk := range scanned {
+		for path, v := range pk.Imports {
+			if v.Module != nil && !containsModule(pathToModules[path], v.Module) {
+				// The directory may be missing; the license is then looked up online.
+				pathToModules[path] = append(pathToModules[path], v.Module)
+			}
+		}
+
+		for ident, obj := range pk.TypesInfo.Uses {
+			if skipped[pk.Fset.File(ident.Pos())] {
+				continue
+			}
+			if ctx.Err() != nil {
+				// Finding the repository root of a package may use the network.
+				return nil, ctx.Err()
+			}
+			if obj.Pkg() == nil || obj.Pkg().Path() == "" {
+				// Skip objects that don't belong to a package.
+				continue
+			}
+
+			if paths.IsStandardImportPath(obj.Pkg().Path()) || obj.Pkg().Path() == startPath || obj.Pkg().Path() == startPath+"_test" {
+				continue
+			}
+
+			if notExported := !obj.Exported(); notExported {
+				return nil, fmt.Errorf("encountered unexpected unexported object %v, which should not be accessible by this package (%s)", obj, obj.Pkg().Path())
+			}
+
+			if local(obj.Pkg().Path()) {
+				continue
+			}
+
+			pkgPath := obj.Pkg().Path()
+			usedIn(pkgPath, obj.Name(), pk, ident.Pos())
+			// The constraints of generic types and functions, like
+			// `constraints.Ordered`, are stubbed with them.
+			for _, named := range constraintTypes(obj) {
+				constraint := named.Obj()
+				if constraint.Pkg() == nil || constraint.Pkg().Path() == pkgPath || !constraint.Exported() || local(constraint.Pkg().Path()) {
+					continue
+				}
+				pathToTypeNames[constraint.Pkg().Path()] = append(pathToTypeNames[constraint.Pkg().Path()], constraint.Name())
+				usedIn(constraint.Pkg().Path(), constraint.Name(), pk, ident.Pos())
+			}
+			switch thing := obj.(type) {
+			case *types.TypeName:
+				pathToTypeNames[pkgPath] = append(pathToTypeNames[pkgPath], obj.Name())
+			case *types.Const:
+				pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
+			case *types.Var:
+				// Ignore fields
+				if isNotAField := !thing.IsField(); isNotAField {
+					pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
+				}
+			case *types.Func:
+				switch sig := thing.Type().(type) {
+				case *types.Signature:
+					if notAMethod := sig.Recv() == nil; notAMethod {
+						// This is a normal function.
+						pathToFuncAndVarNames[pkgPath] = append(pathToFuncAndVarNames[pkgPath], thing.Name())
+					}
+				default:
+					return nil, fmt.Errorf("non-signature type %T for function %s", thing.Type(), obj.String())
+				}
+			default:
+				return nil, fmt.Errorf("unknown type %T for object %s", obj, obj.String())
+			}
+		}
+	}
+
+	// Record the methods called on values of unexported types, like the
+	// builder returned by `pkg.New()` in `pkg.New().Where(x).Build()`, so that
+	// placeholders with exactly those methods can be generated for them.
+	for _, pk := range scanned {
+		for expr, sel := range pk.TypesInfo.Selections {
+			if skipped[pk.Fset.File(expr.Pos())] {
+				continue
+			}
+			if sel.Kind() == types.MethodVal && len(sel.Index()) > 1 {
+				// Promoted methods are stubbed with the type that embeds
+				// them. If a local type embeds an external one, like
+				// `type T struct{ pkg.Base }`, the external type is stubbed
+				// with all its methods, even if the embedding isn't scanned,
+				// like in a generated file.
+				if named := embeddedExternal(sel, local); named != nil {
+					pkgPath := named.Obj().Pkg().Path()
+					pathToTypeNames[pkgPath] = append(pathToTypeNames[pkgPath], named.Obj().Name())
+					usedIn(pkgPath, named.Obj().Name(), pk, expr.Sel.Pos())
+				}
+				continue
+			}
+			if sel.Kind() != types.MethodVal {
+				continue
+			}
+			recv := sel.Recv()
+			if ptr, ok := recv.(*types.Pointer); ok {
+				recv = ptr.Elem()
+			}
+			named, ok := recv.(*types.Named)
+			if !ok || named.Obj().Exported() || named.Obj().Pkg() == nil || !sel.Obj().Exported() {
+				continue
+			}
+			pkgPath := named.Obj().Pkg().Path()
+			if _, used := pathToFuncAndVarNames[pkgPath]; !used {
+				if _, used := pathToTypeNames[pkgPath]; !used {
+					// The type is not from a package that is being stubbed.
+					continue
+				}
+			}
+			name := named.Obj().Name() + "." + sel.Obj().Name()
+			pathToTypeNames[pkgPath] = append(pathToTypeNames[pkgPath], name)
+			usedIn(pkgPath, name, pk, expr.Sel.Pos())
+		}
+	}
+
+	// Record the instantiations of generic types and functions, so that the
+	// stubs can be checked to declare them with as many type parameters.
+	pathToInstances := make(map[string][]Instance)
+	for _, pk := range scanned {
+		for _, f := range pk.Syntax {
+			if skipped[pk.Fset.File(f.Pos())] {
+				continue
+			}
+			ast.Inspect(f, func(node ast.Node) bool {
+				x, indices := indexExpr(node)
+				var ident *ast.Ident
+				switch x := x.(type) {
+				case *ast.Ident:
+					ident = x
+				case *ast.SelectorExpr:
+					ident = x.Sel
+				default:
+					return true
+				}
+				obj := pk.TypesInfo.Uses[ident]
+				switch obj.(type) {
+				case *types.TypeName, *types.Func:
+				default:
+					// An index expression of a slice, map or array.
+					return true
+				}
+				if obj.Pkg() == nil || !obj.Exported() || local(obj.Pkg().Path()) {
+					return true
+				}
+				_, isFunc := obj.(*types.Func)
+				pkgPath := obj.Pkg().Path()
+				pathToInstances[pkgPath] = append(pathToInstances[pkgPath], Instance{
+					Name:     obj.Name(),
+					Func:     isFunc,
+					Expr:     types.ExprString(node.(ast.Expr)),
+					TypeArgs: len(indices),
+					Position: pk.Fset.Position(node.Pos()),
+				})
+				return true
+			})
+		}
+	}
+
+	byPath := make(map[string]*Package)
+	pkgFor := func(path string) *Package {
+		if pkg, ok := byPath[path]; ok {
+			return pkg
+		}
+		pkg := &Package{Path: path, Types: []string{}, Values: []string{}, Modules: pathToModules[path]}
+		byPath[path] = pkg
+		return pkg
+	}
+	for pkgPath, names := range pathToTypeNames {
+		pkgFor(pkgPath).Types = cleanNames(names)
+	}
+	for pkgPath, names := range pathToFuncAndVarNames {
+		pkgFor(pkgPath).Values = cleanNames(names)
+	}
+	for _, pkg := range byPath {
+		pkg.Files = make(map[string][]string)
+		pkg.Positions = make(map[string][]token.Pos)
+		for _, name := range append(append([]string{}, pkg.Types...), pkg.Values...) {
+			files := pathToFiles[pkg.Path][name]
+			sort.Strings(files)
+			pkg.Files[name] = dedupSorted(files)
+			positions := pathToPositions[pkg.Path][name]
+			sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+			pkg.Positions[name] = positions
+		}
+		pkg.Instances = pathToInstances[pkg.Path]
+	}
+
+	result := &Result{Path: startPath, Packages: make([]*Package, 0, len(byPath))}
+	for _, pkg := range byPath {
+		result.Packages = append(result.Packages, pkg)
+	}
+	sort.Slice(result.Packages, func(i, j int) bool {
+		return result.Packages[i].Path < result.Packages[j].Path
+	})
+	return result, nil
+}
+
+// embeddedExternal returns the first type of a package that isn't `local`
+// on the path of embedded fields through which the method of `sel` is
+// promoted to a local type, or nil if there is none or it is unexported.
+func embeddedExternal(sel *types.Selection, local func(path string) bool) *types.Named {
+	deref := func(typ types.Type) types.Type {
+		if ptr, ok := typ.(*types.Pointer); ok {
+			return ptr.Elem()
+		}
+		return typ
+	}
+	typ := deref(sel.Recv())
+	if named, ok := typ.(*types.Named); ok && named.Obj().Pkg() != nil && !local(named.Obj().Pkg().Path()) {
+		// The stub of the receiver has the promoted methods.
+		return nil
+	}
+	for _, index := range sel.Index()[:len(sel.Index())-1] {
+		st, ok := typ.Underlying().(*types.Struct)
+		if !ok {
+			return nil
+		}
+		typ = deref(st.Field(index).Type())
+		named, ok := typ.(*types.Named)
+		if !ok || named.Obj().Pkg() == nil || local(named.Obj().Pkg().Path()) {
+			continue
+		}
+		if !named.Obj().Exported() {
+			return nil
+		}
+		return named
+	}
+	return nil
+}
+
+// loadMode is what loadPackages needs: the syntax and type information of
+// the scanned package, and the path and module of the packages it imports.
+// Unlike packages.LoadSyntax, it doesn't ask for the file lists and type
+// sizes, so that only the scanned package is parsed and type-checked, and
+// its dependencies are read from their export data.
+const loadMode = packages.NeedName | packages.NeedImports | packages.NeedTypes |
+	packages.NeedTypesInfo | packages.NeedSyntax | packages.NeedModule
+
+// loadPackages loads the packages matched by `patterns` in `dir`, and
+// returns the packages to scan for each of them: the package itself, or,
+// with tests, its test variant and its external test package. The first
+// package of each group is the package itself.
+func loadPackages(ctx context.Context, patterns []string, dir string, opts Options) ([][]*packages.Package, error) {
+	config := &packages.Config{
+		Context: ctx,
+		Mode:    loadMode,
+		Env:     opts.Env,
+		Tests:   opts.Tests,
+	}
+
+	// Set the package loader Dir to the `dir`; that will force
+	// the package loader to use the `go.mod` file and thus
+	// load the wanted version of the package:
+	config.Dir = dir
+
+	pkgs, err := packages.Load(config, patterns...)
+	if err != nil {
+		return nil, fmt.Errorf("error while running packages.Load: %s", err)
+	}
+
+	if err := packageErrors(pkgs, dir); err != nil {
+		return nil, err
+	}
+	if len(pkgs) == 0 {
+		return nil, fmt.Errorf("no package found in %s", dir)
+	}
+
+	// With tests, each package is loaded several times: on its own, with
+	// its internal tests as `path [path.test]`, as the external test
+	// package `path_test [path.test]`, and as the test binary `path.test`.
+	// The first two variants include both the package and its tests.
+	type variants struct {
+		plain, withTests, external *packages.Package
+	}
+	var order []string
+	byPath := make(map[string]*variants)
+	variantsOf := func(path string) *variants {
+		if v, ok := byPath[path]; ok {
+			return v
+		}
+		v := &variants{}
+		byPath[path] = v
+		order = append(order, path)
+		return v
+	}
+	for _, pkg := range pkgs {
+		i := strings.Index(pkg.ID, " [")
+		switch {
+		case i < 0 && strings.HasSuffix(pkg.ID, ".test"):
+			// The test binary.
+		case i < 0:
+			variantsOf(pkg.PkgPath).plain = pkg
+		case !strings.HasSuffix(pkg.ID, ".test]"):
+			// Not a test variant.
+		case strings.HasSuffix(pkg.PkgPath, "_test"):
+			variantsOf(strings.TrimSuffix(pkg.ID[i+2:], ".test]")).external = pkg
+		default:
+			variantsOf(pkg.PkgPath).withTests = pkg
+		}
+	}
+
+	groups := make([][]*packages.Package, 0, len(order))
+	for _, path := range order {
+		v := byPath[path]
+		first := v.plain
+		if v.withTests != nil {
+			first = v.withTests
+		}
+		if first == nil {
+			continue
+		}
+		scanned := []*packages.Package{first}
+		if v.external != nil {
+			scanned = append(scanned, v.external)
+		}
+		groups = append(groups, scanned)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("no package found in %s", dir)
+	}
+	return groups, nil
+}
+
+// skippedFiles returns the files of `scanned` that `opts` leaves out.
+func skippedFiles(scanned []*packages.Package, opts Options) map[*token.File]bool {
+	skipped := make(map[*token.File]bool)
+	for _, pk := range scanned {
+		for _, f := range pk.Syntax {
+			if opts.SkipGenerated && isGenerated(f) || requiresTag(f, opts.SkipTags) {
+				skipped[pk.Fset.File(f.Pos())] = true
+			}
+		}
+	}
+	return skipped
+}
+
+var generatedComment = regexp.MustCompile(`^// Code generated .* DO NOT EDIT\.$`)
+
+// isGenerated reports whether `f` has the comment marking generated files
+// before its package clause.
+func isGenerated(f *ast.File) bool {
+	for _, group := range f.Comments {
+		if group.Pos() >= f.Package {
+			break
+		}
+		for _, c := range group.List {
+			if generatedComment.MatchString(c.Text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiresTag reports whether a build constraint of `f` mentions one of
+// `tags`, other than negated.
+func requiresTag(f *ast.File, tags []string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for _, group := range f.Comments {
+		if group.Pos() >= f.Package {
+			break
+		}
+		for _, c := range group.List {
+			var expr string
+			switch {
+			case strings.HasPrefix(c.Text, "//go:build "):
+				expr = c.Text[len("//go:build "):]
+			case strings.HasPrefix(c.Text, "// +build "):
+				expr = c.Text[len("// +build "):]
+			default:
+				continue
+			}
+			for _, term := range strings.FieldsFunc(expr, func(r rune) bool {
+				return r == ' ' || r == ',' || r == '(' || r == ')' || r == '&' || r == '|'
+			}) {
+				for _, tag := range tags {
+					if term == tag {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// dedupSorted removes the duplicates from the sorted `names`.
+func dedupSorted(names []string) []string {
+	result := names[:0]
+	for i, name := range names {
+		if i == 0 || name != names[i-1] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func containsModule(modules []*packages.Module, mod *packages.Module) bool {
+	for _, m := range modules {
+		if m.Path == mod.Path && m.Version == mod.Version {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanNames returns the sorted, deduplicated names, without the blank
+// identifier and unexported identifiers.
+func cleanNames(names []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, name := range names {
+		if seen[name] || name == "_" || !exported(name) {
+			continue
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// exported reports whether `name` is exported. Selections of exported
+// methods (`type.Method`) count as exported, even if the type is unexported.
+func exported(name string) bool {
+	if i := strings.Index(name, "."); i >= 0 {
+		return token.IsExported(name[i+1:])
+	}
+	return token.IsExported(name)
+}
@@ -0,0 +1,164 @@
+package autodetect
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// Diagnostic is an error reported while loading a package, like a syntax
+// or type error, with its position if it has one.
+type Diagnostic struct {
+	Package string `json:"package"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Kind    string `json:"kind"` // "list", "parse", "type" or "unknown"
+	Message string `json:"message"`
+}
+
+// String formats the diagnostic like the compiler does, as
+// `file:line:column: message`.
+func (d Diagnostic) String() string {
+	if d.File == "" {
+		return d.Package + ": " + d.Message
+	}
+	pos := d.File
+	if d.Line > 0 {
+		pos += ":" + strconv.Itoa(d.Line)
+		if d.Column > 0 {
+			pos += ":" + strconv.Itoa(d.Column)
+		}
+	}
+	return pos + ": " + d.Message
+}
+
+// LoadError is returned when the packages to scan have errors. It keeps the
+// positions of the errors, so that they can be shown like compiler
+// diagnostics.
+type LoadError struct {
+	// Diagnostics are sorted by file and position; the errors without a
+	// position come last.
+	Diagnostics []Diagnostic
+}
+
+func (e *LoadError) Error() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("errors while loading packages:")
+	for i, d := range e.Diagnostics {
+		if i == 0 || d.File != e.Diagnostics[i-1].File {
+			// Separate the errors of each file, like go vet does.
+			header := d.File
+			if header == "" {
+				header = "without position"
+			}
+			buf.WriteString("\n# " + header)
+		}
+		buf.WriteString("\n" + d.String())
+	}
+	return buf.String()
+}
+
+// packageErrors returns the errors of `pkgs` and their dependencies as a
+// LoadError, with the paths of files in `dir` relative to it, or nil if
+// there are none.
+func packageErrors(pkgs []*packages.Package, dir string) *LoadError {
+	var diagnostics []Diagnostic
+	seen := make(map[Diagnostic]bool)
+	packages.Visit(pkgs, nil, func(pkg *packages.Package) {
+		positioned := false
+		for _, err := range pkg.Errors {
+			positioned = positioned || (err.Pos != "" && err.Pos != "-")
+		}
+		for _, err := range pkg.Errors {
+			d := diagnostic(pkg.PkgPath, err, dir)
+			if d.File == "" && positioned && strings.HasPrefix(d.Message, "# ") {
+				// The output of the compiler, which repeats the errors
+				// with positions.
+				continue
+			}
+			if !seen[d] {
+				seen[d] = true
+				diagnostics = append(diagnostics, d)
+			}
+		}
+	})
+	if len(diagnostics) == 0 {
+		return nil
+	}
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i], diagnostics[j]
+		if (a.File == "") != (b.File == "") {
+			return b.File == ""
+		}
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return &LoadError{Diagnostics: diagnostics}
+}
+
+// PackageErrors returns the errors of the package `pkg`, loaded from `dir`,
+// as a LoadError, or nil if it has none.
+func PackageErrors(pkg *packages.Package, dir string) *LoadError {
+	return packageErrors([]*packages.Package{pkg}, dir)
+}
+
+// diagnostic returns the Diagnostic of the error `err` of the package
+// `pkgPath`.
+func diagnostic(pkgPath string, err packages.Error, dir string) Diagnostic {
+	d := Diagnostic{Package: pkgPath, Message: err.Msg}
+	switch err.Kind {
+	case packages.ListError:
+		d.Kind = "list"
+	case packages.ParseError:
+		d.Kind = "parse"
+	case packages.TypeError:
+		d.Kind = "type"
+	default:
+		d.Kind = "unknown"
+	}
+	if err.Pos == "" || err.Pos == "-" {
+		return d
+	}
+
+	// Positions are `file:line:column`, `file:line` or `file`; file names
+	// may contain colons on Windows, so parse from the end.
+	pos := err.Pos
+	var numbers []int
+	for len(numbers) < 2 {
+		i := strings.LastIndex(pos, ":")
+		if i == -1 {
+			break
+		}
+		n, convErr := strconv.Atoi(pos[i+1:])
+		if convErr != nil {
+			break
+		}
+		numbers = append([]int{n}, numbers...)
+		pos = pos[:i]
+	}
+	d.File = pos
+	if len(numbers) > 0 {
+		d.Line = numbers[0]
+	}
+	if len(numbers) > 1 {
+		d.Column = numbers[1]
+	}
+	if dir != "" {
+		if abs, absErr := filepath.Abs(dir); absErr == nil {
+			if rel, relErr := filepath.Rel(abs, d.File); relErr == nil && !strings.HasPrefix(rel, "..") {
+				d.File = rel
+			}
+		}
+	}
+	return d
+}
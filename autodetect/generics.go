@@ -0,0 +1,64 @@
+//go:build go1.18
+// +build go1.18
+
+package autodetect
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// indexExpr returns the operand and the indices of the index expression
+// `node`, like `pkg.Map[K, V]`, or nil if it isn't one.
+func indexExpr(node ast.Node) (ast.Expr, []ast.Expr) {
+	switch node := node.(type) {
+	case *ast.IndexExpr:
+		return node.X, []ast.Expr{node.Index}
+	case *ast.IndexListExpr:
+		return node.X, node.Indices
+	}
+	return nil, nil
+}
+
+// constraintTypes returns the named types that the constraints of the type
+// parameters of the generic type or function `obj` refer to, like
+// `constraints.Ordered` in `func Max[T constraints.Ordered](a, b T) T`,
+// including those embedded in them.
+func constraintTypes(obj types.Object) []*types.Named {
+	var params *types.TypeParamList
+	switch t := obj.Type().(type) {
+	case *types.Named:
+		if obj.(*types.TypeName).IsAlias() {
+			return nil
+		}
+		params = t.TypeParams()
+	case *types.Signature:
+		params = t.TypeParams()
+	}
+	var named []*types.Named
+	seen := make(map[types.Type]bool)
+	var walk func(t types.Type)
+	walk = func(t types.Type) {
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		switch t := t.(type) {
+		case *types.Named:
+			named = append(named, t)
+			walk(t.Underlying())
+		case *types.Interface:
+			for i := 0; i < t.NumEmbeddeds(); i++ {
+				walk(t.EmbeddedType(i))
+			}
+		case *types.Union:
+			for i := 0; i < t.Len(); i++ {
+				walk(t.Term(i).Type())
+			}
+		}
+	}
+	for i := 0; i < params.Len(); i++ {
+		walk(params.At(i).Constraint())
+	}
+	return named
+}
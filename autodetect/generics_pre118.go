@@ -0,0 +1,24 @@
+//go:build !go1.18
+// +build !go1.18
+
+package autodetect
+
+import (
+	"go/ast"
+	"go/types"
+)
+
+// indexExpr returns the operand and the index of the index expression
+// `node`, or nil if it isn't one. Before Go 1.18 there are no index
+// expressions with several indices.
+func indexExpr(node ast.Node) (ast.Expr, []ast.Expr) {
+	if node, ok := node.(*ast.IndexExpr); ok {
+		return node.X, []ast.Expr{node.Index}
+	}
+	return nil, nil
+}
+
+// constraintTypes returns nil: before Go 1.18 there are no type parameters.
+func constraintTypes(obj types.Object) []*types.Named {
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+// This file contains the `batch` subcommand, which reads stub requests as
+// JSON from standard input and writes the results as JSON to standard output.
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"batch"},
+		usage: "read JSON stub requests from stdin and write JSON results to stdout",
+		run:   runBatch,
+	})
+}
+
+// batchRequest is a stub request of the `batch` subcommand.
+type batchRequest struct {
+	Package     string   `json:"package"`
+	Types       []string `json:"types,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Destination string   `json:"destination,omitempty"`
+	Vendor      bool     `json:"vendor,omitempty"`
+
+	// Options holds the values of other flags, without the leading dash,
+	// for example {"exclude_symbols": "Foo", "use_ext_types": "true"}.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+type batchInput struct {
+	Requests []batchRequest `json:"requests"`
+}
+
+// batchResult is the result of a batchRequest.
+type batchResult struct {
+	Package     string `json:"package"`
+	Destination string `json:"destination,omitempty"`
+	OK          bool   `json:"ok"`
+	Error       string `json:"error,omitempty"`
+
+	// Source is the stub, if the request has no destination.
+	Source string `json:"source,omitempty"`
+}
+
+type batchOutput struct {
+	Results []batchResult `json:"results"`
+}
+
+func runBatch(args []string) error {
+	var input batchInput
+	decoder := json.NewDecoder(os.Stdin)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil {
+		return fmt.Errorf("invalid batch request: %s", err)
+	}
+
+	base := captureFlags()
+	defer base.restore()
+	defer func() { stubStdout = os.Stdout }()
+	// Keep the messages about copied licenses out of the JSON output.
+	progress = os.Stderr
+
+	output := batchOutput{Results: make([]batchResult, 0, len(input.Requests))}
+	writeModules := false
+	copiedLicenses := make(licenseCopies)
+	for _, req := range input.Requests {
+		result := runBatchRequest(req, base, copiedLicenses)
+		writeModules = writeModules || (result.OK && req.Vendor)
+		output.Results = append(output.Results, result)
+	}
+	base.restore()
+	if writeModules {
+		finishVendor()
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&output)
+}
+
+func runBatchRequest(req batchRequest, base *flagState, copiedLicenses licenseCopies) batchResult {
+	result := batchResult{Package: req.Package}
+	fail := func(err error) batchResult {
+		result.Error = err.Error()
+		return result
+	}
+
+	base.restore()
+	for name, value := range req.Options {
+		if name == "destination" || name == "vendor" || name == "auto" || name == "print" {
+			return fail(fmt.Errorf("option %q can't be set that way in a batch request", name))
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fail(err)
+		}
+	}
+	*destination = req.Destination
+	*vendor = req.Vendor
+	if req.Package == "" {
+		return fail(fmt.Errorf("no package given"))
+	}
+
+	var src bytes.Buffer
+	stubStdout = &src
+	if err := generateStubs(runContext, copiedLicenses, req.Package, req.Types, req.Values, nil); err != nil {
+		return fail(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return fail(err)
+	}
+	result.OK = true
+	result.Destination = stubDestination(wd, req.Package)
+	result.Source = src.String()
+	return result
+}
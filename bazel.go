@@ -0,0 +1,34 @@
+package main
+
+// This file contains the emission of Bazel BUILD files for the stubs.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var bazelBuild = flag.Bool("bazel_build", false, "Also write a BUILD.bazel file with a go_library rule for the stub next to it.")
+
+// writeBazelBuild writes a BUILD.bazel file for the stub of `pkgPath` in the
+// file `stubFile`, and in the files `platformFiles` of the same directory.
+func writeBazelBuild(pkgPath string, stubFile string, platformFiles ...string) error {
+	srcs := make([]string, 0, 1+len(platformFiles))
+	for _, file := range append([]string{stubFile}, platformFiles...) {
+		srcs = append(srcs, fmt.Sprintf("%q", filepath.Base(file)))
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Code generated by depstubber. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "load(\"@io_bazel_rules_go//go:def.bzl\", \"go_library\")\n\n")
+	fmt.Fprintf(&buf, "go_library(\n")
+	fmt.Fprintf(&buf, "    name = %q,\n", path.Base(pkgPath))
+	fmt.Fprintf(&buf, "    srcs = [%s],\n", strings.Join(srcs, ", "))
+	fmt.Fprintf(&buf, "    importpath = %q,\n", pkgPath)
+	fmt.Fprintf(&buf, "    visibility = [\"//visibility:public\"],\n")
+	fmt.Fprintf(&buf, ")\n")
+	return writeFile(filepath.Join(filepath.Dir(stubFile), "BUILD.bazel"), buf.Bytes(), nil, fileAction{Package: pkgPath})
+}
@@ -0,0 +1,141 @@
+package main
+
+// This file contains the cache of the output of reflection programs, which
+// is kept in the user cache directory so that building the same program
+// against the same go.mod again is skipped.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/github/depstubber/model"
+	"golang.org/x/mod/modfile"
+)
+
+var noBuildCache = flag.Bool("no_build_cache", false, "Build and run the reflection programs again instead of using their output cached in the user cache directory.")
+
+// buildCacheVersion is changed when the format of the cached output
+// changes.
+const buildCacheVersion = 1
+
+// cachedBuild is the cached output of a reflection program and the version
+// of the module of the stubbed package it was built with.
+type cachedBuild struct {
+	Version int
+	Pkg     *model.PackedPkg
+	Module  *moduleSum
+}
+
+// buildCacheEnv are the keys of the environment variables that change how
+// the reflection program is built, or which module versions it is built
+// with, besides GOOS and GOARCH.
+var buildCacheEnv = []string{"GOFLAGS", "CGO_ENABLED", "GOEXPERIMENT", "GOPROXY", "GOPRIVATE", "GONOSUMDB"}
+
+// buildCacheKey returns the key of the output of the reflection program in
+// the build directory `buildDir`, or "" if it can't be cached. The key
+// covers the program, go.mod and go.sum, the go command and the flags and
+// environment it builds with, including the -env settings. Programs built
+// against local directories, replacing modules or with -from-dir, are never
+// cached, as the directories may change. Neither are programs built without
+// a go.sum, as the module versions they are built with are only resolved by
+// the build.
+func buildCacheKey(buildDir string) string {
+	if *noBuildCache || currentLocalSource != nil {
+		return ""
+	}
+	goVersion := cachedGoVersion()
+	if goVersion == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	goos, goarch := targetPlatform()
+	fmt.Fprintf(h, "go %s\nplatform %s/%s\nflags %s %s\n", goVersion, goos, goarch, buildModFlag(), effectiveBuildFlags())
+	keys := make(map[string]bool)
+	for _, key := range buildCacheEnv {
+		keys[envKey(key)] = true
+	}
+	for _, entry := range extraEnv {
+		keys[envKey(entry)] = true
+	}
+	for _, entry := range childEnv() {
+		if keys[envKey(entry)] {
+			fmt.Fprintf(h, "env %s\n", entry)
+		}
+	}
+	for _, name := range []string{"prog.go", "go.mod", "go.sum"} {
+		data, err := ioutil.ReadFile(filepath.Join(buildDir, name))
+		if err != nil {
+			return ""
+		}
+		if name == "go.mod" {
+			file, _, err := parseModFile(name, data)
+			if err != nil {
+				return ""
+			}
+			for _, r := range file.Replace {
+				if r.New.Version == "" && modfile.IsDirectoryPath(r.New.Path) {
+					return ""
+				}
+			}
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildCachePath returns the file caching the output with the key `key`,
+// or "" if there is no user cache directory.
+func buildCachePath(key string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "depstubber", "builds", key[:2], key+".gob")
+}
+
+// readCachedBuild returns the cached output with the key `key`, if any.
+func readCachedBuild(key string) (*cachedBuild, bool) {
+	if key == "" {
+		return nil, false
+	}
+	path := buildCachePath(key)
+	if path == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var cached cachedBuild
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cached); err != nil || cached.Version != buildCacheVersion || cached.Pkg == nil {
+		return nil, false
+	}
+	return &cached, true
+}
+
+// writeCachedBuild caches the output `pkg` of the reflection program with
+// the key `key`, built with the module version `sum`. Failing to write the
+// cache is not an error.
+func writeCachedBuild(key string, pkg *model.PackedPkg, sum *moduleSum) {
+	if key == "" {
+		return
+	}
+	path := buildCachePath(key)
+	if path == "" {
+		return
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&cachedBuild{Version: buildCacheVersion, Pkg: pkg, Module: sum}); err != nil {
+		return
+	}
+	writeCacheFile(path, buf.Bytes())
+}
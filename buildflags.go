@@ -0,0 +1,108 @@
+package main
+
+// This file contains the flags passed to the go command building the
+// reflection program.
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// buildFlagList is a list of arguments for go build, in the order they were
+// given.
+type buildFlagList []string
+
+func (l *buildFlagList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *buildFlagList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// extraBuildFlags holds the arguments of -build_flag, which are passed after
+// those of -build_flags.
+var extraBuildFlags buildFlagList
+
+func init() {
+	flag.Var(&extraBuildFlags, "build_flag", "Add a flag for go build, like '-ldflags=-X a=b c', as a single argument after those of -build_flags; may be repeated.")
+}
+
+// goBuildFlags returns the arguments of -build_flags, followed by those of
+// -build_flag.
+func goBuildFlags() ([]string, error) {
+	args, err := shellSplit(*buildFlags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -build_flags %q: %v", *buildFlags, err)
+	}
+	return append(args, extraBuildFlags...), nil
+}
+
+// effectiveBuildFlags returns -build_flags with the arguments of -build_flag
+// appended, quoted so that they split back into the same arguments.
+func effectiveBuildFlags() string {
+	s := *buildFlags
+	for _, f := range extraBuildFlags {
+		if s != "" {
+			s += " "
+		}
+		s += shellQuote(f)
+	}
+	return s
+}
+
+// shellSplit splits `s` into arguments like a POSIX shell does: at
+// unquoted white space, with single quotes keeping everything between them
+// literally, and backslashes escaping the next character outside of quotes
+// and `\`, `"`, `$` and "`" within double quotes. Other expansions are not
+// supported.
+func shellSplit(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			i++
+			arg.WriteByte(s[i])
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			arg.WriteString(s[i+1 : i+1+end])
+			i += 1 + end
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\\\"$`", s[i+1]) >= 0 {
+					i++
+				}
+				arg.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+		default:
+			arg.WriteByte(c)
+		}
+		inArg = true
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
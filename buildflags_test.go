@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestShellSplit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  string
+	}{
+		{in: "", want: nil},
+		{in: " \t\n", want: nil},
+		{in: "-tags foo", want: []string{"-tags", "foo"}},
+		{in: "  -tags\tfoo\n-race  ", want: []string{"-tags", "foo", "-race"}},
+
+		// Single quotes keep everything between them.
+		{in: `-ldflags='-X main.v=1 -s'`, want: []string{"-ldflags=-X main.v=1 -s"}},
+		{in: `'a\b' '"c"'`, want: []string{`a\b`, `"c"`}},
+		{in: `''`, want: []string{""}},
+		{in: `a''b`, want: []string{"ab"}},
+		{in: `'a'"b"c`, want: []string{"abc"}},
+
+		// Double quotes only let backslashes escape \, ", $ and `.
+		{in: `-gcflags="all=-N -l"`, want: []string{"-gcflags=all=-N -l"}},
+		{in: `"a\"b" "c\\d"`, want: []string{`a"b`, `c\d`}},
+		{in: `"\$HOME" "\` + "`" + `x\` + "`" + `"`, want: []string{"$HOME", "`x`"}},
+		{in: `"a\nb" "'c'"`, want: []string{`a\nb`, "'c'"}},
+		{in: `""`, want: []string{""}},
+
+		// Backslashes escape the next character outside of quotes.
+		{in: `a\ b`, want: []string{"a b"}},
+		{in: `\'a\' \"b\"`, want: []string{"'a'", `"b"`}},
+		{in: `a\\b`, want: []string{`a\b`}},
+		{in: `C:\\Go\\bin`, want: []string{`C:\Go\bin`}},
+
+		{in: `-ldflags='-s`, err: "unterminated single quote"},
+		{in: `a 'b' 'c`, err: "unterminated single quote"},
+		{in: `-gcflags="-N`, err: "unterminated double quote"},
+		{in: `"a\"`, err: "unterminated double quote"},
+		{in: `-tags foo\`, err: "trailing backslash"},
+		{in: `\`, err: "trailing backslash"},
+	}
+	for _, test := range tests {
+		got, err := shellSplit(test.in)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("shellSplit(%q) = %q, %v, want error %q", test.in, got, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("shellSplit(%q) = %q, %v, want %q", test.in, got, err, test.want)
+		}
+	}
+}
+
+func TestGoBuildFlags(t *testing.T) {
+	defer func(flags string, extra buildFlagList) {
+		*buildFlags, extraBuildFlags = flags, extra
+	}(*buildFlags, extraBuildFlags)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{args: nil, want: nil},
+		{args: []string{"-build_flags", "-tags foo"}, want: []string{"-tags", "foo"}},
+		{args: []string{"-build_flag", "-ldflags=-X a=b c"}, want: []string{"-ldflags=-X a=b c"}},
+		{
+			args: []string{"-build_flag", "-ldflags=-X a=b c", "-build_flags", "-tags foo", "-build_flag", "-race"},
+			want: []string{"-tags", "foo", "-ldflags=-X a=b c", "-race"},
+		},
+	}
+	for _, test := range tests {
+		*buildFlags, extraBuildFlags = "", nil
+		for i := 0; i < len(test.args); i += 2 {
+			if err := flag.Set(test.args[i][1:], test.args[i+1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := goBuildFlags()
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("goBuildFlags() with %q = %q, %v, want %q", test.args, got, err, test.want)
+		}
+		split, err := shellSplit(effectiveBuildFlags())
+		if err != nil || !reflect.DeepEqual(split, test.want) {
+			t.Errorf("effectiveBuildFlags() with %q splits into %q, %v, want %q", test.args, split, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+// This file contains the `export` and `import` subcommands, which share the
+// stubs of a vendor directory between modules as a bundle.
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+var bundleOutput = flag.String("o", "", "The file the export subcommand writes the bundle of stubs to, or '-' for stdout.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"export"},
+		usage: "write the stubs of the vendor directory, their lockfile and licenses to a .tar.gz bundle",
+		run:   runExport,
+	})
+	registerCommand(&command{
+		names: []string{"import"},
+		usage: "unpack a bundle written by export into the vendor directory",
+		run:   runImport,
+	})
+}
+
+func runExport(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	if *bundleOutput == "" {
+		return fmt.Errorf("export requires -o, the file to write the bundle to")
+	}
+	root, err := currentModuleRoot("export")
+	if err != nil {
+		return err
+	}
+	vendorDir := filepath.Join(root, "vendor")
+	files, err := bundleFiles(root)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, rel := range files {
+		data, err := ioutil.ReadFile(filepath.Join(vendorDir, rel))
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name: path.Join("vendor", filepath.ToSlash(rel)),
+			Mode: 0644,
+			Size: int64(len(data)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if *bundleOutput == "-" {
+		return writeFile("", buf.Bytes(), os.Stdout, fileAction{})
+	}
+	return writeFile(*bundleOutput, buf.Bytes(), nil, fileAction{})
+}
+
+// bundleFiles returns the sorted files of the bundle of the stubs of the
+// module in `root`, relative to its vendor directory: the lockfile, the
+// files in the directory of each stub, the other files of the directories
+// between them and the vendor directory, like the licenses of modules, and
+// the central license directory.
+func bundleFiles(root string) ([]string, error) {
+	vendorDir := filepath.Join(root, "vendor")
+	recorded, err := recordedPackages(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no stubs recorded in %s", vendorDir)
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	add := func(dir string, keep func(name string) bool) error {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || !keep(info.Name()) {
+				continue
+			}
+			rel, err := filepath.Rel(vendorDir, filepath.Join(dir, info.Name()))
+			if err != nil {
+				return err
+			}
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+		}
+		return nil
+	}
+	all := func(string) bool { return true }
+
+	if _, err := os.Stat(filepath.Join(vendorDir, lockfileName)); err == nil {
+		seen[lockfileName] = true
+		files = append(files, lockfileName)
+	}
+	for _, pkg := range recorded {
+		dir := bundledStubDir(vendorDir, pkg)
+		if err := add(dir, all); err != nil {
+			return nil, err
+		}
+		// The stubs of parent packages are bundled with their own entry.
+		for parent := filepath.Dir(dir); parent != vendorDir && strings.HasPrefix(parent, vendorDir); parent = filepath.Dir(parent) {
+			if err := add(parent, func(name string) bool { return !strings.HasSuffix(name, ".go") }); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	licensesDir := filepath.Join(vendorDir, ".licenses")
+	err = filepath.Walk(licensesDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == licensesDir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return add(filepath.Dir(path), func(name string) bool { return name == info.Name() })
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// bundledStubDir returns the directory of the stub of the recorded package
+// `pkg` in `vendorDir`, with the path escaping it was stubbed with.
+func bundledStubDir(vendorDir string, pkg lockedPackage) string {
+	pkgPath := pkg.Package
+	if pkg.Options["escape_paths"] == "true" {
+		if escaped, err := module.EscapePath(pkgPath); err == nil {
+			pkgPath = escaped
+		}
+	}
+	return filepath.Join(vendorDir, filepath.FromSlash(pkgPath))
+}
+
+func runImport(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("import expects the path of a bundle written by export")
+	}
+	root, err := currentModuleRoot("import")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("invalid bundle %s: %s", args[0], err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("invalid bundle %s: %s", args[0], err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(name, "vendor/") {
+			return fmt.Errorf("invalid bundle %s: unexpected entry %s", args[0], hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+
+		if name == path.Join("vendor", lockfileName) {
+			// Merge the lockfile of the bundle into that of the module.
+			var lock lockfile
+			if err := json.Unmarshal(data, &lock); err != nil {
+				return fmt.Errorf("invalid lockfile in bundle %s: %s", args[0], err)
+			}
+			if lock.Version > lockfileVersion {
+				return fmt.Errorf("the lockfile in bundle %s has version %d; this depstubber only supports version %d", args[0], lock.Version, lockfileVersion)
+			}
+			lockedPackages = append(lockedPackages, lock.Packages...)
+			continue
+		}
+		if err := writeFile(filepath.Join(root, filepath.FromSlash(name)), data, nil, fileAction{}); err != nil {
+			return err
+		}
+	}
+	finishVendor()
+	return nil
+}
+
+// currentModuleRoot returns the root of the module containing the current
+// directory, in which the subcommand `name` must be run.
+func currentModuleRoot(name string) (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return "", fmt.Errorf("%s must be run in a module", name)
+	}
+	return root, nil
+}
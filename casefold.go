@@ -0,0 +1,50 @@
+package main
+
+// This file contains the handling of import paths that only differ in case,
+// which collide in the vendor directory on case-insensitive file systems.
+
+import (
+	"flag"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+var escapePaths = flag.Bool("escape_paths", false, "With -vendor, put the stubs under vendor/<ESCAPED PKGPATH>, escaping upper-case letters with '!' like the module cache, so that import paths differing only in case don't collide. The go command doesn't look up such paths in vendor directories.")
+
+// vendoredPaths holds the packages stubbed into the vendor directory during
+// this run, by their lower-case import paths.
+var vendoredPaths = make(map[string]string)
+
+// vendorStubDir returns the directory of the stub of `pkgPath` in the vendor
+// directory `vendorDir`.
+func vendorStubDir(vendorDir string, pkgPath string) string {
+	if *escapePaths {
+		if escaped, err := module.EscapePath(pkgPath); err == nil {
+			pkgPath = escaped
+		}
+	}
+	return filepath.Join(vendorDir, filepath.FromSlash(pkgPath))
+}
+
+// warnCaseCollisions warns if the stub of `pkgPath` in the vendor directory
+// collides with that of another package whose import path only differs in
+// case, which was stubbed during this run or whose stub is at `stubFile`.
+func warnCaseCollisions(pkgPath string, stubFile string) {
+	if *escapePaths {
+		return
+	}
+	key := strings.ToLower(pkgPath)
+	if other, ok := vendoredPaths[key]; ok && other != pkgPath {
+		log.Printf("WARNING: %s and %s only differ in case; their stubs collide on case-insensitive file systems like those of macOS and Windows. Use -escape_paths, or stub only one of them.", other, pkgPath)
+	}
+	vendoredPaths[key] = pkgPath
+
+	if exists, _ := FileExists(stubFile); exists {
+		if existing, err := stubHeader(stubFile); err == nil && existing != nil && existing.Package != pkgPath && strings.EqualFold(existing.Package, pkgPath) {
+			log.Printf("WARNING: the stub of %s replaces that of %s, as their import paths only differ in case and the file system is case-insensitive. Use -escape_paths, or stub only one of them.", pkgPath, existing.Package)
+		}
+	}
+}
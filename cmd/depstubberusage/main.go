@@ -0,0 +1,11 @@
+// The depstubberusage command reports the uses of symbols of external
+// packages that the stubs of the vendor directory lack. Run it on its own, or
+// with `go vet -vettool=$(which depstubberusage)`.
+package main
+
+import (
+	"github.com/github/depstubber/depstubberusage"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() { singlechecker.Main(depstubberusage.Analyzer) }
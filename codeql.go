@@ -0,0 +1,112 @@
+package main
+
+// This file contains the manifest of the stubs of a vendor directory for
+// CodeQL test setups, which check that the dependencies of a test module
+// are stubs rather than the real packages.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// codeqlManifestName is the name of the manifest in the vendor directory.
+const codeqlManifestName = "codeql-stubs.json"
+
+const codeqlManifestVersion = 1
+
+var codeqlManifest = flag.Bool("codeql_manifest", false, "With -vendor, also write vendor/"+codeqlManifestName+", listing the stubbed packages with their module versions, symbols and the hashes of their stub files, for CodeQL test setups. Once written, it is kept up to date with the lockfile.")
+
+type codeqlManifestFile struct {
+	Version int `json:"version"`
+
+	// Module is the path of the test module.
+	Module   string              `json:"module"`
+	Packages []codeqlStubPackage `json:"packages"`
+
+	// Unresolved are the packages that were not stubbed, as their modules
+	// couldn't be resolved.
+	Unresolved []string `json:"unresolved,omitempty"`
+}
+
+// codeqlStubPackage describes the stub of a package.
+type codeqlStubPackage struct {
+	Package string   `json:"package"`
+	Module  string   `json:"module,omitempty"`
+	Version string   `json:"version,omitempty"`
+	Replace string   `json:"replace,omitempty"`
+	Types   []string `json:"types,omitempty"`
+	Values  []string `json:"values,omitempty"`
+
+	// Files maps the Go files of the stub, relative to the module root and
+	// with forward slashes, to their SHA-256 hashes.
+	Files map[string]string `json:"files"`
+}
+
+// writeCodeQLManifest writes the manifest of the stubs recorded in `lock`,
+// the lockfile of the vendor directory `vendorDir`, with -codeql_manifest or
+// if there already is one.
+func writeCodeQLManifest(vendorDir string, lock *lockfile) error {
+	path := filepath.Join(vendorDir, codeqlManifestName)
+	if _, err := os.Stat(path); !*codeqlManifest && err != nil {
+		return nil
+	}
+	root := filepath.Dir(vendorDir)
+
+	manifest := codeqlManifestFile{Version: codeqlManifestVersion, Packages: []codeqlStubPackage{}}
+	if modFile := loadModFile(filepath.Join(root, "go.mod")); modFile.Module != nil {
+		manifest.Module = modFile.Module.Mod.Path
+	}
+	for _, locked := range lock.Packages {
+		stub := codeqlStubPackage{
+			Package: locked.Package,
+			Types:   locked.Types,
+			Values:  locked.Values,
+			Files:   make(map[string]string),
+		}
+		if locked.Module != nil {
+			stub.Module, stub.Version, stub.Replace = locked.Module.Path, locked.Module.Version, locked.Module.Replace
+		}
+		dir := bundledStubDir(vendorDir, locked)
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, info := range infos {
+			if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), ".go") || strings.HasSuffix(info.Name(), exampleSuffix) {
+				// The examples of -examples are meant to be edited.
+				continue
+			}
+			file := filepath.Join(dir, info.Name())
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(data)
+			stub.Files[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		}
+		manifest.Packages = append(manifest.Packages, stub)
+	}
+	sort.Slice(manifest.Packages, func(i, j int) bool {
+		return manifest.Packages[i].Package < manifest.Packages[j].Package
+	})
+	for _, unresolved := range lock.Unresolved {
+		manifest.Unresolved = append(manifest.Unresolved, unresolved.Package)
+	}
+
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), nil, fileAction{})
+}
@@ -0,0 +1,130 @@
+package main
+
+// This file contains the colors of the terminal output, which make the
+// warnings, errors and summary of long runs easier to spot.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+)
+
+var colorMode = flag.String("color", "auto", "Color the warnings, errors and summary written to stderr: 'auto' colors them if stderr is a terminal and NO_COLOR is not set, 'always' or 'never'.")
+
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// stderr receives the warnings and errors; it colors them if colors are
+// enabled for os.Stderr.
+var stderr io.Writer = os.Stderr
+
+// setupColor checks the -color flag and, if colors are enabled, colors the
+// messages of the log package.
+func setupColor() {
+	switch *colorMode {
+	case "auto", "always", "never":
+	default:
+		log.Fatalf("invalid -color %q; expected auto, always or never", *colorMode)
+	}
+	if colorEnabled(os.Stderr) {
+		stderr = &colorWriter{w: os.Stderr}
+		log.SetOutput(stderr)
+	}
+}
+
+// colorEnabled reports whether the output written to `w` should be colored.
+func colorEnabled(w io.Writer) bool {
+	switch *colorMode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	// See https://no-color.org.
+	if _, ok := os.LookupEnv("NO_COLOR"); ok || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	if runtime.GOOS == "windows" && os.Getenv("WT_SESSION") == "" && os.Getenv("TERM") == "" {
+		// The legacy console doesn't interpret escape sequences.
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorize returns `s` in the color `color`.
+func colorize(color string, s string) string {
+	return color + s + colorReset
+}
+
+// colorWriter colors the warnings and errors written to `w`, line by line.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (c *colorWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		text := strings.TrimSuffix(string(line), "\n")
+		buf.WriteString(colorLine(text))
+		if len(text) < len(line) {
+			buf.WriteByte('\n')
+		}
+	}
+	if _, err := c.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// colorLine colors a line of log output: the timestamp is dimmed, the
+// label of warnings is yellow and errors are red.
+func colorLine(line string) string {
+	var timestamp string
+	// The default log prefix is "2006/01/02 15:04:05 ".
+	if len(line) >= 20 && line[4] == '/' && line[7] == '/' && line[13] == ':' && line[19] == ' ' {
+		timestamp, line = line[:20], line[20:]
+		timestamp = colorize(colorDim, timestamp[:19]) + " "
+	}
+	lower := strings.ToLower(line)
+	switch {
+	case strings.HasPrefix(lower, "warning:"):
+		label := line[:len("warning:")]
+		line = colorize(colorYellow+colorBold, label) + line[len(label):]
+	case strings.HasPrefix(lower, "error"), strings.HasPrefix(lower, "failed"), strings.HasPrefix(lower, "unable"),
+		strings.HasPrefix(lower, "building the stubbed packages failed"):
+		line = colorize(colorRed, line)
+	}
+	return timestamp + line
+}
+
+// summaryCount formats the count `n` of the change summary with `label`,
+// in the color `color` if `colored` is set and it is not zero.
+func summaryCount(colored bool, color string, n int, label string) string {
+	s := fmt.Sprintf("%d %s", n, label)
+	if !colored {
+		return s
+	}
+	if n == 0 {
+		return colorize(colorDim, s)
+	}
+	return colorize(color, s)
+}
@@ -0,0 +1,79 @@
+package main
+
+// This file contains the dispatch of depstubber subcommands.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// command is a subcommand of depstubber, invoked as `depstubber <name> [flags] [args]`.
+// The flags of a subcommand are the same as those of depstubber itself.
+type command struct {
+	names []string // the first name is the canonical one
+	usage string
+	run   func(args []string) error
+}
+
+var commands []*command
+
+func registerCommand(cmd *command) {
+	commands = append(commands, cmd)
+}
+
+// lookupCommand returns the subcommand called `name`, or nil if there is none.
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		for _, n := range cmd.names {
+			if n == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// runCommand runs the subcommand named by the first non-flag argument, if
+// there is one. It reports whether a subcommand was run.
+func runCommand() (bool, error) {
+	if flag.NArg() == 0 {
+		return false, nil
+	}
+	cmd := lookupCommand(flag.Arg(0))
+	if cmd == nil {
+		return false, nil
+	}
+
+	// Flags may follow the name of the subcommand.
+	dir := *workDir
+	if err := flag.CommandLine.Parse(flag.Args()[1:]); err != nil {
+		return true, err
+	}
+	if *workDir != dir {
+		changeWorkDir()
+	}
+	if err := startSpans(); err != nil {
+		return true, err
+	}
+	return true, cmd.run(flag.Args())
+}
+
+// printCommands writes the list of subcommands to `w`.
+func printCommands(w io.Writer) {
+	if len(commands) == 0 {
+		return
+	}
+	sorted := make([]*command, len(commands))
+	copy(sorted, commands)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].names[0] < sorted[j].names[0]
+	})
+
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range sorted {
+		fmt.Fprintf(w, "\t%-16s %s\n", cmd.names[0], cmd.usage)
+	}
+	fmt.Fprintln(w)
+}
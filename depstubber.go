@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -14,7 +15,8 @@ import (
 	"strings"
 
 	"github.com/github/depstubber/model"
-	"golang.org/x/tools/imports"
+	"github.com/github/depstubber/stubgen"
+	"golang.org/x/tools/go/packages"
 )
 
 var (
@@ -23,15 +25,88 @@ var (
 	copyrightFile  = flag.String("copyright_file", "", "Copyright file used to add copyright header")
 	writeModuleTxt = flag.Bool("write_module_txt", false, "Write a stub modules.txt to get around the go1.14 vendor check, if necessary.")
 	forceOverwrite = flag.Bool("force", false, "Delete the destination vendor directory if it already exists.")
+	matchSymbols   = flag.String("match", "", "Also stub all exported symbols whose names match this regular expression.")
+	excludeSymbols = flag.String("exclude_symbols", "", "Comma-separated list of symbols to leave out of the stubs; useful with '*' or -auto.")
+	requireLicense = flag.Bool("require_license", false, "Fail if the stub of any package ends up without a license file.")
+	offline        = flag.Bool("offline", false, "Don't use the network, e.g. to look up licenses that can't be detected locally.")
+	licenseLookup  = flag.Bool("license_lookup", false, "Look up the licenses that can't be detected locally with the deps.dev API; ignored with -offline.")
+	jsonOutput     = flag.Bool("json", false, "Print the output of the plan subcommand, and the errors in the packages -auto loads, as JSON.")
+	licenseLayout  = flag.String("license_layout", licenseLayoutPackage, "Where -auto puts license files: 'package' (next to each stub) or 'central' (under vendor/.licenses/<module>@<version>/).")
+	apiCheck       = flag.Bool("apicheck", false, "Also write a <stub>_apicheck.go file, built with -tags "+stubgen.APICheckTag+", that checks the stub against the real package.")
+	examples       = flag.Bool("examples", false, "Also write a <stub>_example_test.go file constructing each stubbed type, as a skeleton for test cases; it is kept once it exists, so that it can be edited.")
+	vendorGoMod    = flag.Bool("vendor_go_mod", false, "Also copy the go.mod file of the module of each stub into the vendor directory, at the root of the module like its license.")
+	prune          = flag.Bool("prune", false, "Remove the unexported declarations, like placeholder types, that nothing exported in a stub refers to, and the imports only they used.")
+	workDir        = flag.String("C", "", "Change to this directory before doing anything else; relative paths in other flags are relative to it.")
 )
+
+// runContext is cancelled when depstubber is interrupted.
+var runContext = context.Background()
+
+// stubStdout receives the stubs that have no destination file.
+var stubStdout io.Writer = os.Stdout
+
 var (
 	modeAutoDetection      = flag.Bool("auto", false, "Automatically detect and stub dependencies of the Go package in the current directory.")
-	modePrintGoGenComments = flag.Bool("print", false, "Automatically detect and generate 'go generate' comments for the Go package in the current directory.")
+	modePrintGoGenComments = flag.Bool("print", false, "Automatically detect and generate 'go generate' comments for the Go package in the current directory; may be combined with -auto.")
+	skipGenerated          = flag.Bool("skip_generated", false, "Make -auto and -print ignore the uses in generated files.")
+	skipBuildTags          = flag.String("skip_build_tags", "", "Comma-separated list of build tags, like 'tools,ignore'; make -auto and -print ignore the uses in files constrained by them.")
 )
 
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	setupColor()
+	changeWorkDir()
+	runContext = interruptContext()
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := startSpans(); err != nil {
+		log.Fatal(err)
+	}
+
+	if ran, err := runCommand(); ran {
+		stopProfiling()
+		if !planOnly {
+			printSummary(os.Stderr)
+			printTimings(os.Stderr)
+		}
+		finishSpans(err)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	runStubs()
+	finishSpans(nil)
+	stopProfiling()
+	printSummary(os.Stderr)
+	printTimings(os.Stderr)
+	if wd, err := os.Getwd(); err == nil {
+		if err := checkStubVersions(findModuleRoot(wd)); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// changeWorkDir changes to the directory given with -C, if any.
+func changeWorkDir() {
+	if *workDir == "" {
+		return
+	}
+	if err := os.Chdir(*workDir); err != nil {
+		log.Fatalf("Unable to change directory: %v", err)
+	}
+}
+
+// runStubs stubs the packages given on the command line, or the
+// auto-detected dependencies.
+func runStubs() {
+	if *licenseLayout != licenseLayoutPackage && *licenseLayout != licenseLayoutCentral {
+		log.Fatalf("Unknown license layout %q; expected %q or %q", *licenseLayout, licenseLayoutPackage, licenseLayoutCentral)
+	}
 
 	// if -write_module_txt has been passed, generate a stub version of a `module/vendor.txt` file
 	if *writeModuleTxt {
@@ -39,36 +114,53 @@ func main() {
 		return
 	}
 
-	if *modePrintGoGenComments {
-		pathToTypeNames, pathToFuncAndVarNames, _, err := autoDetect(".", ".")
+	if *modePrintGoGenComments && !*modeAutoDetection {
+		pathToTypeNames, pathToFuncAndVarNames, _, _, err := autoDetect(".")
 		if err != nil {
-			log.Fatalf("Error while auto-detecting imported objects: %s", err)
+			fatalDetectionError(err)
 		}
 		printGoGenerateComments(pathToTypeNames, pathToFuncAndVarNames)
 		return
 	}
 
-	if *vendor && *forceOverwrite {
+	if *stubVersions != "" && *modeAutoDetection {
+		log.Fatal("-versions can't be combined with -auto")
+	}
+
+	// With -versions, the runs stubbing each version clean their own vendor
+	// directories.
+	if *vendor && *forceOverwrite && *stubVersions == "" {
 		wd, err := os.Getwd()
 		if err != nil {
 			log.Fatalf("Unable to load current director: %v", err)
 		}
 		{ // Remove current ./vendor dir if exists:
 			vendorDir := filepath.Join(findModuleRoot(wd), "vendor")
-			exists, err := DirExists(vendorDir)
-			if err != nil {
+			if err := removeAll(vendorDir); err != nil {
 				panic(err)
 			}
-			if exists {
-				os.RemoveAll(vendorDir)
-			}
 		}
 	}
 
+	startStream()
 	if *modeAutoDetection {
-		pathToTypeNames, pathToFuncAndVarNames, pathToDirs, err := autoDetect(".", ".")
+		pathToTypeNames, pathToFuncAndVarNames, pathToModules, pathToFiles, err := autoDetect(".")
 		if err != nil {
-			log.Fatalf("Error while auto-detecting imported objects: %s", err)
+			fatalDetectionError(err)
+		}
+		if *vendor {
+			wd, err := os.Getwd()
+			if err != nil {
+				log.Fatalf("Unable to load current directory: %v", err)
+			}
+			if err := writeDetectionMap(findModuleRoot(wd), pathToTypeNames, pathToFuncAndVarNames, pathToFiles); err != nil {
+				log.Fatalf("Unable to write the detection map: %v", err)
+			}
+		}
+		if *modePrintGoGenComments {
+			// Reuse the result of the detection rather than loading the
+			// package graph a second time.
+			printGoGenerateComments(pathToTypeNames, pathToFuncAndVarNames)
 		}
 		pkgPaths := make([]string, 0)
 		{
@@ -82,101 +174,339 @@ func main() {
 			sort.Strings(pkgPaths)
 		}
 
+		var modules []*packages.Module
+		for _, pkgPath := range pkgPaths {
+			modules = append(modules, pathToModules[pkgPath]...)
+		}
+		prefetchLicenses(modules)
+
+		copiedLicenses := make(licenseCopies)
 		for _, pkgPath := range pkgPaths {
 			createStubs(
+				copiedLicenses,
 				pkgPath,
 				pathToTypeNames[pkgPath],
 				pathToFuncAndVarNames[pkgPath],
-				pathToDirs[pkgPath],
+				pathToModules[pkgPath],
 			)
 		}
 	} else {
-		if flag.NArg() != 2 && flag.NArg() != 3 {
+		if (flag.NArg() != 1 || *matchSymbols == "") && flag.NArg() != 2 && flag.NArg() != 3 {
 			usage()
-			log.Fatal("Expected exactly two or three arguments")
+			log.Fatal("Expected exactly two or three arguments, or one argument with -match")
 		}
 		packageName := flag.Arg(0)
-		createStubs(packageName, split(flag.Arg(1)), split(flag.Arg(2)), nil)
+		if *stubVersions != "" {
+			if err := stubVersionsInRoots(packageName, flag.Args()[1:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		createStubs(make(licenseCopies), packageName, split(flag.Arg(1)), split(flag.Arg(2)), nil)
+	}
+	if currentStream != nil {
+		if err := currentStream.close(); err != nil {
+			log.Fatalf("Failed writing the archive: %v", err)
+		}
 	}
 	if *vendor {
-		stubModulesTxt()
+		finishVendor()
+	}
+	if *requireLicense && !planOnly {
+		if unlicensed := unlicensedPackages(); len(unlicensed) > 0 {
+			log.Fatalf("No license file found for the stubs of: %s", strings.Join(unlicensed, ", "))
+		}
+	}
+}
+
+func createStubs(copiedLicenses licenseCopies, packageName string, typeNames []string, funcAndVarNames []string, licenseModules []*packages.Module) {
+	var src bytes.Buffer
+	if currentStream != nil {
+		stubStdout = &src
+		defer func() { stubStdout = os.Stdout }()
+	}
+	if err := generateStubs(runContext, copiedLicenses, packageName, typeNames, funcAndVarNames, licenseModules); err != nil {
+		exitIfInterrupted(runContext)
+		if skipUnresolved(err) {
+			return
+		}
+		log.Fatal(err)
+	}
+	if currentStream != nil {
+		if err := currentStream.add(packageName, src.Bytes()); err != nil {
+			log.Fatalf("Failed writing to stdout: %v", err)
+		}
 	}
 }
 
-func createStubs(packageName string, typeNames []string, funcAndVarNames []string, licenseDirs []string) {
+// generateStubs writes the stub of the given symbols of package `packageName`
+// to the destination, and copies the licenses of `licenseModules` next to it,
+// unless they are in `copiedLicenses`, the license directories filled by
+// the run so far.
+func generateStubs(ctx context.Context, copiedLicenses licenseCopies, packageName string, typeNames []string, funcAndVarNames []string, licenseModules []*packages.Module) error {
+	packageSpan = startSpan(runSpan, "stub", map[string]string{"package": packageName})
+	err := stubPackage(ctx, copiedLicenses, packageName, typeNames, funcAndVarNames, licenseModules)
+	packageSpan.end(err)
+	packageSpan = nil
+	return err
+}
+
+// stubPackage generates the stub of generateStubs.
+func stubPackage(ctx context.Context, copiedLicenses licenseCopies, packageName string, typeNames []string, funcAndVarNames []string, licenseModules []*packages.Module) error {
 
 	var pkg *model.PackedPkg
 	var err error
 
+	typeNames = removeExcluded(typeNames)
+	funcAndVarNames = removeExcluded(funcAndVarNames)
+
 	if packageName == "." {
 		dir, err := os.Getwd()
 		if err != nil {
-			log.Fatalf("Get current directory failed: %v", err)
+			return fmt.Errorf("Get current directory failed: %v", err)
 		}
 		packageName, err = packageNameOfDir(dir)
 		if err != nil {
-			log.Fatalf("Parse package name failed: %v", err)
+			return fmt.Errorf("Parse package name failed: %v", err)
+		}
+	}
+
+	if *fromDir != "" {
+		if *modReadonly {
+			return fmt.Errorf("-mod_readonly can't be combined with -from-dir")
+		}
+		src, err := openLocalSource(packageName, *fromDir)
+		if err != nil {
+			return fmt.Errorf("Loading %s failed: %v", *fromDir, err)
 		}
+		defer src.close()
+		currentLocalSource = src
+		defer func() { currentLocalSource = nil }()
 	}
 
-	pkg, err = reflectMode(packageName, typeNames, funcAndVarNames)
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("Unable to load current directory: %v", err)
+	}
+	dst := stubDestination(wd, packageName)
+	if *vendor {
+		warnCaseCollisions(packageName, dst)
+	}
 
+	cacheKey := stubCacheKey(findModuleRoot(wd), packageName, dst, typeNames, funcAndVarNames)
+	cached, err := restoreCachedStub(cacheKey, packageName, dst)
 	if err != nil {
-		log.Fatalf("Loading input failed: %v", err)
+		return fmt.Errorf("Failed writing the cached stub of %s: %v", packageName, err)
 	}
 
-	dst := os.Stdout
-	if *vendor {
-		wd, err := os.Getwd()
-		if err != nil {
-			log.Fatalf("Unable to load current director: %v", err)
-		}
+	var stubs []platformStub
+	if cached {
+		// The files of the stub were copied from the cache.
+	} else if *platforms != "" {
+		stubs, err = reflectPlatforms(ctx, packageName, typeNames, funcAndVarNames)
+	} else {
+		pkg, err = reflectMode(ctx, packageName, typeNames, funcAndVarNames)
+	}
 
-		*destination = filepath.Join(findModuleRoot(wd), "vendor", packageName, "stub.go")
+	if _, ok := err.(*unresolvableError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("Loading input failed: %v", err)
+	}
+	if pkg != nil {
+		for _, note := range pkg.Notes {
+			log.Printf("%s: %s", packageName, note)
+		}
+	}
+	if *apiCheck && dst == "" {
+		return fmt.Errorf("-apicheck requires -destination or -vendor")
+	}
+	if stubs != nil && dst == "" {
+		return fmt.Errorf("-goos requires -destination or -vendor")
+	}
+	if stubs != nil && *apiCheck {
+		return fmt.Errorf("-apicheck can't be combined with -goos")
+	}
+	if *examples && dst == "" {
+		return fmt.Errorf("-examples requires -destination or -vendor")
+	}
+	if stubs != nil && *examples {
+		return fmt.Errorf("-examples can't be combined with -goos")
 	}
 
-	if len(*destination) > 0 {
-		if err := os.MkdirAll(filepath.Dir(*destination), os.ModePerm); err != nil {
-			log.Fatalf("Unable to create directory: %v", err)
+	sum := lookupModuleSum(findModuleRoot(wd), packageName)
+	if resolved := buildModules[packageName]; resolved != nil && (sum == nil || sum.Replace == "") {
+		sum = resolved
+	}
+	if currentLocalSource != nil {
+		sum = currentLocalSource.sum()
+		if licenseModules == nil {
+			licenseModules = []*packages.Module{currentLocalSource.module()}
 		}
-		f, err := os.Create(*destination)
+	}
+	if sum != nil && sum.Replace != "" && licenseModules == nil {
+		// The stub is of the local copy, so copy the license of that too.
+		modules, err := loadModules(findModuleRoot(wd), []string{packageName})
 		if err != nil {
-			log.Fatalf("Failed opening destination file: %v", err)
+			return fmt.Errorf("Loading the replacement of %s failed: %v", sum.Path, err)
+		}
+		licenseModules = modules[packageName]
+	}
+	if currentLocalSource == nil {
+		if err := checkRetracted(ctx, findModuleRoot(wd), sum); err != nil {
+			return fmt.Errorf("Stubbing %s failed: %v", packageName, err)
 		}
-		defer f.Close()
-		dst = f
 	}
 
-	g := new(generator)
-	g.srcPackage = packageName
-	g.srcExports = strings.Join(typeNames, ",")
-	g.srcFunctions = strings.Join(funcAndVarNames, ",")
+	license := licenseConfig{
+		destination: dst,
+		layout:      *licenseLayout,
+		lookup:      *licenseLookup && !*offline,
+		copiedDirs:  copiedLicenses,
+	}
+	if root := findModuleRoot(wd); root != "" {
+		license.vendorDir = filepath.Join(root, "vendor")
+	}
+	g := &stubgen.Generator{
+		Package:           packageName,
+		Types:             typeNames,
+		Values:            funcAndVarNames,
+		Excluded:          split(*excludeSymbols),
+		LicenseExpression: license.expression(ctx, licenseModules),
+	}
+	if sum != nil {
+		g.ModuleSum = sum.String()
+	}
+	if g.LintDirectives, err = lintIgnoreDirectives(); err != nil {
+		return err
+	}
+	if g.UseAny, err = useAny(); err != nil {
+		return err
+	}
+	g.Prune = *prune
 
 	if *copyrightFile != "" {
 		header, err := ioutil.ReadFile(*copyrightFile)
 		if err != nil {
-			log.Fatalf("Failed reading copyright file: %v", err)
+			return fmt.Errorf("Failed reading copyright file: %v", err)
 		}
 
-		g.copyrightHeader = string(header)
-	} else {
-		// check that there is a LICENSE file
+		g.CopyrightHeader = string(header)
+	}
+
+	var platformFiles []string
+	if cached {
+		// restoreCachedStub already wrote the files.
+	} else if stubs != nil {
+		platformFiles, err = writePlatformStubs(g, stubs, packageName, dst)
+		if err != nil {
+			return err
+		}
+	} else if dst != "" && !*apiCheck && !*prune && pkg.Size() > stubgen.StreamThreshold {
+		// Very large stubs are formatted in chunks and written as they go.
+		err := timeGeneration(g, func() error {
+			return writeFileFrom(dst, func(w io.Writer) error {
+				return g.Stream(pkg, w)
+			}, fileAction{Package: packageName})
+		})
+		if err != nil {
+			if outErr, ok := err.(*stubgen.OutputError); ok {
+				outErr.InvalidFile = writeInvalidSource(dst, outErr.Source)
+			}
+			return fmt.Errorf("Failed generating stub for %s: %v", packageName, err)
+		}
+	} else if err := writeStub(g, pkg, packageName, dst); err != nil {
+		return err
+	}
+	if *bazelBuild && dst != "" && !cached {
+		if err := writeBazelBuild(packageName, dst, platformFiles...); err != nil {
+			return fmt.Errorf("Failed writing BUILD file: %v", err)
+		}
+	}
+	if *writeReadme && dst != "" && !cached {
+		if err := writeStubReadme(packageName, dst, typeNames, funcAndVarNames, sum, g.LicenseExpression); err != nil {
+			return fmt.Errorf("Failed writing %s: %v", stubReadmeName, err)
+		}
+	}
+	if cacheKey != "" && !cached {
+		writeCachedStub(cacheKey, packageName, dst, sum)
+	}
+
+	copied, err := license.copyLicenses(ctx, packageName, licenseModules)
+	for _, modLicense := range copied {
+		if modLicense.Source != "" {
+			fmt.Fprintf(progress, "License of %s: %s (from %s)\n", modLicense.Module, modLicense.Expression, modLicense.Source)
+		} else {
+			fmt.Fprintf(progress, "License of %s: %s\n", modLicense.Module, modLicense.Expression)
+		}
+		for _, file := range modLicense.Files {
+			fmt.Fprintf(progress, "Copying %s to %s\n", file.From, file.To)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to find/copy licenses: %v", err)
+	}
+	if err := license.recordLicenseDirs(packageName, licenseModules); err != nil {
+		return fmt.Errorf("Failed to find/copy licenses: %v", err)
+	}
+	if *vendorGoMod {
+		if err := license.copyGoMods(packageName, licenseModules); err != nil {
+			return fmt.Errorf("Failed to copy go.mod files: %v", err)
+		}
+	}
+	if *vendor {
+		recordLockedPackage(packageName, typeNames, funcAndVarNames, sum, g.LicenseExpression)
 	}
+	return nil
+}
 
-	if err := g.Generate(pkg); err != nil {
-		log.Fatalf("Failed generating mock: %v", err)
+// stubDestination returns the file the stub of `packageName` is written to
+// from the directory `wd`: the stub in the vendor directory of its module
+// with -vendor, and -destination otherwise, where "" is stdout.
+func stubDestination(wd string, packageName string) string {
+	if *vendor {
+		return filepath.Join(vendorStubDir(filepath.Join(findModuleRoot(wd), "vendor"), packageName), "stub.go")
 	}
-	if _, err := dst.Write(g.Output()); err != nil {
-		log.Fatalf("Failed writing to destination: %v", err)
+	return *destination
+}
+
+// writeStub writes the stub of `pkg` generated by `g` to `dst`, and its API
+// check if requested.
+func writeStub(g *stubgen.Generator, pkg *model.PackedPkg, packageName string, dst string) error {
+	// Only write the destination once the stub is known to be valid, so that
+	// a failure does not leave an empty file behind.
+	var src []byte
+	err := timeGeneration(g, func() (err error) {
+		src, err = g.Source(pkg)
+		return err
+	})
+	if err != nil {
+		if outErr, ok := err.(*stubgen.OutputError); ok {
+			outErr.InvalidFile = writeInvalidSource(dst, outErr.Source)
+		}
+		return fmt.Errorf("Failed generating stub for %s: %v", packageName, err)
 	}
 
-	if err := copyLicenses(licenseDirs); err != nil {
-		log.Fatalf("Failed to find/copy licenses: %v", err)
+	if err := writeFile(dst, src, stubStdout, fileAction{Package: packageName}); err != nil {
+		return fmt.Errorf("Failed writing to destination: %v", err)
+	}
+	checkInstances(packageName, src)
+	if *apiCheck {
+		if err := writeAPICheck(packageName, dst, src); err != nil {
+			return err
+		}
+	}
+	if *examples {
+		if err := writeExample(packageName, dst, src); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func usage() {
 	_, _ = io.WriteString(os.Stderr, usageText)
+	printCommands(os.Stderr)
 	flag.PrintDefaults()
 }
 
@@ -186,60 +516,89 @@ It generates stub methods and functions by building a program
 that uses reflection. It requires two or three non-flag
 arguments: an import path, and a comma-separated list of
 symbols, and a comma-separated list of function names.
+A '*' in either list stands for all exported symbols of that kind,
+and a regular expression enclosed in slashes stands for all exported
+symbols of that kind whose names match it; alternatively, -match
+selects symbols of both kinds by regular expression. Use
+-exclude_symbols to leave some of the selected symbols out.
 Examples:
 	depstubber database/sql/driver Conn,Driver
 	depstubber github.com/Masterminds/squirrel '' Expr
+	depstubber -exclude_symbols Register database/sql '*' '*'
+	depstubber database/sql '/^Null/' '/^Err/'
+	depstubber net/http Client.Do,Client.Get
+	depstubber -match '^Client' github.com/my/sdk
+	depstubber -C ./service -vendor -auto
 
-`
+Run 'depstubber doctor' to check that the environment can build and
+run the reflection program.
 
-type generator struct {
-	buf                                  bytes.Buffer
-	srcPackage, srcExports, srcFunctions string // may be empty
-	copyrightHeader                      string
-
-	packageMap map[string]string // map from import path to package name
-}
+`
 
-func (g *generator) p(format string, args ...interface{}) {
-	fmt.Fprintf(&g.buf, format+"\n", args...)
+// writeAPICheck writes the file checking the stub `src` against the real
+// package next to the stub file `dst`.
+func writeAPICheck(packageName string, dst string, src []byte) error {
+	check, err := stubgen.APICheck(packageName, src)
+	if err != nil {
+		return fmt.Errorf("Failed generating API check for %s: %v", packageName, err)
+	}
+	path := strings.TrimSuffix(dst, ".go") + "_apicheck.go"
+	if err := writeFile(path, check, nil, fileAction{Package: packageName}); err != nil {
+		return fmt.Errorf("Failed writing API check: %v", err)
+	}
+	return nil
 }
 
-func (g *generator) Generate(pkg *model.PackedPkg) error {
-	g.p("// Code generated by depstubber. DO NOT EDIT.")
+// exampleSuffix ends the name of the file -examples writes next to a stub.
+const exampleSuffix = "_example_test.go"
 
-	g.p("// This is a simple stub for %s, strictly for use in testing.", g.srcPackage)
-	g.p("")
+// writeExample writes the example test for the stub `src` next to the stub
+// file `dst`, unless it already exists.
+func writeExample(packageName string, dst string, src []byte) error {
+	example, err := stubgen.Example(packageName, src)
+	if err != nil {
+		return fmt.Errorf("Failed generating example for %s: %v", packageName, err)
+	}
+	path := strings.TrimSuffix(dst, ".go") + exampleSuffix
+	if err := writeNewFile(path, example, fileAction{Package: packageName}); err != nil {
+		return fmt.Errorf("Failed writing example: %v", err)
+	}
+	return nil
+}
 
-	if g.copyrightHeader != "" {
-		g.p("// See the license below for information about the licensing of the original library.")
-		g.p("")
+// writeNewFile writes `data` to `path` like writeFile, unless the file
+// already exists, as the files written with it are meant to be edited.
+func writeNewFile(path string, data []byte, action fileAction) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return writeFile(path, data, nil, action)
+}
 
-		lines := strings.Split(g.copyrightHeader, "\n")
-		for _, line := range lines {
-			g.p("// %s", line)
+// writeInvalidSource saves the unformatted source of a stub that failed to
+// format next to its destination, or into a temporary file if the stub was
+// going to be written to stdout. It returns the path of the saved file, or
+// an empty string if it could not be saved.
+func writeInvalidSource(dst string, src []byte) string {
+	var path string
+	if dst != "" {
+		path = dst + ".invalid"
+		if err := ioutil.WriteFile(path, src, 0666); err != nil {
+			log.Printf("Failed to save the invalid source: %v", err)
+			return ""
 		}
-		g.p("")
-	} else {
-		// if no copyright file was specified, assume there is a LICENSE file
-		g.p("// See the LICENSE file for information about the licensing of the original library.")
+		return path
 	}
 
-	g.p("// Source: %s (exports: %s; functions: %s)", g.srcPackage, g.srcExports, g.srcFunctions)
-	g.p("")
-
-	g.p("")
-
-	g.p(pkg.Body)
-
-	return nil
-}
-
-// Output returns the generator's output, formatted in the standard Go style.
-func (g *generator) Output() []byte {
-	// Format source and add or remove import statements as necessary:
-	src, err := imports.Process("", g.buf.Bytes(), nil)
+	f, err := ioutil.TempFile("", "depstubber_*.go.invalid")
 	if err != nil {
-		log.Fatalf("Failed to format generated source code: %s\n%s", err, g.buf.String())
+		log.Printf("Failed to save the invalid source: %v", err)
+		return ""
+	}
+	defer f.Close()
+	if _, err := f.Write(src); err != nil {
+		log.Printf("Failed to save the invalid source: %v", err)
+		return ""
 	}
-	return src
+	return f.Name()
 }
@@ -0,0 +1,175 @@
+// Package depstubberusage defines an Analyzer that reports the uses of
+// symbols of external packages that the stubs of the vendor directory lack.
+package depstubberusage
+
+import (
+	"bufio"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/github/depstubber/autodetect"
+	"golang.org/x/tools/go/analysis"
+)
+
+const doc = `report uses of external symbols that lack stubs
+
+The depstubberusage analyzer finds the symbols of external packages that a
+package uses, like depstubber -auto does, and reports each use of a symbol
+that the stub of its package in the vendor directory of the module doesn't
+declare, or of a package that has no stub there.`
+
+// Analyzer reports the uses of external symbols that lack stubs.
+var Analyzer = &analysis.Analyzer{
+	Name: "depstubberusage",
+	Doc:  doc,
+	Run:  run,
+}
+
+var (
+	skipGenerated bool
+	skipBuildTags string
+)
+
+func init() {
+	Analyzer.Flags.BoolVar(&skipGenerated, "skip_generated", false, "ignore the uses in generated files")
+	Analyzer.Flags.StringVar(&skipBuildTags, "skip_build_tags", "", "comma-separated list of build tags; ignore the uses in files constrained by them")
+}
+
+// generatedMarker is the first line of the files depstubber generates,
+// after their build constraints.
+const generatedMarker = "// Code generated by depstubber. DO NOT EDIT."
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	if len(pass.Files) == 0 {
+		return nil, nil
+	}
+	modRoot := findModuleRoot(filepath.Dir(pass.Fset.Position(pass.Files[0].Pos()).Filename))
+	if modRoot == "" {
+		return nil, nil
+	}
+
+	opts := autodetect.Options{SkipGenerated: skipGenerated}
+	if skipBuildTags != "" {
+		opts.SkipTags = strings.Split(skipBuildTags, ",")
+	}
+	result, err := autodetect.ScanTypes(pass.Pkg, pass.Fset, pass.Files, pass.TypesInfo, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pkg := range result.Packages {
+		stubDir := filepath.Join(modRoot, "vendor", filepath.FromSlash(pkg.Path))
+		declared, vendored := stubDeclarations(stubDir)
+		if vendored {
+			// The real package is vendored.
+			continue
+		}
+		rel, err := filepath.Rel(modRoot, stubDir)
+		if err != nil {
+			rel = stubDir
+		}
+		for _, name := range append(append([]string{}, pkg.Types...), pkg.Values...) {
+			if strings.Contains(name, ".") {
+				// Methods of unexported types are stubbed on placeholders.
+				continue
+			}
+			if declared == nil {
+				for _, pos := range pkg.Positions[name] {
+					pass.Reportf(pos, "%s.%s is used, but %s has no stub in %s", pkg.Path, name, pkg.Path, filepath.ToSlash(rel))
+				}
+			} else if !declared[name] {
+				for _, pos := range pkg.Positions[name] {
+					pass.Reportf(pos, "%s.%s is used, but the stub in %s doesn't declare it", pkg.Path, name, filepath.ToSlash(rel))
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// stubDeclarations returns the package-level identifiers declared by the
+// files depstubber generated in `dir`, or nil if there are none. It also
+// reports whether `dir` holds other Go files, as it does if the real
+// package is vendored.
+func stubDeclarations(dir string) (map[string]bool, bool) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, false
+	}
+	var declared map[string]bool
+	fset := token.NewFileSet()
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".go") {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		if !generatedByDepstubber(path) {
+			return nil, true
+		}
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			continue
+		}
+		if declared == nil {
+			declared = make(map[string]bool)
+		}
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					declared[decl.Name.Name] = true
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						declared[spec.Name.Name] = true
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							declared[name.Name] = true
+						}
+					}
+				}
+			}
+		}
+	}
+	return declared, false
+}
+
+// generatedByDepstubber reports whether the Go file at `path` was generated
+// by depstubber.
+func generatedByDepstubber(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "//go:build ") && !strings.HasPrefix(line, "// +build ") {
+			return line == generatedMarker
+		}
+	}
+	return false
+}
+
+// findModuleRoot returns the directory of the go.mod file of the module
+// containing `dir`, or "" if there is none.
+func findModuleRoot(dir string) string {
+	for {
+		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
+			return dir
+		}
+		d := filepath.Dir(dir)
+		if d == dir {
+			return ""
+		}
+		dir = d
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+// This file contains the `run-directives` subcommand, which executes the
+// `//go:generate depstubber ...` directives of a module without go generate.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"run-directives"},
+		usage: "execute the depstubber go:generate directives of the current module, one after another",
+		run:   runDirectives,
+	})
+}
+
+const generatePrefix = "//go:generate "
+
+// directive is a `//go:generate depstubber ...` comment.
+type directive struct {
+	file string
+	line int
+	args []string // the arguments of depstubber
+}
+
+func (d *directive) pos() string {
+	return fmt.Sprintf("%s:%d", d.file, d.line)
+}
+
+// findDirectives returns the depstubber directives of the Go files under
+// `root`, in the order go generate would run them. Like the go command, it
+// skips vendor and testdata directories and directories starting with
+// "." or "_".
+func findDirectives(root string) ([]*directive, error) {
+	var directives []*directive
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := info.Name()
+		if info.IsDir() {
+			if path != root && (name == "vendor" || name == "testdata" ||
+				strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") {
+			return nil
+		}
+
+		fileDirectives, err := parseDirectives(path)
+		if err != nil {
+			return err
+		}
+		directives = append(directives, fileDirectives...)
+		return nil
+	})
+	return directives, err
+}
+
+// parseDirectives returns the depstubber directives of the Go file at `path`.
+func parseDirectives(path string) ([]*directive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var directives []*directive
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if !strings.HasPrefix(text, generatePrefix) {
+			continue
+		}
+		words, err := splitDirective(text[len(generatePrefix):], path, line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		if len(words) == 0 || strings.TrimSuffix(filepath.Base(words[0]), ".exe") != "depstubber" {
+			continue
+		}
+		directives = append(directives, &directive{path, line, words[1:]})
+	}
+	return directives, scanner.Err()
+}
+
+// splitDirective splits the command line of a go:generate directive into
+// words the way go generate does: words are separated by spaces, double-quoted
+// strings are single words with Go escapes, and $NAME is expanded from the
+// environment and the variables go generate defines.
+func splitDirective(text string, file string, line int) ([]string, error) {
+	vars := map[string]string{
+		"GOFILE":    filepath.Base(file),
+		"GOLINE":    strconv.Itoa(line),
+		"GOPACKAGE": packageOfFile(file),
+		"DOLLAR":    "$",
+	}
+	expand := func(word string) string {
+		return os.Expand(word, func(name string) string {
+			if value, ok := vars[name]; ok {
+				return value
+			}
+			return os.Getenv(name)
+		})
+	}
+
+	var words []string
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimLeft(text, " \t") {
+		if text[0] != '"' {
+			end := strings.IndexAny(text, " \t")
+			if end < 0 {
+				end = len(text)
+			}
+			words = append(words, expand(text[:end]))
+			text = text[end:]
+			continue
+		}
+
+		end := 1
+		for ; end < len(text) && text[end] != '"'; end++ {
+			if text[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(text) {
+			return nil, fmt.Errorf("mismatched quoted string in go:generate directive")
+		}
+		quoted := text[:end+1]
+		word, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+		words = append(words, expand(word))
+		text = text[len(quoted):]
+	}
+	return words, nil
+}
+
+// packageOfFile returns the name of the package declared in the Go file at
+// `path`, or "" if it can't be read.
+func packageOfFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "package" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// flagState holds the values of the flags depstubber was invoked with, which
+// are the defaults for the flags of the directives.
+type flagState struct {
+	values     map[string]string
+	env        envOverrides
+	buildFlags buildFlagList
+}
+
+func captureFlags() *flagState {
+	state := &flagState{values: make(map[string]string)}
+	flag.Visit(func(f *flag.Flag) {
+		state.values[f.Name] = f.Value.String()
+	})
+	state.env = append(state.env, extraEnv...)
+	state.buildFlags = append(state.buildFlags, extraBuildFlags...)
+	return state
+}
+
+// restore sets all flags back to their values in `state`.
+func (state *flagState) restore() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := state.values[f.Name]; ok {
+			_ = f.Value.Set(value)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+	})
+	// The -env and -build_flag flags accumulate their values.
+	extraEnv = append(envOverrides(nil), state.env...)
+	extraBuildFlags = append(buildFlagList(nil), state.buildFlags...)
+}
+
+// parseDirective applies the flags of `d` on top of `base` and returns
+// its remaining arguments.
+func parseDirective(d *directive, base *flagState) ([]string, error) {
+	base.restore()
+	flags := flag.NewFlagSet(d.pos(), flag.ContinueOnError)
+	flags.SetOutput(os.Stderr)
+	flag.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	if err := flags.Parse(d.args); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case *modeAutoDetection || *modePrintGoGenComments:
+		return nil, fmt.Errorf("-auto and -print are not supported by run-directives; use go generate")
+	case *writeModuleTxt:
+		return nil, nil
+	case (flags.NArg() != 1 || *matchSymbols == "") && flags.NArg() != 2 && flags.NArg() != 3:
+		return nil, fmt.Errorf("expected exactly two or three arguments, or one argument with -match")
+	}
+	return flags.Args(), nil
+}
+
+// warmBuildCache builds all packages to be stubbed in one go command per
+// module, so that the go command compiles them in parallel, and the
+// reflection program of each directive only has to link.
+func warmBuildCache(packagesByDir map[string][]string, modRoot string) {
+	dirs := make([]string, 0, len(packagesByDir))
+	for dir := range packagesByDir {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	byModule := make(map[string][]string)
+	for _, dir := range dirs {
+		root := findModuleRoot(dir)
+		if root == "" {
+			root = modRoot
+		}
+		byModule[root] = append(byModule[root], packagesByDir[dir]...)
+	}
+
+	for root, pkgs := range byModule {
+		if err := warmModule(root, DeduplicateStrings(pkgs)); err != nil {
+			// The failures are reported for each directive.
+			fmt.Fprintf(stderr, "Building the stubbed packages failed: %s\n", err)
+		}
+	}
+}
+
+// warmModule builds the packages `pkgs` required by the module in `root`.
+// Like the reflection programs, they are built in a temporary module with a
+// copy of its go.mod file, so that the build doesn't update that of the
+// module.
+func warmModule(root string, pkgs []string) error {
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(root, "depstubber_warm_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := writeBuildModule(tmpDir); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(runContext, "go", append([]string{"build", buildModFlag()}, pkgs...)...)
+	cmd.Dir = tmpDir
+	cmd.Env = childEnv()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s\n%s", err, out)
+	}
+	return nil
+}
+
+func runDirectives(args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("run-directives must be run in a module")
+	}
+	directives, err := findDirectives(root)
+	if err != nil {
+		return err
+	}
+	if len(directives) == 0 {
+		fmt.Println("No depstubber directives found.")
+		return nil
+	}
+	defer os.Chdir(wd)
+	base := captureFlags()
+	defer base.restore()
+
+	// Apply the flags of every directive once, to find out what they stub
+	// and whether the vendor directory should be recreated.
+	packagesByDir := make(map[string][]string)
+	force := false
+	for _, d := range directives {
+		rest, err := parseDirective(d, base)
+		if err != nil || len(rest) == 0 {
+			continue
+		}
+		force = force || (*vendor && *forceOverwrite)
+		if rest[0] != "." {
+			dir := filepath.Dir(d.file)
+			packagesByDir[dir] = append(packagesByDir[dir], rest[0])
+		}
+	}
+	if force {
+		// Removing the vendor directory for each directive would remove the
+		// stubs of the previous ones.
+		if err := removeAll(filepath.Join(root, "vendor")); err != nil {
+			return err
+		}
+	}
+	base.restore()
+	warmBuildCache(packagesByDir, root)
+
+	var failures []string
+	writeModules := false
+	copiedLicenses := make(licenseCopies)
+	// The directives run one after another: each sets the global flags and
+	// changes to the directory of its file. The single go build above
+	// compiled their packages together already.
+	for _, d := range directives {
+		err := runDirective(d, base, copiedLicenses)
+		writeModules = writeModules || *vendor || *writeModuleTxt
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", d.pos(), err))
+			fmt.Printf("FAIL  %s\n", d.pos())
+		} else {
+			fmt.Printf("ok    %s\n", d.pos())
+		}
+	}
+	base.restore()
+	if writeModules {
+		if err := os.Chdir(root); err != nil {
+			return err
+		}
+		finishVendor()
+	}
+
+	fmt.Printf("%d directives, %d failed\n", len(directives), len(failures))
+	if len(failures) > 0 {
+		return fmt.Errorf("failed directives:\n\t%s", strings.Join(failures, "\n\t"))
+	}
+	return nil
+}
+
+// runDirective executes `d` in the directory of its file, like go generate.
+func runDirective(d *directive, base *flagState, copiedLicenses licenseCopies) error {
+	rest, err := parseDirective(d, base)
+	if err != nil {
+		return err
+	}
+	if err := os.Chdir(filepath.Dir(d.file)); err != nil {
+		return err
+	}
+	if rest == nil {
+		// -write_module_txt is done once for all directives.
+		return nil
+	}
+	return generateStubs(runContext, copiedLicenses, rest[0], split(flagArg(rest, 1)), split(flagArg(rest, 2)), nil)
+}
+
+// flagArg returns the i'th element of `args`, or "" if there is none.
+func flagArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
@@ -0,0 +1,273 @@
+package main
+
+// This file contains the `doctor` subcommand, which diagnoses problems with
+// the environment depstubber runs in.
+
+import (
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"doctor", "selftest"},
+		usage: "check the environment and stub a built-in fixture end-to-end",
+		run:   runDoctor,
+	})
+}
+
+// doctorCheck is a step of the `doctor` subcommand. It returns a short
+// description of what it found, and an error if the step failed.
+type doctorCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+func runDoctor(args []string) error {
+	checks := []doctorCheck{
+		{"go binary", checkGoBinary},
+		{"GOFLAGS", checkGoFlags},
+		{"module cache", checkModuleCache},
+		{"build cache", checkBuildCache},
+		{"temp dir executability", checkTempDirExec},
+		{"network access", checkNetwork},
+		{"end-to-end stub", checkEndToEnd},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		result, err := check.run()
+		status := "PASS"
+		if err != nil {
+			status = "FAIL"
+			failed++
+			result = err.Error()
+		}
+		fmt.Printf("%s  %s: %s\n", status, check.name, result)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// goEnv returns the value of the go environment variable `name`.
+func goEnv(name string) (string, error) {
+	out, err := exec.Command("go", "env", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("go env %s: %s", name, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// moduleCacheDir returns the module cache directory of the go command.
+func moduleCacheDir() (string, error) {
+	dir, err := goEnv("GOMODCACHE")
+	if err != nil || dir == "" {
+		// GOMODCACHE was added in Go 1.15.
+		gopath, err := goEnv("GOPATH")
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(filepath.SplitList(gopath)[0], "pkg", "mod")
+	}
+	return dir, nil
+}
+
+func checkGoBinary() (string, error) {
+	path, err := exec.LookPath("go")
+	if err != nil {
+		return "", fmt.Errorf("go binary not found in PATH: %s", err)
+	}
+	out, err := exec.Command(path, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s version: %s", path, err)
+	}
+	return fmt.Sprintf("%s (%s)", strings.TrimSpace(string(out)), path), nil
+}
+
+func checkGoFlags() (string, error) {
+	flags, err := goEnv("GOFLAGS")
+	if err != nil {
+		return "", err
+	}
+	if flags == "" {
+		return "not set", nil
+	}
+	if strings.Contains(flags, "-mod=vendor") {
+		return "", fmt.Errorf("%q: -mod=vendor prevents the reflection program from resolving the stubbed package", flags)
+	}
+	return flags, nil
+}
+
+func checkModuleCache() (string, error) {
+	dir, err := moduleCacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := checkWritable(dir); err != nil {
+		return "", err
+	}
+	return dir + " is writable", nil
+}
+
+func checkBuildCache() (string, error) {
+	for _, entry := range childEnv() {
+		if envKey(entry) == envKey("GOCACHE") {
+			dir := entry[len("GOCACHE="):]
+			if err := checkWritable(dir); err != nil {
+				return "", err
+			}
+			return dir + " is writable", nil
+		}
+	}
+	dir, err := goEnv("GOCACHE")
+	if err != nil {
+		return "", err
+	}
+	if err := checkWritable(dir); err != nil {
+		return "", err
+	}
+	return dir + " is writable", nil
+}
+
+// checkWritable checks that files can be created in the directory `dir`,
+// creating it if necessary.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("%s can't be created: %s", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, "depstubber_doctor_")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+func checkTempDirExec() (string, error) {
+	tmpDir, err := ioutil.TempDir("", "depstubber_doctor_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	const program = "package main\n\nfunc main() { println(\"ok\") }\n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "main.go"), []byte(program), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte("module depstubber.doctor\n"), 0600); err != nil {
+		return "", err
+	}
+
+	binary := "prog.bin"
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	build := exec.Command("go", "build", "-o", binary, "main.go")
+	build.Dir = tmpDir
+	if out, err := build.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("building a program in %s failed: %s\n%s", tmpDir, err, out)
+	}
+	if out, err := exec.Command(filepath.Join(tmpDir, binary)).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("running a program in %s failed: %s\n%s", tmpDir, err, out)
+	}
+	return "programs can be built and run in " + os.TempDir(), nil
+}
+
+func checkNetwork() (string, error) {
+	proxies, err := goEnv("GOPROXY")
+	if err != nil {
+		return "", err
+	}
+
+	proxy := strings.Split(strings.Split(proxies, ",")[0], "|")[0]
+	if proxy == "off" {
+		return "GOPROXY=off; only modules in the module cache can be stubbed", nil
+	}
+	if proxy == "direct" || proxy == "" {
+		return "GOPROXY=direct; modules are fetched from their version control systems", nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := strings.TrimSuffix(proxy, "/") + "/golang.org/x/mod/@v/list"
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("module proxy %s is not reachable: %s", proxy, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("module proxy %s responded with %s", proxy, resp.Status)
+	}
+	return "module proxy " + proxy + " is reachable", nil
+}
+
+// checkEndToEnd stubs a package of the standard library with the running
+// depstubber binary. Like a normal invocation, it runs in the enclosing module,
+// which must require github.com/github/depstubber for the reflection program
+// to build; outside of a module, a temporary module requiring the version of
+// the running binary is used.
+func checkEndToEnd() (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "depstubber_doctor_")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := findModuleRoot(wd)
+	if dir == "" {
+		info, ok := debug.ReadBuildInfo()
+		if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+			return "", fmt.Errorf("not in a module, and the version of depstubber is unknown; run doctor in a module that requires github.com/github/depstubber")
+		}
+		modFile := fmt.Sprintf("module depstubber.doctor\n\nrequire %s %s\n", info.Main.Path, info.Main.Version)
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, "go.mod"), []byte(modFile), 0600); err != nil {
+			return "", err
+		}
+		dir = tmpDir
+	}
+
+	const fixture = "database/sql/driver"
+	stub := filepath.Join(tmpDir, "stub.go")
+	var stderr bytes.Buffer
+	cmd := exec.Command(self, "-destination", stub, fixture, "Conn,Driver")
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("stubbing %s in %s failed: %s\n%s", fixture, dir, err, stderr.String())
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), stub, nil, 0)
+	if err != nil {
+		return "", fmt.Errorf("the stub of %s does not parse: %s", fixture, err)
+	}
+	for _, name := range []string{"Conn", "Driver"} {
+		if file.Scope.Lookup(name) == nil {
+			return "", fmt.Errorf("the stub of %s does not declare %s", fixture, name)
+		}
+	}
+	return "stubbed " + fixture + " in " + dir, nil
+}
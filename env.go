@@ -0,0 +1,210 @@
+package main
+
+// This file contains the handling of the environment of child processes.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// envOverrides is a list of KEY=VALUE settings, in the order they were given.
+type envOverrides []string
+
+func (e *envOverrides) String() string {
+	return strings.Join(*e, " ")
+}
+
+func (e *envOverrides) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	*e = append(*e, value)
+	return nil
+}
+
+var extraEnv envOverrides
+
+var goCache = flag.String("gocache", "", "The build cache of the go commands, shared by the reflection builds; by default, that of the go command, or a depstubber-go-build directory in the temp directory if it has none.")
+
+func init() {
+	flag.Var(&extraEnv, "env", "Set an environment variable (KEY=VALUE) for the go commands and the reflection program; may be repeated.")
+}
+
+// envKey returns the key of an environment entry, normalized the way the
+// operating system compares keys.
+func envKey(entry string) string {
+	key := entry
+	if i := strings.Index(entry, "="); i >= 0 {
+		key = entry[:i]
+	}
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(key)
+	}
+	return key
+}
+
+// childEnv returns the environment of the child processes: the environment of
+// depstubber with the -env settings applied. A later setting of a key wins
+// over an earlier one, and every key appears once, so that the result doesn't
+// depend on which duplicate the child process happens to pick. The entries are
+// sorted to make the environment the same from one run to the next.
+func childEnv() []string {
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if _, ok := env[envKey(entry)]; !ok {
+			// Like os.Getenv, use the first occurrence of a key.
+			env[envKey(entry)] = entry
+		}
+	}
+	// The children run in other directories, for which the PWD of
+	// depstubber is wrong; without it, they find their real directory.
+	delete(env, envKey("PWD"))
+	if *goCache != "" {
+		env[envKey("GOCACHE")] = "GOCACHE=" + *goCache
+	}
+	for _, entry := range extraEnv {
+		env[envKey(entry)] = entry
+	}
+	if entry, ok := env[envKey("GOCACHE")]; !ok || entry[len("GOCACHE="):] == "off" {
+		if dir := fallbackGoCache(); dir != "" {
+			env[envKey("GOCACHE")] = "GOCACHE=" + dir
+		}
+	}
+
+	result := make([]string, 0, len(env))
+	for _, entry := range env {
+		result = append(result, entry)
+	}
+	sort.Strings(result)
+	return result
+}
+
+var (
+	fallbackGoCacheOnce sync.Once
+	fallbackGoCacheDir  string
+)
+
+// fallbackGoCache returns the build cache for the go commands if they have
+// none, like when neither HOME nor GOCACHE is set, or "" if they have one.
+// Without a build cache, every reflection build would compile all the
+// dependencies of the stubbed package again, if the go command builds at
+// all.
+func fallbackGoCache() string {
+	fallbackGoCacheOnce.Do(func() {
+		if dir, err := goEnv("GOCACHE"); err == nil && dir != "" && dir != "off" {
+			return
+		}
+		fallbackGoCacheDir = filepath.Join(os.TempDir(), "depstubber-go-build")
+	})
+	return fallbackGoCacheDir
+}
+
+// targetPlatform returns the GOOS and GOARCH that the child processes build
+// for, as set in their environment.
+func targetPlatform() (string, string) {
+	goos, goarch := runtime.GOOS, runtime.GOARCH
+	for _, entry := range childEnv() {
+		i := strings.Index(entry, "=")
+		switch envKey(entry) {
+		case envKey("GOOS"):
+			if entry[i+1:] != "" {
+				goos = entry[i+1:]
+			}
+		case envKey("GOARCH"):
+			if entry[i+1:] != "" {
+				goarch = entry[i+1:]
+			}
+		}
+	}
+	return goos, goarch
+}
+
+// generationEnv is the go environment stubs are generated in. It is recorded
+// in the lockfile, as the same stub may differ when it is generated in
+// another environment.
+type generationEnv struct {
+	GoVersion string `json:"goversion,omitempty"`
+	GoFlags   string `json:"goflags,omitempty"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+}
+
+func (e *generationEnv) String() string {
+	s := e.GOOS + "/" + e.GOARCH
+	if e.GoVersion != "" {
+		s = e.GoVersion + " " + s
+	}
+	if e.GoFlags != "" {
+		s += " GOFLAGS=" + shellQuote(e.GoFlags)
+	}
+	return s
+}
+
+var (
+	currentEnvOnce sync.Once
+	currentEnv     *generationEnv
+)
+
+// currentGenerationEnv returns the go environment of the child processes.
+func currentGenerationEnv() *generationEnv {
+	currentEnvOnce.Do(func() {
+		goos, goarch := targetPlatform()
+		currentEnv = &generationEnv{GOOS: goos, GOARCH: goarch}
+		cmd := exec.Command("go", "env", "-json", "GOVERSION", "GOFLAGS", "GOOS", "GOARCH")
+		cmd.Env = childEnv()
+		out, err := cmd.Output()
+		if err != nil {
+			return
+		}
+		var vars map[string]string
+		if err := json.Unmarshal(out, &vars); err != nil {
+			return
+		}
+		// GOVERSION was added in Go 1.16.
+		currentEnv.GoVersion, currentEnv.GoFlags = vars["GOVERSION"], vars["GOFLAGS"]
+		if vars["GOOS"] != "" && vars["GOARCH"] != "" {
+			currentEnv.GOOS, currentEnv.GOARCH = vars["GOOS"], vars["GOARCH"]
+		}
+	})
+	return currentEnv
+}
+
+// differsMaterially reports whether stubs generated in the environment `e`
+// may differ from those generated in `other`: the Go language versions,
+// GOFLAGS or the platforms differ. Patch releases of Go don't matter.
+func (e *generationEnv) differsMaterially(other *generationEnv) bool {
+	if e == nil || other == nil {
+		// Lockfiles of older versions don't record the environment.
+		return false
+	}
+	return goLanguageVersion(e.GoVersion) != goLanguageVersion(other.GoVersion) ||
+		strings.Join(strings.Fields(e.GoFlags), " ") != strings.Join(strings.Fields(other.GoFlags), " ") ||
+		e.GOOS != other.GOOS || e.GOARCH != other.GOARCH
+}
+
+// goLanguageVersion returns the language version of the Go release `version`,
+// like "go1.21" for "go1.21.5" or "go1.22rc1", or "" if it is unknown.
+func goLanguageVersion(version string) string {
+	version = strings.TrimPrefix(version, "go")
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	minor := parts[1]
+	for i, r := range minor {
+		if r < '0' || r > '9' {
+			minor = minor[:i]
+			break
+		}
+	}
+	return "go" + parts[0] + "." + minor
+}
@@ -0,0 +1,188 @@
+package main
+
+// This file contains the handling of -from-dir, which stubs a package from a
+// local directory that need not be referenced in go.mod.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+)
+
+var fromDir = flag.String("from-dir", "", "Stub the package from this directory, e.g. a checkout of a module that is not in go.mod yet, instead of from the module providing it.")
+
+// localSource is the module that provides the package stubbed with -from-dir.
+type localSource struct {
+	path string // the module path
+	root string // the directory the module is replaced by
+	dir  string // the directory of the package given to -from-dir
+
+	// synthesized is set if the module is a temporary copy of the directory.
+	synthesized bool
+
+	loadDir string // a copy of the current module requiring the local module
+	tmpDirs []string
+}
+
+// currentLocalSource is the local module of the package being stubbed, if
+// -from-dir is set.
+var currentLocalSource *localSource
+
+// openLocalSource returns the local module providing `pkgPath` from the
+// directory `dir`. If the directory is not in a module providing `pkgPath`,
+// it is copied into a temporary module of that path.
+func openLocalSource(pkgPath string, dir string) (*localSource, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("-from-dir: %s is not a directory", dir)
+	}
+
+	src := &localSource{dir: dir}
+	if root := findModuleRoot(dir); root != "" {
+		modPath := loadModFile(filepath.Join(root, "go.mod")).Module.Mod.Path
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		if rel, err := filepath.Rel(root, dir); err == nil && path.Join(modPath, filepath.ToSlash(rel)) == pkgPath {
+			src.path, src.root = modPath, root
+		}
+	}
+	if src.root == "" {
+		// A plain checkout of the package, or one of a module that doesn't
+		// provide it at that path.
+		if err := src.synthesizeModule(pkgPath); err != nil {
+			src.close()
+			return nil, err
+		}
+	}
+
+	loadDir, err := ioutil.TempDir("", "depstubber_local_")
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	src.tmpDirs = append(src.tmpDirs, loadDir)
+	src.loadDir = loadDir
+	wd, err := os.Getwd()
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	if err := src.writeGoMod(findModuleRoot(wd), loadDir); err != nil {
+		src.close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// synthesizeModule copies the files of the directory into a temporary
+// module of path `pkgPath`.
+func (src *localSource) synthesizeModule(pkgPath string) error {
+	root, err := ioutil.TempDir("", "depstubber_module_")
+	if err != nil {
+		return err
+	}
+	src.tmpDirs = append(src.tmpDirs, root)
+	infos, err := ioutil.ReadDir(src.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && info.Name() != "go.mod" && info.Name() != "go.sum" {
+			if _, err := copyFile(filepath.Join(src.dir, info.Name()), filepath.Join(root, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "go.mod"), []byte(fmt.Sprintf("module %s\n", pkgPath)), 0644); err != nil {
+		return err
+	}
+	src.path, src.root, src.synthesized = pkgPath, root, true
+	return nil
+}
+
+// writeGoMod writes the go.mod of the module in `modRoot`, or of an empty
+// module if it is "", to `dir`, with a requirement of the local module.
+func (src *localSource) writeGoMod(modRoot string, dir string) error {
+	if modRoot != "" {
+		if err := copyGoMod(modRoot, dir); err != nil {
+			return err
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(modRoot, "go.sum")); err == nil {
+			if err := ioutil.WriteFile(filepath.Join(dir, "go.sum"), data, 0644); err != nil {
+				return err
+			}
+		}
+	} else if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module depstubber_reflect\n"), 0644); err != nil {
+		return err
+	}
+	return src.addRequirement(filepath.Join(dir, "go.mod"))
+}
+
+// addRequirement makes the module of go.mod file `path` require the local
+// module, replaced by its directory.
+func (src *localSource) addRequirement(path string) error {
+	file, tools := loadModFileTools(path)
+	for _, r := range file.Replace {
+		if r.Old.Path == src.path {
+			if err := file.DropReplace(r.Old.Path, r.Old.Version); err != nil {
+				return err
+			}
+		}
+	}
+	if err := file.AddRequire(src.path, src.version()); err != nil {
+		return err
+	}
+	if err := file.AddReplace(src.path, "", src.root, ""); err != nil {
+		return err
+	}
+	file.Cleanup()
+	data, err := formatModFile(file, tools)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// version returns the version under which the local module is required,
+// which is the one the go command uses for modules that are only replaced.
+func (src *localSource) version() string {
+	major := "v0"
+	if _, pathMajor, ok := module.SplitPathVersion(src.path); ok && pathMajor != "" {
+		major = strings.TrimLeft(pathMajor, "/.")
+	}
+	return major + ".0.0-00010101000000-000000000000"
+}
+
+// module returns the local module, for the detection of its licenses.
+func (src *localSource) module() *packages.Module {
+	dir := src.root
+	if src.synthesized {
+		dir = src.dir
+	}
+	return &packages.Module{Path: src.path, Version: src.version(), Dir: dir}
+}
+
+// sum returns the module the stub is generated from, for the header and the
+// lockfile.
+func (src *localSource) sum() *moduleSum {
+	return &moduleSum{Path: src.path, Version: src.version(), Replace: src.module().Dir}
+}
+
+func (src *localSource) close() {
+	for _, dir := range src.tmpDirs {
+		os.RemoveAll(dir)
+	}
+}
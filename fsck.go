@@ -0,0 +1,177 @@
+package main
+
+// This file contains the `fsck` subcommand, which checks that the stubs of
+// the vendor directory are intact.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"fsck"},
+		usage: "check that the stubs of the vendor directory parse, are listed in modules.txt and match the manifest",
+		run:   runFsck,
+	})
+}
+
+func runFsck(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("fsck must be run in a module")
+	}
+	problems, checked, err := fsckVendor(root)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(stderr, "%s\n", problem)
+	}
+	fmt.Printf("%d stub files, %d problems\n", checked, len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("the stubs of %s are not intact", filepath.Join(root, "vendor"))
+	}
+	return nil
+}
+
+// fsckVendor checks the files generated by depstubber in the vendor
+// directory of the module in `root`: that they parse, that their packages
+// are listed in modules.txt, and that they match the hashes of the CodeQL
+// manifest, if there is one. It returns the problems found and the number
+// of files checked.
+func fsckVendor(root string) ([]string, int, error) {
+	vendorDir := filepath.Join(root, "vendor")
+	listed, err := modulesTxtPackages(vendorDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	hashes, err := manifestHashes(vendorDir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var problems []string
+	checked := 0
+	seen := make(map[string]bool)
+	fset := token.NewFileSet()
+	err = filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == vendorDir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), ".go") || !generatedByDepstubber(path) {
+			return nil
+		}
+		checked++
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := parser.ParseFile(fset, path, data, parser.AllErrors); err != nil {
+			problems = append(problems, fmt.Sprintf("unparsable: %s: %v", rel, err))
+		}
+		if pkgDir, _ := filepath.Rel(vendorDir, filepath.Dir(path)); !listed[filepath.ToSlash(pkgDir)] {
+			problems = append(problems, fmt.Sprintf("orphaned: %s is not in a package listed in vendor/modules.txt", rel))
+		}
+		if hashes != nil {
+			sum := sha256.Sum256(data)
+			switch want, ok := hashes[rel]; {
+			case !ok:
+				problems = append(problems, fmt.Sprintf("orphaned: %s is not listed in vendor/%s", rel, codeqlManifestName))
+			case want != hex.EncodeToString(sum[:]):
+				problems = append(problems, fmt.Sprintf("tampered: %s doesn't match its hash in vendor/%s", rel, codeqlManifestName))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var missing []string
+	for rel := range hashes {
+		if !seen[rel] {
+			missing = append(missing, rel)
+		}
+	}
+	sort.Strings(missing)
+	for _, rel := range missing {
+		problems = append(problems, fmt.Sprintf("missing: %s is listed in vendor/%s, but is not a stub file", rel, codeqlManifestName))
+	}
+	return problems, checked, nil
+}
+
+// modulesTxtPackages returns the directories, relative to `vendorDir` and
+// with forward slashes, of the packages listed in its modules.txt, escaped
+// as with -escape_paths or not.
+func modulesTxtPackages(vendorDir string) (map[string]bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(vendorDir, "modules.txt"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		listed[line] = true
+		if escaped, err := module.EscapePath(line); err == nil {
+			listed[escaped] = true
+		}
+	}
+	return listed, nil
+}
+
+// manifestHashes returns the hashes of the stub files recorded in the CodeQL
+// manifest of `vendorDir`, by their paths relative to the module root, or
+// nil if there is no manifest.
+func manifestHashes(vendorDir string) (map[string]string, error) {
+	path := filepath.Join(vendorDir, codeqlManifestName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var manifest codeqlManifestFile
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %s", path, err)
+	}
+	if manifest.Version > codeqlManifestVersion {
+		return nil, fmt.Errorf("manifest %s has version %d; this depstubber only supports version %d", path, manifest.Version, codeqlManifestVersion)
+	}
+	hashes := make(map[string]string)
+	for _, pkg := range manifest.Packages {
+		for file, sum := range pkg.Files {
+			hashes[file] = sum
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+// This file contains the changes depstubber makes to the file system, which
+// are recorded so that they can be planned before they are applied.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"plan"},
+		usage: "print the changes to the file system the same invocation with 'apply' would make",
+		run:   runPlan,
+	})
+	registerCommand(&command{
+		names: []string{"apply"},
+		usage: "stub as without a subcommand, e.g. after reviewing a plan",
+		run: func(args []string) error {
+			runStubs()
+			return nil
+		},
+	})
+}
+
+// fileAction is a change to the file system.
+type fileAction struct {
+	Action string `json:"action"` // "remove", "write" or "copy"
+	Path   string `json:"path"`
+	From   string `json:"from,omitempty"` // the source of a copy
+
+	// Package is the stubbed package the action is for, if any.
+	Package string `json:"package,omitempty"`
+
+	// Entries holds the lines of a modules.txt file.
+	Entries []string `json:"entries,omitempty"`
+
+	// Bytes is the size of a written file, and Unchanged is set if the file
+	// already had that content.
+	Bytes     int  `json:"bytes,omitempty"`
+	Unchanged bool `json:"unchanged,omitempty"`
+}
+
+func (a fileAction) String() string {
+	switch a.Action {
+	case "copy":
+		return fmt.Sprintf("copy   %s -> %s", a.From, a.Path)
+	case "remove":
+		return fmt.Sprintf("remove %s", a.Path)
+	default:
+		s := fmt.Sprintf("write  %s", a.Path)
+		if a.Package != "" {
+			s += fmt.Sprintf(" (stub of %s)", a.Package)
+		}
+		if a.Unchanged {
+			s += " (unchanged)"
+		}
+		for _, entry := range a.Entries {
+			s += "\n         " + entry
+		}
+		return s
+	}
+}
+
+// stdoutPath stands for standard output in the path of a fileAction.
+const stdoutPath = "<stdout>"
+
+var (
+	// planOnly is set by the `plan` subcommand to record the actions
+	// without applying them.
+	planOnly bool
+
+	recordedActions []fileAction
+
+	// progress receives the messages about the actions being applied.
+	progress io.Writer = os.Stdout
+)
+
+// removeAll removes the directory `path` and its contents, if it exists.
+func removeAll(path string) error {
+	if exists, err := DirExists(path); err != nil || !exists {
+		return err
+	}
+	recordedActions = append(recordedActions, fileAction{Action: "remove", Path: path})
+	if planOnly {
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
+// writeFile writes `data` to the file `path`, creating its directory if
+// necessary, or to `stdout` if `path` is empty. `action` describes the write.
+func writeFile(path string, data []byte, stdout io.Writer, action fileAction) error {
+	defer timePhase(phaseIO, time.Now())
+	action.Action = "write"
+	action.Path = path
+	action.Bytes = len(data)
+	if path == "" {
+		action.Path = stdoutPath
+	} else if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		action.Unchanged = true
+	}
+	recordedActions = append(recordedActions, action)
+	if planOnly {
+		return nil
+	}
+
+	if path == "" {
+		_, err := stdout.Write(data)
+		return err
+	}
+	if action.Unchanged {
+		return nil
+	}
+	tmpName, err := writeTempFile(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err == nil {
+		err = os.Rename(tmpName, path)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// writeFileFrom writes the output of `write` to the file `path` like
+// writeFile, without holding all of it in memory.
+func writeFileFrom(path string, write func(w io.Writer) error, action fileAction) error {
+	action.Action = "write"
+	action.Path = path
+	if planOnly {
+		counter := &countingWriter{w: ioutil.Discard}
+		if err := write(counter); err != nil {
+			return err
+		}
+		action.Bytes = counter.n
+		recordedActions = append(recordedActions, action)
+		return nil
+	}
+
+	tmpName, err := writeTempFile(path, write)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if info, err := os.Stat(tmpName); err == nil {
+		action.Bytes = int(info.Size())
+	}
+	action.Unchanged = sameContents(tmpName, path)
+	recordedActions = append(recordedActions, action)
+	if action.Unchanged {
+		return os.Remove(tmpName)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes the output of `write` to a new temporary file next
+// to `path` and returns its name, so that an interrupt never leaves a
+// truncated file at `path`.
+func writeTempFile(path string, write func(w io.Writer) error) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", fmt.Errorf("Unable to create directory: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	buffered := bufio.NewWriter(f)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	return f.Name(), err
+}
+
+// sameContents reports whether the files `a` and `b` exist and have the
+// same contents.
+func sameContents(a string, b string) bool {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	bufA, bufB := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if na != nb || !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == errA
+		}
+		if errA != nil || errB != nil {
+			return false
+		}
+	}
+}
+
+// countingWriter counts the bytes written to `w`.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+// copyToFile copies the file `src` to `dst`, creating the directory of
+// `dst` if necessary.
+func copyToFile(src string, dst string) error {
+	defer timePhase(phaseIO, time.Now())
+	recordedActions = append(recordedActions, fileAction{Action: "copy", Path: dst, From: src})
+	if planOnly {
+		return nil
+	}
+	if err := CreateFolderIfNotExists(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	if _, err := copyFile(src, dst); err != nil {
+		return fmt.Errorf("error copying %q to %q: %s", src, dst, err)
+	}
+	return nil
+}
+
+// printSummary writes a summary of the changes made to the file system
+// to `w`, if any were made.
+func printSummary(w io.Writer) {
+	var written, unchanged, removed, copied, size int
+	modulesTxt := "no"
+	for _, action := range recordedActions {
+		switch {
+		case action.Path == stdoutPath:
+		case action.Action == "remove":
+			removed++
+		case action.Action == "copy":
+			copied++
+		case action.Unchanged:
+			unchanged++
+		default:
+			written++
+			size += action.Bytes
+			if filepath.Base(action.Path) == "modules.txt" {
+				modulesTxt = "yes"
+			}
+		}
+	}
+	if written+unchanged+removed+copied == 0 && len(unresolvedPackages) == 0 {
+		return
+	}
+	colored := colorEnabled(w)
+	prefix := "depstubber:"
+	if colored {
+		prefix = colorize(colorBold, prefix)
+	}
+	fmt.Fprintf(w, "%s %s (%d bytes), %s, %s, %s, modules.txt updated: %s\n",
+		prefix, summaryCount(colored, colorGreen, written, "files written"), size,
+		summaryCount(colored, colorDim, unchanged, "unchanged"), summaryCount(colored, colorRed, removed, "removed"),
+		summaryCount(colored, colorGreen, copied, "licenses copied"), modulesTxt)
+	if len(unresolvedPackages) > 0 {
+		skipped := make([]string, len(unresolvedPackages))
+		for i, unresolved := range unresolvedPackages {
+			skipped[i] = unresolved.Package + " (" + unresolved.Reason + ")"
+		}
+		fmt.Fprintf(w, "%s %s: %s\n", prefix, summaryCount(colored, colorYellow, len(skipped), "unresolved packages skipped"), strings.Join(skipped, ", "))
+	}
+}
+
+func runPlan(args []string) error {
+	planOnly = true
+	progress = os.Stderr
+	runStubs()
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(struct {
+			Actions []fileAction `json:"actions"`
+		}{append([]fileAction{}, recordedActions...)})
+	}
+	if len(recordedActions) == 0 {
+		fmt.Println("No changes.")
+		return nil
+	}
+	lines := make([]string, 0, len(recordedActions))
+	for _, action := range recordedActions {
+		lines = append(lines, action.String())
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+	return nil
+}
@@ -0,0 +1,674 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+// This file contains the stubbing of generic types and functions, which are
+// declared from the type-checked package: the reflection program only sees
+// instantiations of generic types, like `List[int]`, and can't refer to
+// generic functions without instantiating them.
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/github/depstubber/model"
+	"github.com/golang/dep/gps/paths"
+	"golang.org/x/mod/semver"
+)
+
+// genericDecls holds the generic types and functions of a package to stub,
+// with the interfaces only usable as constraints, like
+// `interface{ ~int | ~string }`, which can't be reflected on either.
+type genericDecls struct {
+	ps    *packageSymbols
+	types []selectedType
+	funcs []string
+}
+
+// isGenericType reports whether the type `obj` is generic, or an interface
+// only usable as a constraint.
+func isGenericType(obj *types.TypeName) bool {
+	named, ok := obj.Type().(*types.Named)
+	if !ok || obj.IsAlias() {
+		return false
+	}
+	if named.TypeParams().Len() > 0 {
+		return true
+	}
+	iface, ok := named.Underlying().(*types.Interface)
+	return ok && !iface.IsMethodSet()
+}
+
+// isGenericFunc reports whether `obj` is a generic function.
+func isGenericFunc(obj types.Object) bool {
+	fn, ok := obj.(*types.Func)
+	return ok && fn.Type().(*types.Signature).TypeParams().Len() > 0
+}
+
+// generics splits `typeNames` and `valueNames` into the generic types and
+// functions of the package, and the names left to the reflection program.
+// The generic types instantiated by the other symbols are declared as well,
+// and the exported types the generic declarations refer to are added to the
+// names left to the reflection program.
+func (ps *packageSymbols) generics(typeNames []string, valueNames []string) (*genericDecls, []string, []string, error) {
+	g := &genericDecls{ps: ps}
+	var genericTypes, restTypes, restValues []string
+	for _, name := range typeNames {
+		typeName, _ := splitMethodSelection(name)
+		if obj, ok := ps.scope.Lookup(typeName).(*types.TypeName); ok && isGenericType(obj) {
+			genericTypes = append(genericTypes, name)
+		} else {
+			restTypes = append(restTypes, name)
+		}
+	}
+	for _, name := range valueNames {
+		if isGenericFunc(ps.scope.Lookup(name)) {
+			g.funcs = append(g.funcs, name)
+		} else {
+			restValues = append(restValues, name)
+		}
+	}
+
+	if version := strings.TrimPrefix(*lang, "go"); version != "" && semver.Compare("v"+version, "v1.18") < 0 {
+		if generic := append(genericTypes, g.funcs...); len(generic) > 0 {
+			return nil, nil, nil, fmt.Errorf("%s.%s is generic, and -lang %s has no generics; stub the functions and types using its instantiations instead", ps.path, generic[0], *lang)
+		}
+		// The instantiations used by the other symbols are stubbed as
+		// interface{}.
+		return g, restTypes, restValues, nil
+	}
+
+	// Find the generic types instantiated by the symbols, and the types the
+	// generic declarations refer to, which the reflection program must
+	// stub; the types the reflected symbols refer to are stubbed with them.
+	type item struct {
+		obj     types.Object
+		generic bool
+	}
+	var queue []item
+	queued := make(map[types.Object]bool)
+	enqueue := func(obj types.Object, generic bool) {
+		if obj != nil && !queued[obj] {
+			queued[obj] = true
+			queue = append(queue, item{obj, generic})
+		}
+	}
+	reflected := make(map[string]bool)
+	for _, name := range restTypes {
+		typeName, _ := splitMethodSelection(name)
+		reflected[typeName] = true
+		enqueue(ps.scope.Lookup(typeName), false)
+	}
+	for _, name := range genericTypes {
+		typeName, _ := splitMethodSelection(name)
+		enqueue(ps.scope.Lookup(typeName), true)
+	}
+	for _, name := range restValues {
+		enqueue(ps.scope.Lookup(name), false)
+	}
+	for _, name := range g.funcs {
+		enqueue(ps.scope.Lookup(name), true)
+	}
+
+	seen := map[bool]map[types.Type]bool{false: {}, true: {}}
+	var walk func(t types.Type, generic bool)
+	walk = func(t types.Type, generic bool) {
+		if t == nil || seen[generic][t] {
+			return
+		}
+		seen[generic][t] = true
+		switch t := t.(type) {
+		case *types.Named:
+			// The reflection program only sees the names of the type
+			// arguments of instantiations, so it doesn't stub them.
+			for i := 0; i < t.TypeArgs().Len(); i++ {
+				walk(t.TypeArgs().At(i), true)
+			}
+			obj := t.Origin().Obj()
+			if obj.Pkg() == nil || obj.Pkg().Path() != ps.path || obj.Parent() != ps.scope || !obj.Exported() {
+				return
+			}
+			if isGenericType(obj) {
+				if !queued[obj] {
+					genericTypes = append(genericTypes, obj.Name())
+				}
+				enqueue(obj, true)
+				return
+			}
+			if generic && !reflected[obj.Name()] {
+				reflected[obj.Name()] = true
+				restTypes = append(restTypes, obj.Name())
+			}
+			enqueue(obj, false)
+		case *types.Pointer:
+			walk(t.Elem(), generic)
+		case *types.Slice:
+			walk(t.Elem(), generic)
+		case *types.Array:
+			walk(t.Elem(), generic)
+		case *types.Map:
+			walk(t.Key(), generic)
+			walk(t.Elem(), generic)
+		case *types.Chan:
+			walk(t.Elem(), generic)
+		case *types.Signature:
+			for i := 0; i < t.TypeParams().Len(); i++ {
+				walk(t.TypeParams().At(i).Constraint(), generic)
+			}
+			walk(t.Params(), generic)
+			walk(t.Results(), generic)
+		case *types.Tuple:
+			for i := 0; i < t.Len(); i++ {
+				walk(t.At(i).Type(), generic)
+			}
+		case *types.Struct:
+			for i := 0; i < t.NumFields(); i++ {
+				walk(t.Field(i).Type(), generic)
+			}
+		case *types.Interface:
+			for i := 0; i < t.NumEmbeddeds(); i++ {
+				walk(t.EmbeddedType(i), generic)
+			}
+			for i := 0; i < t.NumExplicitMethods(); i++ {
+				walk(t.ExplicitMethod(i).Type(), generic)
+			}
+		case *types.Union:
+			for i := 0; i < t.Len(); i++ {
+				walk(t.Term(i).Type(), generic)
+			}
+		case *types.TypeParam:
+			walk(t.Constraint(), generic)
+		}
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		named, ok := next.obj.Type().(*types.Named)
+		if _, isType := next.obj.(*types.TypeName); !isType || !ok {
+			walk(next.obj.Type(), next.generic)
+			continue
+		}
+		for i := 0; i < named.TypeParams().Len(); i++ {
+			walk(named.TypeParams().At(i).Constraint(), next.generic)
+		}
+		walk(named.Underlying(), next.generic)
+		for i := 0; i < named.NumMethods(); i++ {
+			if named.Method(i).Exported() {
+				walk(named.Method(i).Type(), next.generic)
+			}
+		}
+	}
+
+	g.types = selectTypes(genericTypes)
+	sort.Slice(g.types, func(i, j int) bool { return g.types[i].Name < g.types[j].Name })
+	sort.Strings(g.funcs)
+	return g, restTypes, restValues, nil
+}
+
+// addTo adds the declarations of the generic types and functions to the
+// stub `pkg` written by the reflection program, and the imports they need to
+// its header.
+func (g *genericDecls) addTo(pkg *model.PackedPkg) error {
+	if g == nil || len(g.types) == 0 && len(g.funcs) == 0 {
+		return nil
+	}
+	w, err := newGenericWriter(g.ps, pkg.Header)
+	if err != nil {
+		return fmt.Errorf("unable to add the generic declarations to the stub of %s: %v", g.ps.path, err)
+	}
+	var decls []string
+	for _, t := range g.types {
+		decls = append(decls, w.typeDecl(g.ps.scope.Lookup(t.Name).(*types.TypeName), t.Methods)...)
+	}
+	for _, name := range g.funcs {
+		decls = append(decls, w.funcDecl(g.ps.scope.Lookup(name).(*types.Func)))
+	}
+	pkg.Header = w.header(pkg.Header)
+	pkg.Decls = append(pkg.Decls, decls...)
+	return nil
+}
+
+// genericWriter writes the declarations of generic types and functions of
+// a package, like the model package writes those of the reflected symbols.
+type genericWriter struct {
+	ps      *packageSymbols
+	typeMap map[string]string
+
+	imported map[string]string // the names of the imported packages, by path
+	names    map[string]bool   // the names of the imported packages
+	added    []string          // the paths of the imports the header lacks
+
+	constraint bool            // whether the type being written is a constraint
+	warned     map[string]bool // the constraints replaced by interface{}
+}
+
+// newGenericWriter returns a genericWriter for the stub with the header
+// `header`, whose imports it reuses.
+func newGenericWriter(ps *packageSymbols, header string) (*genericWriter, error) {
+	mapped, err := parseTypeMap(*typeMap)
+	if err != nil {
+		return nil, err
+	}
+	w := &genericWriter{ps: ps, typeMap: mapped, imported: make(map[string]string), names: make(map[string]bool), warned: make(map[string]bool)}
+	f, err := parser.ParseFile(token.NewFileSet(), "", header, parser.ImportsOnly)
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range f.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		w.imported[importPath] = name
+		w.names[name] = true
+	}
+	return w, nil
+}
+
+// qualifier returns the name the package `pkg` is imported with, adding an
+// import for it if there is none.
+func (w *genericWriter) qualifier(pkg *types.Package) string {
+	if name, ok := w.imported[pkg.Path()]; ok {
+		return name
+	}
+	name := pkg.Name()
+	for i := 0; w.names[name] || w.ps.scope.Lookup(name) != nil; i++ {
+		name = pkg.Name() + strconv.Itoa(i)
+	}
+	w.imported[pkg.Path()] = name
+	w.names[name] = true
+	w.added = append(w.added, pkg.Path())
+	return name
+}
+
+// header returns `header` with the imports the declarations need.
+func (w *genericWriter) header(header string) string {
+	if len(w.added) == 0 {
+		return header
+	}
+	var imports strings.Builder
+	for _, importPath := range w.added {
+		fmt.Fprintf(&imports, "\t%s %q\n", w.imported[importPath], importPath)
+	}
+	const block = "import (\n"
+	i := strings.Index(header, block)
+	if i < 0 {
+		return header + block + imports.String() + ")\n\n"
+	}
+	i += len(block)
+	return header[:i] + imports.String() + header[i:]
+}
+
+// typeString returns the source of the type `t` in the stub. Like in the
+// reflected declarations, the types of other modules and the unexported
+// types of the package are replaced with `interface{}`.
+func (w *genericWriter) typeString(t types.Type) string {
+	switch t := t.(type) {
+	case *types.Basic:
+		if t.Kind() == types.UnsafePointer {
+			return w.qualifier(types.Unsafe) + ".Pointer"
+		}
+		return t.Name()
+	case *types.Pointer:
+		return "*" + w.typeString(t.Elem())
+	case *types.Slice:
+		return "[]" + w.typeString(t.Elem())
+	case *types.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), w.typeString(t.Elem()))
+	case *types.Map:
+		return "map[" + w.typeString(t.Key()) + "]" + w.typeString(t.Elem())
+	case *types.Chan:
+		elem := w.typeString(t.Elem())
+		switch t.Dir() {
+		case types.SendOnly:
+			return "chan<- " + elem
+		case types.RecvOnly:
+			return "<-chan " + elem
+		}
+		if c, ok := t.Elem().(*types.Chan); ok && c.Dir() == types.RecvOnly {
+			elem = "(" + elem + ")"
+		}
+		return "chan " + elem
+	case *types.Signature:
+		return "func" + w.signature(t)
+	case *types.Struct:
+		fields := make([]string, t.NumFields())
+		for i := range fields {
+			field := t.Field(i)
+			if field.Embedded() {
+				fields[i] = w.typeString(field.Type())
+			} else {
+				fields[i] = field.Name() + " " + w.typeString(field.Type())
+			}
+			if tag := t.Tag(i); tag != "" {
+				fields[i] += " " + strconv.Quote(tag)
+			}
+		}
+		return "struct{" + strings.Join(fields, "; ") + "}"
+	case *types.Interface:
+		return "interface{" + strings.Join(w.interfaceElems(t), "; ") + "}"
+	case *types.Union:
+		terms := make([]string, t.Len())
+		for i := range terms {
+			terms[i] = w.typeString(t.Term(i).Type())
+			if t.Term(i).Tilde() {
+				terms[i] = "~" + terms[i]
+			}
+		}
+		return strings.Join(terms, " | ")
+	case *types.TypeParam:
+		return t.Obj().Name()
+	case *types.Named:
+		return w.namedString(t)
+	}
+	// Type checkers of Go 1.22 on may give aliases, which are written as
+	// the types they stand for.
+	return w.typeString(t.Underlying())
+}
+
+// namedString returns the source of the named type `t` in the stub.
+func (w *genericWriter) namedString(t *types.Named) string {
+	obj := t.Obj()
+	var args string
+	if t.TypeArgs().Len() > 0 {
+		list := make([]string, t.TypeArgs().Len())
+		for i := range list {
+			list[i] = w.typeString(t.TypeArgs().At(i))
+		}
+		args = "[" + strings.Join(list, ", ") + "]"
+	}
+
+	switch {
+	case obj.Pkg() == nil:
+		// Predeclared types, like error and comparable.
+		return obj.Name()
+	case obj.Pkg().Path() == w.ps.path:
+		if !obj.Exported() || obj.Parent() != w.ps.scope {
+			return "interface{}"
+		}
+		return obj.Name() + args
+	}
+	pkgPath := obj.Pkg().Path()
+	if mapped, ok := w.typeMap[pkgPath+"."+obj.Name()]; ok && args == "" {
+		if i := strings.LastIndex(mapped, "."); i >= 0 {
+			return w.qualifier(types.NewPackage(mapped[:i], path.Base(mapped[:i]))) + mapped[i:]
+		}
+		return mapped
+	}
+	if obj.Exported() && !paths.IsStandardImportPath(pkgPath) && !*useExtTypes && w.constraint {
+		// Constraints of other modules are stubbed along with the package
+		// by -auto; replacing them by interface{} would loosen the type
+		// parameters.
+		if detectedPackages[pkgPath] {
+			return w.qualifier(obj.Pkg()) + "." + obj.Name() + args
+		}
+		if name := pkgPath + "." + obj.Name(); !w.warned[name] {
+			w.warned[name] = true
+			log.Printf("WARNING: the constraint %s is stubbed as interface{} in the stub of %s; stub %s as well and use -use_ext_types, or use -auto, to keep it", name, w.ps.path, pkgPath)
+		}
+	}
+	if !obj.Exported() || !paths.IsStandardImportPath(pkgPath) && !*useExtTypes {
+		return "interface{}"
+	}
+	return w.qualifier(obj.Pkg()) + "." + obj.Name() + args
+}
+
+// interfaceElems returns the exported methods and the embedded elements of
+// the interface `t`.
+func (w *genericWriter) interfaceElems(t *types.Interface) []string {
+	var elems []string
+	for i := 0; i < t.NumEmbeddeds(); i++ {
+		// The embedded elements of interfaces with type terms are
+		// constraints as well.
+		elems = append(elems, w.constrained(!t.IsMethodSet(), func() string {
+			return w.typeString(t.EmbeddedType(i))
+		}))
+	}
+	for i := 0; i < t.NumExplicitMethods(); i++ {
+		if m := t.ExplicitMethod(i); m.Exported() {
+			elems = append(elems, m.Name()+w.signature(m.Type().(*types.Signature)))
+		}
+	}
+	return elems
+}
+
+// signature returns the parameters and results of `sig`, like
+// `(_ T, _ ...int) (bool, error)`.
+func (w *genericWriter) signature(sig *types.Signature) string {
+	params := make([]string, sig.Params().Len())
+	for i := range params {
+		typ := sig.Params().At(i).Type()
+		if slice, ok := typ.(*types.Slice); ok && sig.Variadic() && i == len(params)-1 {
+			params[i] = "_ ..." + w.typeString(slice.Elem())
+		} else {
+			params[i] = "_ " + w.typeString(typ)
+		}
+	}
+	results := make([]string, sig.Results().Len())
+	for i := range results {
+		results[i] = w.typeString(sig.Results().At(i).Type())
+	}
+
+	s := "(" + strings.Join(params, ", ") + ")"
+	if len(results) == 1 {
+		s += " " + results[0]
+	} else if len(results) > 1 {
+		s += " (" + strings.Join(results, ", ") + ")"
+	}
+	return s
+}
+
+// typeParams returns the type parameter list `list` with its constraints,
+// like `[K comparable, V any]`, or "" if it is empty.
+func (w *genericWriter) typeParams(list *types.TypeParamList) string {
+	if list.Len() == 0 {
+		return ""
+	}
+	params := make([]string, list.Len())
+	for i := range params {
+		params[i] = list.At(i).Obj().Name() + " " + w.constraintString(list.At(i).Constraint())
+	}
+	return "[" + strings.Join(params, ", ") + "]"
+}
+
+// constrained returns the result of `write`, with the named types it
+// writes being constraints if `constraint` is set.
+func (w *genericWriter) constrained(constraint bool, write func() string) string {
+	outer := w.constraint
+	w.constraint = w.constraint || constraint
+	defer func() { w.constraint = outer }()
+	return write()
+}
+
+// constraintString returns the source of the constraint `t`.
+func (w *genericWriter) constraintString(t types.Type) string {
+	iface, ok := t.(*types.Interface)
+	if !ok || !iface.IsImplicit() {
+		return w.constrained(true, func() string { return w.typeString(t) })
+	}
+	// Constraints like `~int | ~string` are interfaces with that element.
+	elem := w.constrained(true, func() string { return w.typeString(iface.EmbeddedType(0)) })
+	if strings.HasPrefix(elem, "*") {
+		// `[T *int]` would be parsed as an array length.
+		return "interface{" + elem + "}"
+	}
+	return elem
+}
+
+// zero returns the zero value of the type `t`.
+func (w *genericWriter) zero(t types.Type) string {
+	written := w.typeString(t)
+	if _, ok := t.(*types.TypeParam); ok {
+		return "*new(" + written + ")"
+	}
+	if written == "interface{}" {
+		return "nil"
+	}
+	if named, ok := t.(*types.Named); ok && named.Obj().Pkg() != nil && named.Obj().Pkg().Path() != w.ps.path {
+		// Types of other packages may be mapped to types of any kind.
+		return "*new(" + written + ")"
+	}
+	switch u := t.Underlying().(type) {
+	case *types.Basic:
+		switch {
+		case u.Info()&types.IsBoolean != 0:
+			return "false"
+		case u.Info()&types.IsString != 0:
+			return `""`
+		case u.Kind() == types.UnsafePointer:
+			return "nil"
+		}
+		return "0"
+	case *types.Pointer, *types.Slice, *types.Map, *types.Chan, *types.Signature, *types.Interface:
+		return "nil"
+	}
+	return "*new(" + written + ")"
+}
+
+// body returns the body of a function with the signature `sig`, which
+// returns the zero values of its results.
+func (w *genericWriter) body(sig *types.Signature) string {
+	if sig.Results().Len() == 0 {
+		return ""
+	}
+	zeros := make([]string, sig.Results().Len())
+	for i := range zeros {
+		zeros[i] = w.zero(sig.Results().At(i).Type())
+	}
+	return "\n\treturn " + strings.Join(zeros, ", ") + "\n"
+}
+
+// deprecation returns the deprecation notice of the symbol `name` as a
+// comment, or "" if it isn't deprecated.
+func (w *genericWriter) deprecation(name string) string {
+	notice, ok := w.ps.deprecated[name]
+	if !ok {
+		return ""
+	}
+	var comment string
+	for _, line := range strings.Split(notice, "\n") {
+		if line == "" {
+			comment += "//\n"
+		} else {
+			comment += "// " + line + "\n"
+		}
+	}
+	return comment
+}
+
+// typeDecl returns the declarations of the generic type `obj` and of its
+// methods `methods`, or all of them if nil. Like those of reflected types,
+// its unexported fields and methods are left out.
+func (w *genericWriter) typeDecl(obj *types.TypeName, methods []string) []string {
+	named := obj.Type().(*types.Named)
+	var underlying string
+	switch u := named.Underlying().(type) {
+	case *types.Struct:
+		var fields string
+		for i := 0; i < u.NumFields(); i++ {
+			field := u.Field(i)
+			if !field.Exported() {
+				continue
+			}
+			if field.Embedded() {
+				fields += "\t" + w.typeString(field.Type()) + "\n"
+			} else {
+				fields += "\t" + field.Name() + " " + w.typeString(field.Type()) + "\n"
+			}
+		}
+		underlying = "struct{}"
+		if fields != "" {
+			underlying = "struct {\n" + fields + "}"
+		}
+	case *types.Interface:
+		underlying = "interface {\n"
+		for _, elem := range w.interfaceElems(u) {
+			underlying += "\t" + elem + "\n"
+		}
+		underlying += "}"
+	default:
+		underlying = w.typeString(u)
+	}
+	decl := fmt.Sprintf("type %s%s %s", obj.Name(), w.typeParams(named.TypeParams()), underlying)
+	decls := []string{w.deprecation(obj.Name()) + decl + "\n\n"}
+
+	selected := make(map[string]bool)
+	for _, name := range methods {
+		selected[name] = true
+	}
+	var fns []*types.Func
+	for i := 0; i < named.NumMethods(); i++ {
+		if fn := named.Method(i); fn.Exported() && (methods == nil || selected[fn.Name()]) {
+			fns = append(fns, fn)
+		}
+	}
+	sort.Slice(fns, func(i, j int) bool { return fns[i].Name() < fns[j].Name() })
+	for _, fn := range fns {
+		decls = append(decls, w.methodDecl(obj, fn))
+	}
+	return decls
+}
+
+// methodDecl returns the declaration of the method `fn` of the generic type
+// `obj`, with the receiver type parameters it is declared with, like
+// `func (_ *List[E]) Append(_ E)`.
+func (w *genericWriter) methodDecl(obj *types.TypeName, fn *types.Func) string {
+	sig := fn.Type().(*types.Signature)
+	params := make([]string, sig.RecvTypeParams().Len())
+	for i := range params {
+		params[i] = sig.RecvTypeParams().At(i).Obj().Name()
+	}
+	recv := obj.Name()
+	if len(params) > 0 {
+		recv += "[" + strings.Join(params, ", ") + "]"
+	}
+	if _, ok := sig.Recv().Type().(*types.Pointer); ok {
+		recv = "*" + recv
+	}
+	decl := fmt.Sprintf("func (_ %s) %s%s {%s}", recv, fn.Name(), w.signature(sig), w.body(sig))
+	return w.deprecation(obj.Name()+"."+fn.Name()) + decl + "\n\n"
+}
+
+// funcDecl returns the declaration of the generic function `fn`.
+func (w *genericWriter) funcDecl(fn *types.Func) string {
+	sig := fn.Type().(*types.Signature)
+	decl := fmt.Sprintf("func %s%s%s {%s}", fn.Name(), w.typeParams(sig.TypeParams()), w.signature(sig), w.body(sig))
+	return w.deprecation(fn.Name()) + decl + "\n\n"
+}
+
+// typeParamCount returns the number of type parameters of the type or
+// function declared by `decl`, a *ast.TypeSpec or *ast.FuncDecl.
+func typeParamCount(decl ast.Node) int {
+	switch decl := decl.(type) {
+	case *ast.TypeSpec:
+		return decl.TypeParams.NumFields()
+	case *ast.FuncDecl:
+		return decl.Type.TypeParams.NumFields()
+	}
+	return 0
+}
+
+// indexOperand returns the generic type of the instantiation `expr`, like
+// `List` in `List[T]` or `Map` in `Map[K, V]`, or nil if it isn't one.
+func indexOperand(expr ast.Expr) ast.Expr {
+	switch expr := expr.(type) {
+	case *ast.IndexExpr:
+		return expr.X
+	case *ast.IndexListExpr:
+		return expr.X
+	}
+	return nil
+}
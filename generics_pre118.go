@@ -0,0 +1,34 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+// Type checkers before Go 1.18 can't load packages declaring generic types
+// and functions, so there are none to stub.
+
+import (
+	"go/ast"
+
+	"github.com/github/depstubber/model"
+)
+
+type genericDecls struct{}
+
+func (ps *packageSymbols) generics(typeNames []string, valueNames []string) (*genericDecls, []string, []string, error) {
+	return nil, typeNames, valueNames, nil
+}
+
+func (g *genericDecls) addTo(pkg *model.PackedPkg) error {
+	return nil
+}
+
+func typeParamCount(decl ast.Node) int {
+	return 0
+}
+
+func indexOperand(expr ast.Expr) ast.Expr {
+	if expr, ok := expr.(*ast.IndexExpr); ok {
+		return expr.X
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+	"testing"
+
+	"github.com/github/depstubber/model"
+)
+
+// stubGenerics type-checks the package `src`, declares its generic symbols
+// `typeNames` and `valueNames` like reflectMode, and type-checks the result.
+func stubGenerics(t *testing.T, src string, typeNames []string, valueNames []string) (*types.Package, *types.Package, string) {
+	t.Helper()
+	fset := token.NewFileSet()
+	imp := importer.ForCompiler(fset, "source", nil)
+	check := func(path string, src string) *types.Package {
+		f, err := parser.ParseFile(fset, path+".go", src, 0)
+		if err != nil {
+			t.Fatalf("parsing %s: %v\n%s", path, err, src)
+		}
+		pkg, err := (&types.Config{Importer: imp}).Check(path, fset, []*ast.File{f}, nil)
+		if err != nil {
+			t.Fatalf("type-checking %s: %v\n%s", path, err, src)
+		}
+		return pkg
+	}
+
+	orig := check("example.com/lib", src)
+	ps := &packageSymbols{path: orig.Path(), scope: orig.Scope()}
+	decls, restTypes, restValues, err := ps.generics(typeNames, valueNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restTypes) > 0 || len(restValues) > 0 {
+		t.Fatalf("generics left %v and %v to the reflection program", restTypes, restValues)
+	}
+	pkg := &model.PackedPkg{Header: "package lib\n\n"}
+	if err := decls.addTo(pkg); err != nil {
+		t.Fatal(err)
+	}
+	stubSrc := pkg.Header + strings.Join(pkg.Decls, "")
+	return orig, check("example.com/lib", stubSrc), stubSrc
+}
+
+// typeParams returns the type parameters of the generic type or function
+// `obj`.
+func typeParams(obj types.Object) *types.TypeParamList {
+	if sig, ok := obj.Type().(*types.Signature); ok {
+		return sig.TypeParams()
+	}
+	return obj.Type().(*types.Named).TypeParams()
+}
+
+func TestGenericsPreserveStdlibConstraints(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		types   []string
+		values  []string
+		methods map[string][]string // the methods the stub must declare, by type
+	}{
+		{
+			name:    "comparable",
+			src:     "package lib\n\ntype Set[T comparable] struct{ m map[T]struct{} }\n\nfunc (s *Set[T]) Contains(v T) bool { return false }\n",
+			types:   []string{"Set"},
+			methods: map[string][]string{"Set": {"Contains"}},
+		},
+		{
+			name:    "any",
+			src:     "package lib\n\ntype Box[T any] struct{ V T }\n\nfunc (b Box[T]) Get() T { return b.V }\n",
+			types:   []string{"Box"},
+			methods: map[string][]string{"Box": {"Get"}},
+		},
+		{
+			name:   "cmp.Ordered",
+			src:    "package lib\n\nimport \"cmp\"\n\nfunc Max[T cmp.Ordered](a, b T) T { return a }\n",
+			values: []string{"Max"},
+		},
+		{
+			name:  "union",
+			src:   "package lib\n\ntype Key[T ~int | ~string] struct{ k T }\n",
+			types: []string{"Key"},
+		},
+		{
+			name:    "several",
+			src:     "package lib\n\nimport \"fmt\"\n\ntype Map[K comparable, V fmt.Stringer] map[K]V\n\nfunc (m Map[K, V]) Lookup(k K) (V, bool) { v, ok := m[k]; return v, ok }\n",
+			types:   []string{"Map"},
+			methods: map[string][]string{"Map": {"Lookup"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orig, stub, src := stubGenerics(t, test.src, test.types, test.values)
+			for _, name := range append(append([]string(nil), test.types...), test.values...) {
+				want := typeParams(orig.Scope().Lookup(name))
+				stubObj := stub.Scope().Lookup(name)
+				if stubObj == nil {
+					t.Fatalf("the stub doesn't declare %s:\n%s", name, src)
+				}
+				got := typeParams(stubObj)
+				if got.Len() != want.Len() {
+					t.Fatalf("the stub declares %s with %d type parameters, want %d:\n%s", name, got.Len(), want.Len(), src)
+				}
+				for i := 0; i < want.Len(); i++ {
+					if !types.Identical(got.At(i).Constraint(), want.At(i).Constraint()) {
+						t.Errorf("the constraint of %s of %s is %s, want %s:\n%s", got.At(i), name, got.At(i).Constraint(), want.At(i).Constraint(), src)
+					}
+				}
+			}
+			for typeName, methods := range test.methods {
+				named := stub.Scope().Lookup(typeName).Type().(*types.Named)
+				for _, method := range methods {
+					obj, _, _ := types.LookupFieldOrMethod(types.NewPointer(named), false, stub, method)
+					if _, ok := obj.(*types.Func); !ok {
+						t.Errorf("the stub doesn't declare %s.%s:\n%s", typeName, method, src)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+// This file contains the handling of interrupts: child processes are killed
+// and temporary state is cleaned up before depstubber exits.
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by operations cancelled by an interrupt.
+var errInterrupted = errors.New("interrupted")
+
+// interruptContext returns a context that is cancelled when depstubber
+// receives an interrupt or termination signal. A second signal exits
+// immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Print("Interrupted; stopping child processes and cleaning up")
+		cancel()
+		<-signals
+		os.Exit(130)
+	}()
+	return ctx
+}
+
+// ctxErr returns errInterrupted if `ctx` was cancelled, and `err` otherwise.
+// The error of a killed child process is then reported as an interrupt.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+	return err
+}
+
+// exitIfInterrupted exits with the conventional status of a process killed
+// by SIGINT if `ctx` was cancelled by an interrupt.
+func exitIfInterrupted(ctx context.Context) {
+	if ctx.Err() != nil {
+		log.Print("Interrupted")
+		os.Exit(130)
+	}
+}
@@ -1,57 +1,526 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-enry/go-license-detector/v4/licensedb"
+	"github.com/go-enry/go-license-detector/v4/licensedb/api"
 	"github.com/go-enry/go-license-detector/v4/licensedb/filer"
+	"golang.org/x/tools/go/packages"
 )
 
-// copyLicenses finds license files in the provided directories,
-// and copies them into the vendor directories of the stubbed packages.
-func copyLicenses(licenseDirs []string) error {
-	if licenseDirs == nil {
-		return nil
+// The values of the -license_layout flag.
+const (
+	licenseLayoutPackage = "package"
+	licenseLayoutCentral = "central"
+)
+
+// licenseConfig holds the settings for finding and copying the licenses
+// of a stub.
+type licenseConfig struct {
+	destination string        // the path of the stub
+	layout      string        // licenseLayoutPackage or licenseLayoutCentral
+	lookup      bool          // look up licenses online
+	vendorDir   string        // the vendor directory of the main module, if any
+	copiedDirs  licenseCopies // the license directories filled in this run
+}
+
+// licenseCopies holds the license directories that have already been filled
+// in a run, so that module licenses shared by several stubbed packages are
+// copied once.
+type licenseCopies map[string]bool
+
+// licenseDestination returns the directory into which the licenses of
+// module `mod`, which contains the stubbed package `pkgPath`, are copied.
+func (c licenseConfig) licenseDestination(pkgPath string, mod *packages.Module) (string, error) {
+	if c.layout != licenseLayoutCentral {
+		return c.moduleStubDir(pkgPath, mod.Path), nil
 	}
-	for _, licenseSearchDir := range licenseDirs {
-		fl, err := filer.FromDirectory(licenseSearchDir)
-		if err != nil {
-			return err
+	if c.vendorDir == "" {
+		return "", fmt.Errorf("-license_layout %s requires a main module, whose vendor directory holds the licenses", licenseLayoutCentral)
+	}
+	name := mod.Path
+	if mod.Version != "" {
+		name += "@" + mod.Version
+	}
+	return filepath.Join(c.vendorDir, ".licenses", filepath.FromSlash(name)), nil
+}
+
+// moduleStubDir returns the directory that corresponds to the root of the
+// module `modPath` for the stub of the package `pkgPath`. The license of a
+// module usually lives at its root, so for a deep subpackage like
+// github.com/aws/aws-sdk-go/service/s3, with the stub in
+// vendor/github.com/aws/aws-sdk-go/service/s3, it is
+// vendor/github.com/aws/aws-sdk-go.
+func (c licenseConfig) moduleStubDir(pkgPath string, modPath string) string {
+	dir := filepath.Dir(c.destination)
+	if pkgPath == modPath || !strings.HasPrefix(pkgPath, modPath+"/") {
+		return dir
+	}
+	for range strings.Split(strings.TrimPrefix(pkgPath, modPath+"/"), "/") {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// excludedLicenseDirs are the directories whose license files don't apply
+// to the module itself: vendored or bundled third-party code, and fixtures.
+var excludedLicenseDirs = map[string]bool{
+	"vendor":       true,
+	"node_modules": true,
+	"testdata":     true,
+	"examples":     true,
+}
+
+// slashLicensePath returns the path `relativePath` of a file relative to the
+// module root with slashes. The paths of the filer may use either separator,
+// depending on the platform; as module file paths can't contain backslashes,
+// these are separators on all platforms.
+func slashLicensePath(relativePath string) string {
+	return path.Clean(strings.ReplaceAll(filepath.ToSlash(relativePath), "\\", "/"))
+}
+
+// excludedLicensePath reports whether the license file at `relativePath`,
+// relative to the module root, is inside one of the excludedLicenseDirs.
+func excludedLicensePath(relativePath string) bool {
+	components := strings.Split(slashLicensePath(relativePath), "/")
+	for _, dir := range components[:len(components)-1] {
+		if excludedLicenseDirs[dir] {
+			return true
 		}
-		licenses, err := licensedb.Detect(fl)
-		if err != nil {
-			return err
+	}
+	return false
+}
+
+// moduleLicense holds the license files found in a module.
+type moduleLicense struct {
+	files      map[string]string // from slash-separated path relative to the module root to SPDX identifier
+	expression string            // SPDX expression combining the licenses of all files
+	source     string            // where the license was found, if not in the module itself
+}
+
+// detectedLicenses and licenseErrors cache the results of detectLicenses
+// by module path and version.
+var (
+	detectedLicenses = make(map[string]*moduleLicense)
+	licenseErrors    = make(map[string]error)
+)
+
+// lookupNotice tells once per run that licenses are looked up online.
+var lookupNotice sync.Once
+
+// detectLicenses finds the license files in the root directory of module
+// `mod`, and the license of each of them. If no license can be detected
+// locally, the license is looked up with the deps.dev API if -license_lookup
+// is set.
+func (c licenseConfig) detectLicenses(ctx context.Context, mod *packages.Module) (*moduleLicense, error) {
+	defer timePhase(phaseLicenses, time.Now())
+	key := mod.Path + "@" + mod.Version
+	if result, ok := detectedLicenses[key]; ok {
+		return result, nil
+	}
+	if err, ok := licenseErrors[key]; ok {
+		return nil, err
+	}
+
+	result, err := detectModuleLicenses(mod)
+	if err != nil && err != licensedb.ErrNoLicenseFound && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if result.expression == "" && c.lookup {
+		lookupNotice.Do(func() {
+			log.Printf("Looking up the licenses that can't be detected locally with the %s API, as -license_lookup is set", depsDevHost)
+		})
+		if expression, lookupErr := lookupLicense(ctx, mod); lookupErr == nil && expression != "" {
+			result.expression = expression
+			result.source = depsDevHost
+			err = nil
+		} else if lookupErr != nil {
+			log.Printf("Unable to look up the license of %s: %s", key, lookupErr)
+		}
+		if ctx.Err() != nil {
+			return nil, errInterrupted
 		}
-		filenames := make(map[string]bool)
-		{
-			for _, match := range licenses {
-				for fName := range match.Files {
-					filenames[fName] = true
-				}
+	}
+	if result.expression == "" {
+		if err == nil {
+			err = licensedb.ErrNoLicenseFound
+		}
+		if c.lookup {
+			err = fmt.Errorf("no license found for %s: %s", key, err)
+		} else {
+			err = fmt.Errorf("no license found for %s: %s; pass -license_lookup to look it up with the %s API", key, err, depsDevHost)
+		}
+		licenseErrors[key] = err
+		return nil, err
+	}
+
+	detectedLicenses[key] = result
+	return result, nil
+}
+
+var licenseJobs = flag.Int("license_jobs", runtime.NumCPU(), "The number of modules whose license files -auto detects concurrently.")
+
+// localLicense is the result of detectLocalLicenses for a module.
+type localLicense struct {
+	license *moduleLicense
+	err     error
+}
+
+// localLicenses caches the license files found in each module by module
+// path and version. It is filled concurrently by prefetchLicenses.
+var (
+	localLicensesMu sync.Mutex
+	localLicenses   = make(map[string]localLicense)
+)
+
+// detectModuleLicenses returns the license files found in the directory of
+// `mod`, detecting them only once per module version, and only if they are
+// not in the cache of earlier runs.
+func detectModuleLicenses(mod *packages.Module) (*moduleLicense, error) {
+	key := mod.Path + "@" + mod.Version
+	localLicensesMu.Lock()
+	cached, ok := localLicenses[key]
+	localLicensesMu.Unlock()
+	if ok {
+		return cached.license, cached.err
+	}
+
+	result, ok := readCachedLicense(mod)
+	if !ok {
+		license, err := detectLocalLicenses(mod.Dir)
+		result = localLicense{license, err}
+		writeCachedLicense(mod, result)
+	}
+	localLicensesMu.Lock()
+	localLicenses[key] = result
+	localLicensesMu.Unlock()
+	return result.license, result.err
+}
+
+// prefetchLicenses detects the license files of `modules` with up to
+// -license_jobs goroutines, so that the stubs, which are generated one after
+// the other, find them in the cache. Scanning large module directories
+// otherwise dominates runs with many dependencies.
+func prefetchLicenses(modules []*packages.Module) {
+	defer timePhase(phaseLicenses, time.Now())
+	jobs := *licenseJobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	queue := make(chan *packages.Module)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mod := range queue {
+				detectModuleLicenses(mod)
 			}
+		}()
+	}
+	seen := make(map[string]bool)
+	for _, mod := range modules {
+		if key := mod.Path + "@" + mod.Version; !seen[key] {
+			seen[key] = true
+			queue <- mod
 		}
+	}
+	close(queue)
+	wg.Wait()
+}
 
-		for licenseRelativePath := range filenames {
-			// Exclude licenses of vendored packages:
-			if strings.Contains(licenseRelativePath, "/vendor/") {
+// detectLocalLicenses finds the license files in `dir`, and the license of
+// each of them.
+func detectLocalLicenses(dir string) (*moduleLicense, error) {
+	result := &moduleLicense{files: make(map[string]string)}
+	if dir == "" {
+		// The module is not in the module cache.
+		return result, licensedb.ErrNoLicenseFound
+	}
+
+	fl, err := filer.FromDirectory(dir)
+	if err != nil {
+		return result, err
+	}
+	licenses, err := licensedb.Detect(fl)
+	if err != nil {
+		return result, err
+	}
+
+	result.files = licenseFiles(licenses)
+	ids := make([]string, 0, len(result.files))
+	for _, id := range result.files {
+		ids = append(ids, id)
+	}
+	result.expression = joinLicenses(ids)
+	return result, nil
+}
+
+// licenseFiles returns the SPDX identifier of each license file matched by
+// `licenses`, by slash-separated path relative to the module root, leaving
+// out the excludedLicensePath ones. A file may match several licenses; it
+// is attributed to the best match.
+func licenseFiles(licenses map[string]api.Match) map[string]string {
+	type fileMatch struct {
+		id         string
+		confidence float32
+	}
+	best := make(map[string]fileMatch)
+	for id, match := range licenses {
+		for fName, confidence := range match.Files {
+			// The same file may be reported with either separator on
+			// Windows; record it once, in the same form on all platforms.
+			fName = slashLicensePath(fName)
+			if excludedLicensePath(fName) {
 				continue
 			}
-			licenseFilepath := filepath.Join(licenseSearchDir, licenseRelativePath)
+			if current, ok := best[fName]; !ok || confidence > current.confidence ||
+				(confidence == current.confidence && id < current.id) {
+				best[fName] = fileMatch{id, confidence}
+			}
+		}
+	}
 
-			dstFolder := filepath.Dir(*destination)
-			dstFilepath := filepath.Join(dstFolder, licenseRelativePath)
-			if strings.HasSuffix(dstFilepath, ".go") {
-				// When saving, add .txt extension.
-				dstFilepath += ".txt"
+	files := make(map[string]string, len(best))
+	for fName, match := range best {
+		files[fName] = match.id
+	}
+	return files
+}
+
+// joinLicenses returns the SPDX expression for a module with all of the
+// licenses `ids`, e.g. one with files under different licenses.
+func joinLicenses(ids []string) string {
+	ids = DeduplicateStrings(ids)
+	sort.Strings(ids)
+	return strings.Join(ids, " AND ")
+}
+
+const depsDevHost = "deps.dev"
+
+// lookupLicense returns the SPDX expression for the license of module `mod`
+// as recorded by deps.dev.
+func lookupLicense(ctx context.Context, mod *packages.Module) (string, error) {
+	path, version := mod.Path, mod.Version
+	if mod.Replace != nil {
+		if mod.Replace.Version == "" {
+			return "", fmt.Errorf("%s is replaced by a local directory", mod.Path)
+		}
+		path, version = mod.Replace.Path, mod.Replace.Version
+	}
+	if version == "" {
+		return "", fmt.Errorf("the version of %s is unknown", path)
+	}
+
+	url := fmt.Sprintf("https://api.%s/v3/systems/go/packages/%s/versions/%s",
+		depsDevHost, neturl.PathEscape(path), neturl.PathEscape(version))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+
+	var info struct {
+		Licenses []string `json:"licenses"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("invalid response from %s: %s", url, err)
+	}
+	ids := make([]string, 0, len(info.Licenses))
+	for _, id := range info.Licenses {
+		if id != "" && id != "non-standard" {
+			ids = append(ids, id)
+		}
+	}
+	return joinLicenses(ids), nil
+}
+
+// expression returns the SPDX expression for the licenses
+// of the provided modules, or "" if none could be detected.
+func (c licenseConfig) expression(ctx context.Context, licenseModules []*packages.Module) string {
+	ids := make([]string, 0)
+	for _, mod := range licenseModules {
+		license, err := c.detectLicenses(ctx, mod)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, strings.Split(license.expression, " AND ")...)
+	}
+	return joinLicenses(ids)
+}
+
+// copiedLicense is a license file copied by copyLicenses.
+type copiedLicense struct {
+	From string // the license file in the module
+	To   string // the copy next to the stub
+}
+
+// moduleLicenseCopy is the license of a module, and the files of it that
+// copyLicenses copied.
+type moduleLicenseCopy struct {
+	Module     string // the path of the module
+	Expression string // the SPDX expression of its license
+	Source     string // where the license was found, if not in the module itself
+	Files      []copiedLicense
+}
+
+// copyLicenses finds license files in the directories of the provided modules,
+// and copies them into the vendor directories of the stubbed packages, or into
+// the central license directory of each module, relative to the destination
+// of `c`. It returns the licenses it copied, which exclude those of the
+// modules whose licenses were already copied there for another package.
+func (c licenseConfig) copyLicenses(ctx context.Context, pkgPath string, licenseModules []*packages.Module) ([]moduleLicenseCopy, error) {
+	var copied []moduleLicenseCopy
+	for _, mod := range licenseModules {
+		licenseSearchDir := mod.Dir
+		dstFolder, err := c.licenseDestination(pkgPath, mod)
+		if err != nil {
+			return copied, err
+		}
+		if c.copiedDirs[dstFolder] {
+			continue
+		}
+		c.copiedDirs[dstFolder] = true
+
+		license, err := c.detectLicenses(ctx, mod)
+		if err != nil {
+			return copied, err
+		}
+		copied = append(copied, moduleLicenseCopy{Module: mod.Path, Expression: license.expression, Source: license.source})
+		modCopy := &copied[len(copied)-1]
+
+		relativePaths := make([]string, 0, len(license.files))
+		for licenseRelativePath := range license.files {
+			relativePaths = append(relativePaths, licenseRelativePath)
+		}
+		sort.Strings(relativePaths)
+		for _, licenseRelativePath := range relativePaths {
+			licenseFilepath := filepath.Join(licenseSearchDir, filepath.FromSlash(licenseRelativePath))
+			dstFilepath := licenseCopyPath(dstFolder, licenseRelativePath)
+			if err := copyToFile(licenseFilepath, dstFilepath); err != nil {
+				return copied, err
 			}
-			fmt.Println(fmt.Sprintf("Copying %s to %s", licenseFilepath, dstFilepath))
+			modCopy.Files = append(modCopy.Files, copiedLicense{From: licenseFilepath, To: dstFilepath})
+		}
+	}
+	return copied, nil
+}
+
+// licenseCopyPath returns the path of the copy in `dstFolder` of the
+// license file at the slash-separated `relativePath` in the module. License
+// files with the .go extension get a .txt one as well, so that the go
+// command doesn't compile them.
+func licenseCopyPath(dstFolder string, relativePath string) string {
+	dst := filepath.Join(dstFolder, filepath.FromSlash(relativePath))
+	if strings.HasSuffix(dst, ".go") {
+		dst += ".txt"
+	}
+	return dst
+}
+
+// copiedGoMods holds the destinations of the go.mod files already copied.
+var copiedGoMods = make(map[string]bool)
+
+// copyGoMods copies the go.mod files of the provided modules into the vendor
+// directories corresponding to their roots, next to their licenses with the
+// package layout, so that the tools inspecting vendor directories can tell
+// which module a stub comes from.
+func (c licenseConfig) copyGoMods(pkgPath string, licenseModules []*packages.Module) error {
+	for _, mod := range licenseModules {
+		goMod := mod.GoMod
+		if mod.Replace != nil && mod.Replace.GoMod != "" {
+			goMod = mod.Replace.GoMod
+		}
+		dst := filepath.Join(c.moduleStubDir(pkgPath, mod.Path), "go.mod")
+		if goMod == "" || copiedGoMods[dst] {
+			continue
+		}
+		copiedGoMods[dst] = true
+
+		data, err := ioutil.ReadFile(goMod)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(progress, "Copying %s to %s\n", goMod, dst)
+		if err := writeFile(dst, data, nil, fileAction{Package: pkgPath}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			MustCreateFolderIfNotExists(filepath.Dir(dstFilepath), os.ModePerm)
-			MustCopyFile(licenseFilepath, dstFilepath)
+// stubLicenseDirs maps each stubbed package to the directories in which a
+// license file for its stub may be found.
+var stubLicenseDirs = make(map[string][]string)
+
+// recordLicenseDirs records where the license of the stub of package
+// `pkgPath` is expected, for -require_license.
+func (c licenseConfig) recordLicenseDirs(pkgPath string, licenseModules []*packages.Module) error {
+	dirs := make([]string, 0)
+	for _, mod := range licenseModules {
+		dir, err := c.licenseDestination(pkgPath, mod)
+		if err != nil {
+			return err
 		}
+		dirs = append(dirs, dir)
 	}
+	if len(dirs) == 0 && c.destination != "" {
+		// Without module information, accept a license in the directory of
+		// the stub or in any parent directory inside the vendor directory.
+		dir, _ := filepath.Abs(filepath.Dir(c.destination))
+		dirs = append(dirs, dir)
+		for c.vendorDir != "" && strings.HasPrefix(dir, c.vendorDir+string(filepath.Separator)) {
+			dir = filepath.Dir(dir)
+			if dir != c.vendorDir {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	stubLicenseDirs[pkgPath] = append(stubLicenseDirs[pkgPath], dirs...)
 	return nil
 }
+
+// unlicensedPackages returns the sorted stubbed packages for which no
+// license file is found in any of the recorded directories.
+func unlicensedPackages() []string {
+	unlicensed := make([]string, 0)
+	for pkgPath, dirs := range stubLicenseDirs {
+		found := false
+		for _, dir := range dirs {
+			if license, err := detectLocalLicenses(dir); err == nil && len(license.files) > 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unlicensed = append(unlicensed, pkgPath)
+		}
+	}
+	sort.Strings(unlicensed)
+	return unlicensed
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-enry/go-license-detector/v4/licensedb/api"
+	"golang.org/x/tools/go/packages"
+)
+
+func TestSlashLicensePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"LICENSE", "LICENSE"},
+		{"third_party/LICENSE", "third_party/LICENSE"},
+		{`third_party\LICENSE`, "third_party/LICENSE"},
+		{`third_party\zlib/LICENSE`, "third_party/zlib/LICENSE"},
+		{"./LICENSE", "LICENSE"},
+		{`.\docs\..\LICENSE`, "LICENSE"},
+		{"docs//LICENSE", "docs/LICENSE"},
+		{filepath.Join("docs", "LICENSE"), "docs/LICENSE"},
+	}
+	for _, test := range tests {
+		if got := slashLicensePath(test.path); got != test.want {
+			t.Errorf("slashLicensePath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestExcludedLicensePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"LICENSE", false},
+		{"vendor", false},
+		{"third_party/LICENSE", false},
+		{"vendor/github.com/pkg/errors/LICENSE", true},
+		{"node_modules/left-pad/LICENSE", true},
+		{"internal/testdata/LICENSE", true},
+		{"examples/LICENSE", true},
+		{"docs/examples.md/LICENSE", false},
+		{"vendorized/LICENSE", false},
+		{`vendor\github.com\pkg\errors\LICENSE`, true},
+		{`internal\testdata\LICENSE`, true},
+		{`third_party\LICENSE`, false},
+		{`.\examples\LICENSE`, true},
+		{filepath.Join("vendor", "LICENSE"), true},
+	}
+	for _, test := range tests {
+		if got := excludedLicensePath(test.path); got != test.want {
+			t.Errorf("excludedLicensePath(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestLicenseFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		licenses map[string]api.Match
+		want     map[string]string
+	}{
+		{
+			name: "best match",
+			licenses: map[string]api.Match{
+				"MIT":          {Files: map[string]float32{"LICENSE": 0.98}},
+				"MIT-0":        {Files: map[string]float32{"LICENSE": 0.9}},
+				"BSD-3-Clause": {Files: map[string]float32{"third_party/LICENSE": 0.95}},
+			},
+			want: map[string]string{"LICENSE": "MIT", "third_party/LICENSE": "BSD-3-Clause"},
+		},
+		{
+			name: "tie",
+			licenses: map[string]api.Match{
+				"MIT":        {Files: map[string]float32{"LICENSE": 0.9}},
+				"Apache-2.0": {Files: map[string]float32{"LICENSE": 0.9}},
+			},
+			want: map[string]string{"LICENSE": "Apache-2.0"},
+		},
+		{
+			name: "windows separators",
+			licenses: map[string]api.Match{
+				"MIT":        {Files: map[string]float32{`third_party\LICENSE`: 0.9}},
+				"Apache-2.0": {Files: map[string]float32{"third_party/LICENSE": 0.95, `.\NOTICE`: 0.9}},
+			},
+			want: map[string]string{"third_party/LICENSE": "Apache-2.0", "NOTICE": "Apache-2.0"},
+		},
+		{
+			name: "excluded",
+			licenses: map[string]api.Match{
+				"MIT":        {Files: map[string]float32{"LICENSE": 0.9, `vendor\x\LICENSE`: 0.99}},
+				"Apache-2.0": {Files: map[string]float32{"testdata/LICENSE": 0.99}},
+			},
+			want: map[string]string{"LICENSE": "MIT"},
+		},
+	}
+	for _, test := range tests {
+		if got := licenseFiles(test.licenses); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: licenseFiles() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLicenseCopyPath(t *testing.T) {
+	dst := filepath.Join("vendor", "github.com", "pkg", "errors")
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"LICENSE", filepath.Join(dst, "LICENSE")},
+		{"third_party/zlib/LICENSE", filepath.Join(dst, "third_party", "zlib", "LICENSE")},
+		{"license.go", filepath.Join(dst, "license.go.txt")},
+		{"docs/license.go", filepath.Join(dst, "docs", "license.go.txt")},
+		{"LICENSE.gopher", filepath.Join(dst, "LICENSE.gopher")},
+	}
+	for _, test := range tests {
+		if got := licenseCopyPath(dst, test.path); got != test.want {
+			t.Errorf("licenseCopyPath(%q, %q) = %q, want %q", dst, test.path, got, test.want)
+		}
+	}
+}
+
+func TestLicenseDestination(t *testing.T) {
+	vendorDir := filepath.Join("src", "app", "vendor")
+	stub := filepath.Join(vendorDir, "github.com", "aws", "aws-sdk-go", "service", "s3", "stub.go")
+	tests := []struct {
+		name    string
+		config  licenseConfig
+		pkgPath string
+		mod     *packages.Module
+		want    string
+		err     bool
+	}{
+		{
+			name:    "package layout, module root",
+			config:  licenseConfig{destination: filepath.Join(vendorDir, "example.com", "a", "stub.go"), layout: licenseLayoutPackage, vendorDir: vendorDir},
+			pkgPath: "example.com/a",
+			mod:     &packages.Module{Path: "example.com/a", Version: "v1.0.0"},
+			want:    filepath.Join(vendorDir, "example.com", "a"),
+		},
+		{
+			name:    "package layout, subpackage",
+			config:  licenseConfig{destination: stub, layout: licenseLayoutPackage},
+			pkgPath: "github.com/aws/aws-sdk-go/service/s3",
+			mod:     &packages.Module{Path: "github.com/aws/aws-sdk-go", Version: "v1.44.0"},
+			want:    filepath.Join(vendorDir, "github.com", "aws", "aws-sdk-go"),
+		},
+		{
+			name:    "central layout",
+			config:  licenseConfig{destination: stub, layout: licenseLayoutCentral, vendorDir: vendorDir},
+			pkgPath: "github.com/aws/aws-sdk-go/service/s3",
+			mod:     &packages.Module{Path: "github.com/aws/aws-sdk-go", Version: "v1.44.0"},
+			want:    filepath.Join(vendorDir, ".licenses", "github.com", "aws", "aws-sdk-go@v1.44.0"),
+		},
+		{
+			name:    "central layout without version",
+			config:  licenseConfig{destination: stub, layout: licenseLayoutCentral, vendorDir: vendorDir},
+			pkgPath: "example.com/a",
+			mod:     &packages.Module{Path: "example.com/a"},
+			want:    filepath.Join(vendorDir, ".licenses", "example.com", "a"),
+		},
+		{
+			name:    "central layout without main module",
+			config:  licenseConfig{destination: stub, layout: licenseLayoutCentral},
+			pkgPath: "example.com/a",
+			mod:     &packages.Module{Path: "example.com/a", Version: "v1.0.0"},
+			err:     true,
+		},
+	}
+	for _, test := range tests {
+		got, err := test.config.licenseDestination(test.pkgPath, test.mod)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("%s: licenseDestination(%q) = %q, %v, want %q", test.name, test.pkgPath, got, err, test.want)
+		}
+	}
+}
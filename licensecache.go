@@ -0,0 +1,127 @@
+package main
+
+// This file contains the cache of the license files detected in module
+// versions, which is kept in the user cache directory across runs.
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/go-enry/go-license-detector/v4/licensedb"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+)
+
+var noLicenseCache = flag.Bool("no_license_cache", false, "Detect the license files of modules again instead of using the results cached in the user cache directory.")
+
+// licenseCacheVersion is changed when the way license files are detected
+// changes, so that older results are detected again.
+const licenseCacheVersion = 1
+
+// cachedLicense is a cached result of detectLocalLicenses.
+type cachedLicense struct {
+	Version    int               `json:"version"`
+	Files      map[string]string `json:"files,omitempty"`
+	Expression string            `json:"expression,omitempty"`
+	NotFound   bool              `json:"not_found,omitempty"`
+}
+
+// licenseCachePath returns the file caching the license files of `mod`, or
+// "" if they can't be cached: only the contents of module versions from the
+// module cache never change.
+func licenseCachePath(mod *packages.Module) string {
+	if *noLicenseCache {
+		return ""
+	}
+	path, version := mod.Path, mod.Version
+	if mod.Replace != nil {
+		path, version = mod.Replace.Path, mod.Replace.Version
+	}
+	if version == "" || mod.Dir == "" {
+		return ""
+	}
+	escapedPath, err := module.EscapePath(path)
+	if err != nil {
+		return ""
+	}
+	escapedVersion, err := module.EscapeVersion(version)
+	if err != nil {
+		return ""
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "depstubber", "licenses", filepath.FromSlash(escapedPath)+"@"+escapedVersion+".json")
+}
+
+// readCachedLicense returns the cached license files of `mod`, if any.
+func readCachedLicense(mod *packages.Module) (localLicense, bool) {
+	path := licenseCachePath(mod)
+	if path == "" {
+		return localLicense{}, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return localLicense{}, false
+	}
+	var cached cachedLicense
+	if err := json.Unmarshal(data, &cached); err != nil || cached.Version != licenseCacheVersion {
+		return localLicense{}, false
+	}
+
+	license := &moduleLicense{files: cached.Files, expression: cached.Expression}
+	if license.files == nil {
+		license.files = make(map[string]string)
+	}
+	if cached.NotFound {
+		return localLicense{license, licensedb.ErrNoLicenseFound}, true
+	}
+	return localLicense{license, nil}, true
+}
+
+// writeCachedLicense caches the license files of `mod` detected with the
+// result `result`. Other errors than finding no license are not cached, and
+// failing to write the cache is not an error.
+func writeCachedLicense(mod *packages.Module, result localLicense) {
+	path := licenseCachePath(mod)
+	if path == "" || (result.err != nil && result.err != licensedb.ErrNoLicenseFound) {
+		return
+	}
+	data, err := json.Marshal(&cachedLicense{
+		Version:    licenseCacheVersion,
+		Files:      result.license.files,
+		Expression: result.license.expression,
+		NotFound:   result.err != nil,
+	})
+	if err != nil {
+		return
+	}
+	writeCacheFile(path, data)
+}
+
+// writeCacheFile writes `data` to the file `path` in the user cache
+// directory, ignoring errors.
+func writeCacheFile(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return
+	}
+	// Other runs may read the cache at the same time.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+// This file contains the directives that make linters skip the stubs.
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var lintIgnore = flag.String("lint_ignore", "", "Comma-separated list of linters that should skip the stubs, among 'golangci-lint' (with a //nolint:all directive) and 'staticcheck' (with a //lint:file-ignore directive).")
+
+// lintDirectives holds the directive that makes each linter of -lint_ignore
+// skip a file.
+var lintDirectives = map[string]string{
+	"golangci-lint": "//nolint:all",
+	"staticcheck":   "//lint:file-ignore U1000,ST1003,ST1016 Generated by depstubber.",
+}
+
+// lintIgnoreDirectives returns the directives for the linters of -lint_ignore.
+func lintIgnoreDirectives() ([]string, error) {
+	var directives []string
+	for _, linter := range split(*lintIgnore) {
+		directive, ok := lintDirectives[strings.TrimSpace(linter)]
+		if !ok {
+			known := make([]string, 0, len(lintDirectives))
+			for name := range lintDirectives {
+				known = append(known, name)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown linter %q in -lint_ignore; expected one of %s", linter, strings.Join(known, ", "))
+		}
+		directives = append(directives, directive)
+	}
+	return directives, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+// This file contains the lockfile, which records the packages stubbed into
+// a vendor directory and how, so that the stubs can be reproduced.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// lockfileName is the name of the lockfile in the vendor directory.
+const lockfileName = "depstubber.lock.json"
+
+const lockfileVersion = 1
+
+type lockfile struct {
+	Version  int             `json:"version"`
+	Packages []lockedPackage `json:"packages"`
+
+	// Unresolved are the packages skipped with -skip_unresolvable.
+	Unresolved []unresolvedPackage `json:"unresolved,omitempty"`
+}
+
+// lockedPackage records a stubbed package.
+type lockedPackage struct {
+	Package string   `json:"package"`
+	Types   []string `json:"types,omitempty"`
+	Values  []string `json:"values,omitempty"`
+
+	// Options holds the flags that affect the stub and were not left at
+	// their default values, without the leading dash.
+	Options map[string]string `json:"options,omitempty"`
+
+	// Module is the version of the module the stub was generated from.
+	Module *moduleSum `json:"module,omitempty"`
+
+	// License, Purl and Registry are the SPDX expression of the license,
+	// the package URL and the deps.dev page of the module, for compliance
+	// tools.
+	License  string `json:"license,omitempty"`
+	Purl     string `json:"purl,omitempty"`
+	Registry string `json:"registry,omitempty"`
+
+	// Env is the go environment the stub was generated in.
+	Env *generationEnv `json:"env,omitempty"`
+}
+
+// lockedFlags are the flags that affect the content of a stub.
+var lockedFlags = []string{
+	"apicheck",
+	"bazel_build",
+	"build_flags",
+	"copyright_file",
+	"empty_interface",
+	"enum_strings",
+	"escape_paths",
+	"examples",
+	"exclude_symbols",
+	"fakes",
+	"from-dir",
+	"goos",
+	"lang",
+	"lint_ignore",
+	"match",
+	"prune",
+	"type_map",
+	"use_ext_types",
+	"vendor_go_mod",
+	"write_readme",
+}
+
+// lockedPackages holds the packages stubbed into the vendor directory
+// during this run.
+var lockedPackages []lockedPackage
+
+// recordLockedPackage records the stub of `pkgPath` for the lockfile.
+func recordLockedPackage(pkgPath string, typeNames []string, funcAndVarNames []string, sum *moduleSum, licenseExpression string) {
+	locked := lockedPackage{
+		Package: pkgPath,
+		Types:   typeNames,
+		Values:  funcAndVarNames,
+		Module:  sum,
+		License: licenseExpression,
+		Env:     currentGenerationEnv(),
+	}
+	if sum != nil {
+		locked.Purl, locked.Registry = sum.purl(), sum.registryURL()
+	}
+	for _, name := range lockedFlags {
+		if value := lockedFlagValue(name); value != flag.Lookup(name).DefValue {
+			if locked.Options == nil {
+				locked.Options = make(map[string]string)
+			}
+			locked.Options[name] = value
+		}
+	}
+	lockedPackages = append(lockedPackages, locked)
+}
+
+// lockedFlagValue returns the value of the locked flag `name`. That of
+// -build_flags includes the arguments of -build_flag, so that setting it
+// again passes both.
+func lockedFlagValue(name string) string {
+	if name == "build_flags" {
+		return effectiveBuildFlags()
+	}
+	return flag.Lookup(name).Value.String()
+}
+
+// lockfilePath returns the path of the lockfile of the module containing
+// the current directory.
+func lockfilePath() string {
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Unable to load current directory: %v", err)
+	}
+	return filepath.Join(findModuleRoot(wd), "vendor", lockfileName)
+}
+
+// readLockfile reads the lockfile at `path`; a missing lockfile is empty.
+func readLockfile(path string) (*lockfile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &lockfile{Version: lockfileVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lock lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("invalid lockfile %s: %s", path, err)
+	}
+	if lock.Version > lockfileVersion {
+		return nil, fmt.Errorf("lockfile %s has version %d; this depstubber only supports version %d", path, lock.Version, lockfileVersion)
+	}
+	return &lock, nil
+}
+
+// updateLockfile records the packages stubbed during this run in the
+// lockfile of the current module, replacing earlier entries for them.
+func updateLockfile() {
+	if len(lockedPackages) == 0 && len(unresolvedPackages) == 0 {
+		return
+	}
+	path := lockfilePath()
+	lock, err := readLockfile(path)
+	if err != nil {
+		log.Fatalf("Unable to update the lockfile: %v", err)
+	}
+
+	byPackage := make(map[string]lockedPackage)
+	for _, locked := range lock.Packages {
+		byPackage[locked.Package] = locked
+	}
+	for _, locked := range lockedPackages {
+		if earlier, ok := byPackage[locked.Package]; ok && *strictEnv && earlier.Env.differsMaterially(locked.Env) {
+			log.Printf("WARNING: the stub of %s was generated with %s, but regenerated with %s; its changes may come from that", locked.Package, earlier.Env, locked.Env)
+		}
+		byPackage[locked.Package] = locked
+	}
+	lock.Version = lockfileVersion
+	lock.Packages = make([]lockedPackage, 0, len(byPackage))
+	for _, locked := range byPackage {
+		lock.Packages = append(lock.Packages, locked)
+	}
+	sort.Slice(lock.Packages, func(i, j int) bool {
+		return lock.Packages[i].Package < lock.Packages[j].Package
+	})
+	lock.Unresolved = mergeUnresolved(lock.Unresolved)
+
+	if err := writeLockfile(path, lock); err != nil {
+		log.Fatalf("Unable to update the lockfile: %v", err)
+	}
+}
+
+// writeLockfile writes `lock` to `path`, and updates the CodeQL manifest
+// next to it.
+func writeLockfile(path string, lock *lockfile) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFile(path, append(data, '\n'), nil, fileAction{}); err != nil {
+		return err
+	}
+	return writeCodeQLManifest(filepath.Dir(path), lock)
+}
+
+// finishVendor writes the files describing the vendor directory after the
+// stubs have been written into it.
+func finishVendor() {
+	stubModulesTxt()
+	updateLockfile()
+	if *vendorVerify && !planOnly {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalf("Unable to load current directory: %v", err)
+		}
+		if err := verifyVendoring(findModuleRoot(wd)); err != nil {
+			log.Fatalf("Verifying the vendor directory failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package model
+
+import "fmt"
+
+// FakeDirective marks the doc comments of the fakes generated for stubbed
+// interfaces with Package.Fakes, which the real package doesn't declare.
+const FakeDirective = "//depstubber:fake"
+
+// fakeDecls returns the declarations of a fake of the interface `named`: a
+// struct type whose methods do nothing and return zero values, named like
+// `FakeClient` for `Client`. It returns nil if the interface has no methods,
+// or the name of the fake is taken.
+func (pkg *Package) fakeDecls(named *NamedType, iface *InterfaceType, pm map[string]string) []string {
+	if len(iface.Methods) == 0 || !isExported(named.Name) {
+		return nil
+	}
+	name := "Fake" + named.Name
+	if pkg.declares(name) {
+		pkg.Notes = append(pkg.Notes, fmt.Sprintf("no fake of %s was generated, as the package declares %s", named.Name, name))
+		return nil
+	}
+
+	fake := &NamedType{Package: pkg.PkgPath, Name: name, Underlying: &StructType{}}
+	decls := []string{
+		fmt.Sprintf("// %s is a no-op implementation of %s, whose methods return zero values.\n//\n%s\n", name, named.Name, FakeDirective) +
+			fake.Declaration(pm, pkg.PkgPath) + "\n",
+		fmt.Sprintf("var _ %s = %s{}\n\n", named.Name, name),
+	}
+	for _, meth := range iface.Methods {
+		m := &Method{
+			Name: meth.Name,
+			Type: &FuncType{
+				In:       append([]*Parameter{{Type: fake}}, meth.Type.In...),
+				Out:      meth.Type.Out,
+				Variadic: meth.Type.Variadic,
+			},
+		}
+		decls = append(decls, m.Declaration(pm, pkg.PkgPath)+"\n\n")
+	}
+	return decls
+}
@@ -3,15 +3,18 @@ package model
 
 import (
 	"bytes"
+	"encoding"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"go/token"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -58,13 +61,61 @@ const pkgPath = "github.com/github/depstubber/model"
 type PackedPkg struct {
 	Name    string
 	PkgPath string
-	Body    string
+
+	// Body is the whole source of the stub, as sent by reflection programs
+	// built with older versions of this package; newer ones send the
+	// package clause and imports in Header, and each declaration in Decls.
+	Body   string
+	Header string
+	Decls  []string
+
+	Notes []string
 }
 
 func PackPkg(pkg *Package) *PackedPkg {
+	header, decls := pkg.source()
 	return &PackedPkg{
-		pkg.Name, pkg.PkgPath, pkg.String(),
+		Name:    pkg.Name,
+		PkgPath: pkg.PkgPath,
+		Header:  header,
+		Decls:   decls,
+		Notes:   DeduplicateNotes(pkg.Notes),
+	}
+}
+
+// Size returns the length of the source of the stub.
+func (p *PackedPkg) Size() int {
+	size := len(p.Body) + len(p.Header)
+	for _, decl := range p.Decls {
+		size += len(decl)
 	}
+	return size
+}
+
+// WriteTo writes the source of the stub to `w`.
+func (p *PackedPkg) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, s := range append([]string{p.Body, p.Header}, p.Decls...) {
+		n, err := io.WriteString(w, s)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// DeduplicateNotes returns `notes` without repeated entries, in their original order.
+func DeduplicateNotes(notes []string) []string {
+	result := make([]string, 0, len(notes))
+	seen := make(map[string]bool)
+	for _, note := range notes {
+		if !seen[note] {
+			seen[note] = true
+			result = append(result, note)
+		}
+	}
+	return result
 }
 
 // Package is a Go package. It may be a subset.
@@ -74,6 +125,55 @@ type Package struct {
 	UseExtTypes bool
 	Exports     map[string]Export
 	NamedTypes  map[string]Type
+
+	// SelectedMethods maps the names of types of this package to the
+	// names of the only methods that should be stubbed for them.
+	SelectedMethods map[string][]string
+
+	// EnumStrings makes the String methods of types with stubbed constants
+	// return the original results for those constants.
+	EnumStrings bool
+
+	// Fakes adds a no-op implementation of each stubbed interface, like
+	// `FakeClient` for `Client`, for tests to use.
+	Fakes bool
+
+	// Lang is the Go language version the stub must compile with, like
+	// "go1.16"; if empty, the stub may use any construct.
+	Lang string
+
+	// Deprecations holds the deprecation notices of the original symbols,
+	// like "Deprecated: Use Bar instead.", with methods named as
+	// `Type.Method`. They are copied into the stub.
+	Deprecations map[string]string
+
+	// TypeMap maps external types, named like "github.com/google/uuid.UUID",
+	// to the types stubbed in their place: a type of the standard library,
+	// like "time.Time", or a type expression without package qualifiers,
+	// like "[16]byte" or the name of a type declared next to the stub.
+	TypeMap map[string]string
+
+	// Notes are messages for the user about decisions taken while stubbing.
+	Notes []string
+
+	// sealed holds the interfaces of this package with unexported methods,
+	// and stubbedTypes the other named types of this package stubbed so
+	// far, so that those implementing the interfaces get the methods too.
+	sealed       []sealedInterface
+	stubbedTypes []stubbedType
+}
+
+// sealedInterface is an interface of the stubbed package with unexported
+// methods, which only types of the package can implement.
+type sealedInterface struct {
+	typ     reflect.Type
+	methods []string
+}
+
+// stubbedType is a named type of the stubbed package and its stub.
+type stubbedType struct {
+	typ  reflect.Type
+	stub *NamedType
 }
 
 func NewPackage(pkgpath string, useExtTypes bool) *Package {
@@ -91,10 +191,93 @@ func NewPackage(pkgpath string, useExtTypes bool) *Package {
 		UseExtTypes: useExtTypes,
 		Exports:     make(map[string]Export),
 		NamedTypes:  make(map[string]Type),
+
+		SelectedMethods: make(map[string][]string),
+	}
+}
+
+// SelectMethods restricts the methods stubbed for the type `name` of this
+// package to `methods`. It must be called before the type is added.
+func (pkg *Package) SelectMethods(name string, methods []string) {
+	pkg.SelectedMethods[name] = append(pkg.SelectedMethods[name], methods...)
+}
+
+// methodSelected reports whether the method `method` of type `t` should
+// be stubbed.
+func (pkg *Package) methodSelected(t reflect.Type, method string) bool {
+	if t.PkgPath() != pkg.PkgPath {
+		return true
+	}
+	if pkg.EnumStrings && method == "String" {
+		return true
+	}
+	selected, ok := pkg.SelectedMethods[t.Name()]
+	if !ok {
+		return true
+	}
+	for _, name := range selected {
+		if name == method {
+			return true
+		}
 	}
+	if iface := preservedInterface(t, method); iface != nil {
+		pkg.Notes = append(pkg.Notes, fmt.Sprintf("kept method %s.%s so that the stub still implements %s", t.Name(), method, iface))
+		return true
+	}
+	return false
+}
+
+// preservedInterfaces are interfaces that values are commonly passed as.
+// Stubbed types keep the methods needed to implement those of them that the
+// original types implement, even if the methods were not selected.
+var preservedInterfaces = []reflect.Type{
+	reflect.TypeOf((*error)(nil)).Elem(),
+	reflect.TypeOf((*fmt.Stringer)(nil)).Elem(),
+	reflect.TypeOf((*fmt.GoStringer)(nil)).Elem(),
+	reflect.TypeOf((*fmt.Formatter)(nil)).Elem(),
+	reflect.TypeOf((*io.Reader)(nil)).Elem(),
+	reflect.TypeOf((*io.Writer)(nil)).Elem(),
+	reflect.TypeOf((*io.Closer)(nil)).Elem(),
+	reflect.TypeOf((*io.Seeker)(nil)).Elem(),
+	reflect.TypeOf((*io.ReaderAt)(nil)).Elem(),
+	reflect.TypeOf((*io.WriterAt)(nil)).Elem(),
+	reflect.TypeOf((*io.ReaderFrom)(nil)).Elem(),
+	reflect.TypeOf((*io.WriterTo)(nil)).Elem(),
+	reflect.TypeOf((*io.ByteReader)(nil)).Elem(),
+	reflect.TypeOf((*io.ByteWriter)(nil)).Elem(),
+	reflect.TypeOf((*io.RuneReader)(nil)).Elem(),
+	reflect.TypeOf((*io.StringWriter)(nil)).Elem(),
+	reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem(),
+	reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem(),
+	reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem(),
+	reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem(),
+	reflect.TypeOf((*json.Marshaler)(nil)).Elem(),
+	reflect.TypeOf((*json.Unmarshaler)(nil)).Elem(),
+	reflect.TypeOf((*sort.Interface)(nil)).Elem(),
+}
+
+// preservedInterface returns the preserved interface that requires `t` to
+// keep the method `method`, or nil if there is none.
+func preservedInterface(t reflect.Type, method string) reflect.Type {
+	for _, iface := range preservedInterfaces {
+		if _, ok := iface.MethodByName(method); !ok {
+			continue
+		}
+		if t.Implements(iface) || (t.Kind() != reflect.Interface && reflect.PtrTo(t).Implements(iface)) {
+			return iface
+		}
+	}
+	return nil
 }
 
 func (pkg *Package) String() string {
+	header, decls := pkg.source()
+	return header + strings.Join(decls, "")
+}
+
+// source returns the package clause and imports of the stub, and each of
+// its declarations followed by a blank line.
+func (pkg *Package) source() (string, []string) {
 	var ret string
 
 	// Get all required imports, and generate unique names for them all.
@@ -151,6 +334,7 @@ func (pkg *Package) String() string {
 		ret += fmt.Sprintf("\t%v %q\n", pkgName, pkgPath)
 	}
 	ret += ")\n\n"
+	var decls []string
 
 	// sort keys so output is deterministic
 	keys := make([]string, 0, len(pkg.Exports))
@@ -159,10 +343,23 @@ func (pkg *Package) String() string {
 	}
 	sort.Strings(keys)
 
+	// typed constants are emitted in a single declaration per type, so that
+	// enums keep their type and values
+	constGroups := make(map[string]bool)
+
 	for _, key := range keys {
 		export := pkg.Exports[key]
 
-		ret += export.Declaration(pm, pkg.PkgPath) + "\n\n"
+		if c, ok := export.(*Constant); ok && c.Type != nil {
+			typ := c.Type.String(pm, pkg.PkgPath)
+			if !constGroups[typ] {
+				constGroups[typ] = true
+				decls = append(decls, pkg.constGroup(typ, pm)+"\n\n")
+			}
+			continue
+		}
+
+		decls = append(decls, pkg.deprecation(key, "")+export.Declaration(pm, pkg.PkgPath)+"\n\n")
 
 		if named, ok := export.(*NamedType); ok {
 			// if _, ok := named.Underlying.(*InterfaceType); ok {
@@ -171,11 +368,20 @@ func (pkg *Package) String() string {
 
 			// we have a named type that is not an interface, print methods
 			for _, meth := range named.Methods {
-				ret += meth.Declaration(pm, pkg.PkgPath) + "\n\n"
+				comment := pkg.deprecation(named.Name+"."+meth.Name, "")
+				if decl, ok := pkg.enumStringMethod(named, meth, pm); ok {
+					decls = append(decls, comment+decl+"\n\n")
+					continue
+				}
+				decls = append(decls, comment+meth.Declaration(pm, pkg.PkgPath)+"\n\n")
+			}
+
+			if iface, ok := named.Underlying.(*InterfaceType); ok && pkg.Fakes {
+				decls = append(decls, pkg.fakeDecls(named, iface, pm)...)
 			}
 		}
 	}
-	return ret
+	return ret, decls
 }
 
 // Imports returns the imports needed by the Package as a set of import paths.
@@ -238,6 +444,14 @@ func (pkg *Package) AddValue(name string, val reflect.Value) error {
 	if err != nil {
 		return err
 	}
+	if u := unnamedOf(typ); t == EmptyInterface && u != nil {
+		// Maps and slices of types that aren't stubbed, like a table of
+		// defaults of an unexported type, keep their structure, so that
+		// they can be indexed and iterated over.
+		if t, err = pkg.typeFromType(u); err != nil {
+			return err
+		}
+	}
 
 	switch t := t.(type) {
 	case *FuncType:
@@ -255,6 +469,73 @@ func (pkg *Package) AddValue(name string, val reflect.Value) error {
 	return nil
 }
 
+// unnamedOf returns the unnamed type underlying the named map, slice or
+// array type `t`, or nil if `t` isn't one.
+func unnamedOf(t reflect.Type) reflect.Type {
+	if t.Name() == "" || strings.Contains(t.Name(), "[") {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return reflect.MapOf(t.Key(), t.Elem())
+	case reflect.Slice:
+		return reflect.SliceOf(t.Elem())
+	case reflect.Array:
+		return reflect.ArrayOf(t.Len(), t.Elem())
+	}
+	return nil
+}
+
+// AddConst adds the constant `name` with the value `lit`, given as a Go
+// literal. `val` is the value of the constant, or the zero Value for untyped
+// constants. `index` is the position of the constant in declaration order.
+func (pkg *Package) AddConst(name string, val reflect.Value, lit string, index int) error {
+	c := &Constant{
+		Name:  name,
+		Value: lit,
+		Index: index,
+	}
+
+	if val.IsValid() {
+		typ := val.Type()
+		t, err := pkg.typeFromType(typ)
+		if err != nil {
+			return err
+		}
+
+		switch t.(type) {
+		case *NamedType, PredeclaredType:
+			c.Type = t
+		default:
+			// The type of the constant can't be named in the stub (e.g. it
+			// is unexported), so fall back to its basic kind.
+			c.Type = PredeclaredType(typ.Kind().String())
+		}
+
+		if pkg.EnumStrings {
+			c.Str, c.HasStr = stringOf(val)
+		}
+	}
+
+	pkg.Exports[name] = c
+	return nil
+}
+
+var stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+// stringOf returns the result of the String method of `val`, if it has one.
+func stringOf(val reflect.Value) (str string, ok bool) {
+	if !val.Type().Implements(stringerType) {
+		return "", false
+	}
+	defer func() {
+		if recover() != nil {
+			str, ok = "", false
+		}
+	}()
+	return val.Interface().(fmt.Stringer).String(), true
+}
+
 type Export interface {
 	Declaration(pm map[string]string, pkgOverride string) string
 	addImports(im map[string]bool)
@@ -266,13 +547,134 @@ type Variable struct {
 }
 
 func (v *Variable) Declaration(pm map[string]string, pkgOverride string) string {
-	return "var " + v.Name + " " + v.Type.String(pm, pkgOverride) + " = " + zeroOf(v.Type, pm, pkgOverride)
+	value := compositeOf(v.Type, pm, pkgOverride)
+	if value == "" {
+		value = zeroOf(v.Type, pm, pkgOverride)
+	}
+	return "var " + v.Name + " " + v.Type.String(pm, pkgOverride) + " = " + value
 }
 
 func (v *Variable) addImports(im map[string]bool) {
 	v.Type.addImports(im)
 }
 
+// Constant is a constant.
+type Constant struct {
+	Name  string
+	Type  Type // nil for untyped constants
+	Value string
+	Index int // position in declaration order
+
+	// Str is the result of the original String method of the constant,
+	// if HasStr is set.
+	Str    string
+	HasStr bool
+}
+
+func (c *Constant) Declaration(pm map[string]string, pkgOverride string) string {
+	return "const " + c.spec(pm, pkgOverride)
+}
+
+// spec returns the constant specification, as used inside a const declaration.
+func (c *Constant) spec(pm map[string]string, pkgOverride string) string {
+	if c.Type == nil {
+		return c.Name + " = " + c.Value
+	}
+	return c.Name + " " + c.Type.String(pm, pkgOverride) + " = " + c.Value
+}
+
+func (c *Constant) addImports(im map[string]bool) {
+	if c.Type != nil {
+		c.Type.addImports(im)
+	}
+}
+
+// constGroup returns a single const declaration for all typed constants
+// of the package whose type is `typ`, in declaration order.
+func (pkg *Package) constGroup(typ string, pm map[string]string) string {
+	consts := make([]*Constant, 0)
+	for _, export := range pkg.Exports {
+		if c, ok := export.(*Constant); ok && c.Type != nil && c.Type.String(pm, pkg.PkgPath) == typ {
+			consts = append(consts, c)
+		}
+	}
+	sort.Slice(consts, func(i, j int) bool {
+		return consts[i].Index < consts[j].Index
+	})
+	if len(consts) == 1 {
+		return pkg.deprecation(consts[0].Name, "") + consts[0].Declaration(pm, pkg.PkgPath)
+	}
+
+	ret := "const (\n"
+	for _, c := range consts {
+		ret += pkg.deprecation(c.Name, "\t") + "\t" + c.spec(pm, pkg.PkgPath) + "\n"
+	}
+	ret += ")"
+	return ret
+}
+
+// deprecation returns the deprecation notice of the original symbol `name`
+// as comment lines indented with `indent`, or "" if it is not deprecated.
+func (pkg *Package) deprecation(name string, indent string) string {
+	notice, ok := pkg.Deprecations[name]
+	if !ok {
+		return ""
+	}
+	var ret string
+	for _, line := range strings.Split(notice, "\n") {
+		if line == "" {
+			ret += indent + "//\n"
+		} else {
+			ret += indent + "// " + line + "\n"
+		}
+	}
+	return ret
+}
+
+// enumStringMethod returns a declaration of the String method `meth` of the
+// type `named` that returns the results of the original String method for
+// the stubbed constants of that type. It returns false if there are no such
+// constants, or if -enum_strings is not enabled.
+func (pkg *Package) enumStringMethod(named *NamedType, meth *Method, pm map[string]string) (string, bool) {
+	if !pkg.EnumStrings || meth.Name != "String" || len(meth.Type.In) != 1 ||
+		len(meth.Type.Out) != 1 || meth.Type.Out[0].Type != PredeclaredType("string") {
+		return "", false
+	}
+
+	typ := named.String(pm, pkg.PkgPath)
+	consts := make([]*Constant, 0)
+	for _, export := range pkg.Exports {
+		if c, ok := export.(*Constant); ok && c.HasStr && c.Type != nil && c.Type.String(pm, pkg.PkgPath) == typ {
+			consts = append(consts, c)
+		}
+	}
+	if len(consts) == 0 {
+		return "", false
+	}
+	sort.Slice(consts, func(i, j int) bool {
+		return consts[i].Index < consts[j].Index
+	})
+
+	recv := meth.Type.In[0].Type.String(pm, pkg.PkgPath)
+	subject := "v"
+	if _, ok := meth.Type.In[0].Type.(*PointerType); ok {
+		subject = "*v"
+	}
+
+	ret := fmt.Sprintf("func (v %s) String() string {\n\tswitch %s {\n", recv, subject)
+	seen := make(map[string]bool)
+	for _, c := range consts {
+		// constants may share values, which must not be repeated in a switch
+		if seen[c.Value] {
+			continue
+		}
+		seen[c.Value] = true
+		ret += fmt.Sprintf("\tcase %s:\n\t\treturn %q\n", c.Name, c.Str)
+	}
+	ret += "\t}\n\treturn \"\"\n}"
+	return ret, true
+}
+
 // Function is a function
 type Function struct {
 	Name string
@@ -316,6 +718,11 @@ func (f *Function) addImports(im map[string]bool) {
 type Method struct {
 	Name string
 	Type *FuncType
+
+	// Marker is set for the unexported methods of sealed interfaces, which
+	// are stubbed without parameters and results, as their types may be
+	// unexported.
+	Marker bool
 }
 
 // returns the string representation of this method that would be used to declare
@@ -520,6 +927,10 @@ func (it *InterfaceType) String(pm map[string]string, pkgOverride string) string
 	}
 	ret := "interface{\n"
 	for _, meth := range it.Methods {
+		if meth.Marker {
+			ret += "\t// " + meth.Name + " stands in for an unexported method of the original\n"
+			ret += "\t// interface, which only types of this package implement.\n"
+		}
 		ret += "\t" + meth.InterfaceString(pm, pkgOverride) + "\n"
 	}
 	ret += "}"
@@ -591,6 +1002,100 @@ func (pt *PointerType) String(pm map[string]string, pkgOverride string) string {
 }
 func (pt *PointerType) addImports(im map[string]bool) { pt.Type.addImports(im) }
 
+// InstanceType is an instantiation of a generic type, like `List[int]`.
+// Reflection only gives its name, in which the types of the type arguments
+// are qualified with their import paths; the generic type itself is
+// declared from its source.
+type InstanceType struct {
+	Package string // the package of the generic type
+	Name    string // the name of the generic type
+
+	// Args are the type arguments, as the source between Refs, the named
+	// types they refer to.
+	Args []string
+	Refs []*NamedType
+
+	Kind reflect.Kind
+}
+
+func (it *InstanceType) String(pm map[string]string, pkgOverride string) string {
+	var args strings.Builder
+	for i, arg := range it.Args {
+		args.WriteString(arg)
+		if i < len(it.Refs) {
+			args.WriteString(it.Refs[i].String(pm, pkgOverride))
+		}
+	}
+	if it.Package == pkgOverride {
+		return it.Name + "[" + args.String() + "]"
+	}
+	return pm[it.Package] + "." + it.Name + "[" + args.String() + "]"
+}
+
+func (it *InstanceType) addImports(im map[string]bool) {
+	im[it.Package] = true
+	for _, ref := range it.Refs {
+		ref.addImports(im)
+	}
+}
+
+// qualifiedIdentRegex matches the types qualified with their import paths
+// in the names of instantiations, like `github.com/a/b.Item`.
+var qualifiedIdentRegex = regexp.MustCompile(`([\w~-][\w.~/-]*)\.([\pL_][\pL\pN_]*)`)
+
+// instanceFromType returns the instantiation of a generic type `t`, or the
+// empty interface if it or one of its type arguments is an external type.
+func (pkg *Package) instanceFromType(t reflect.Type) Type {
+	imp := impPath(t.PkgPath())
+	open := strings.Index(t.Name(), "[")
+	args := t.Name()[open+1 : len(t.Name())-1]
+	it := &InstanceType{Package: imp, Name: t.Name()[:open], Kind: t.Kind()}
+	if imp != pkg.PkgPath && !isInStdlib(imp) {
+		return EmptyInterface
+	}
+
+	last := 0
+	for _, m := range qualifiedIdentRegex.FindAllStringSubmatchIndex(args, -1) {
+		path, name := impPath(args[m[2]:m[3]]), args[m[4]:m[5]]
+		if path != pkg.PkgPath && !isInStdlib(path) || !isExported(name) {
+			return EmptyInterface
+		}
+		it.Args = append(it.Args, args[last:m[0]])
+		it.Refs = append(it.Refs, &NamedType{Package: path, Name: name})
+		last = m[1]
+	}
+	it.Args = append(it.Args, args[last:])
+	return it
+}
+
+// MappedType is a type an external type is mapped to by the TypeMap of a
+// package.
+type MappedType struct {
+	Package string // the standard library package of Name, if any
+	Name    string // a type expression if Package is empty
+}
+
+// mappedType returns the MappedType of the entry `expr` of a TypeMap.
+func mappedType(expr string) *MappedType {
+	if i := strings.LastIndex(expr, "."); i != -1 {
+		return &MappedType{Package: expr[:i], Name: expr[i+1:]}
+	}
+	return &MappedType{Name: expr}
+}
+
+func (mt *MappedType) String(pm map[string]string, pkgOverride string) string {
+	if mt.Package == "" || mt.Package == pkgOverride {
+		return mt.Name
+	}
+	return pm[mt.Package] + "." + mt.Name
+}
+
+func (mt *MappedType) addImports(im map[string]bool) {
+	if mt.Package != "" {
+		im[mt.Package] = true
+	}
+}
+
 // PredeclaredType is a predeclared type such as "int".
 type PredeclaredType string
 
@@ -685,6 +1190,23 @@ func (pkg *Package) typeFromType(t reflect.Type) (Type, error) {
 	}
 
 	if imp := t.PkgPath(); imp != "" {
+		if expr, ok := pkg.TypeMap[impPath(imp)+"."+t.Name()]; ok && imp != pkg.PkgPath {
+			return mappedType(expr), nil
+		}
+
+		if strings.Contains(t.Name(), "[") {
+			// Instantiations of generic types are named like `List[int]`.
+			if !pkg.langAtLeast("go1.18") {
+				pkg.Notes = append(pkg.Notes, fmt.Sprintf("generic type %s is stubbed as interface{}, as %s has no generics", t.Name(), pkg.Lang))
+				return EmptyInterface, nil
+			}
+			return pkg.instanceFromType(t), nil
+		}
+
+		if _, ok := pkg.SelectedMethods[t.Name()]; ok && imp == pkg.PkgPath && !isExported(t.Name()) {
+			return pkg.placeholderFromType(t)
+		}
+
 		if !isExported(t.Name()) || (imp != pkg.PkgPath && !isInStdlib(imp)) {
 			return EmptyInterface, nil
 		}
@@ -709,7 +1231,7 @@ func (pkg *Package) typeFromType(t reflect.Type) (Type, error) {
 			for i := 0; i < t.NumMethod(); i++ {
 				mt := t.Method(i)
 
-				if !isExported(mt.Name) {
+				if !isExported(mt.Name) || !pkg.methodSelected(t, mt.Name) {
 					continue
 				}
 
@@ -734,7 +1256,7 @@ func (pkg *Package) typeFromType(t reflect.Type) (Type, error) {
 				mt := pt.Method(i)
 
 				//fmt.Println(mt.Type.In(0))
-				if !isExported(mt.Name) || seen[mt.PkgPath+"."+mt.Name] {
+				if !isExported(mt.Name) || seen[mt.PkgPath+"."+mt.Name] || !pkg.methodSelected(t, mt.Name) {
 					continue
 				}
 
@@ -751,6 +1273,10 @@ func (pkg *Package) typeFromType(t reflect.Type) (Type, error) {
 				res.Methods = append(res.Methods, m)
 
 			}
+
+			if imp == pkg.PkgPath {
+				pkg.addMarkerMethods(res, t)
+			}
 		}
 
 		var err error
@@ -769,6 +1295,154 @@ func (pkg *Package) typeFromType(t reflect.Type) (Type, error) {
 	return pkg.unnamedTypeFromType(t)
 }
 
+// langAtLeast reports whether the stub may use the constructs of the Go
+// language version `version`, like "go1.18".
+func (pkg *Package) langAtLeast(version string) bool {
+	if pkg.Lang == "" {
+		return true
+	}
+	return semver.Compare("v"+strings.TrimPrefix(pkg.Lang, "go"), "v"+strings.TrimPrefix(version, "go")) >= 0
+}
+
+// placeholderFromType returns a local type standing in for the unexported
+// type `t`, with only the selected methods of `t`, so that chained calls on
+// values of that type can be stubbed.
+func (pkg *Package) placeholderFromType(t reflect.Type) (Type, error) {
+	typPath := t.PkgPath() + "." + t.Name()
+	if res, ok := pkg.NamedTypes[typPath]; ok {
+		return res, nil
+	}
+
+	res := &NamedType{
+		Package: impPath(t.PkgPath()),
+		Name:    pkg.SynthesizedName(t.Name()),
+	}
+	pkg.NamedTypes[typPath] = res
+	pkg.Exports[res.Name] = res
+	pkg.Notes = append(pkg.Notes, fmt.Sprintf("unexported type %s is stubbed as placeholder %s", t.Name(), res.Name))
+
+	if t.Kind() == reflect.Interface {
+		underlying, err := pkg.unnamedTypeFromType(t)
+		if err != nil {
+			return nil, err
+		}
+		res.Underlying = underlying
+		return res, nil
+	}
+
+	// The fields of the original type are not exposed.
+	res.Underlying = &StructType{}
+	pkg.addMarkerMethods(res, t)
+
+	for _, typ := range []reflect.Type{t, reflect.PtrTo(t)} {
+		for i := 0; i < typ.NumMethod(); i++ {
+			mt := typ.Method(i)
+			if !pkg.methodSelected(t, mt.Name) || res.hasMethod(mt.Name) {
+				continue
+			}
+
+			ft, err := pkg.typeFromType(mt.Type)
+			if err != nil {
+				return nil, err
+			}
+
+			res.Methods = append(res.Methods, &Method{
+				Name: mt.Name,
+				Type: ft.(*FuncType),
+			})
+		}
+	}
+
+	return res, nil
+}
+
+// synthesizedPrefix starts the names of all declarations that are invented
+// by the generator rather than copied from the original package. It keeps
+// these names unexported, so they can't clash with stubbed symbols.
+const synthesizedPrefix = "stub"
+
+// SynthesizedName returns a name for a declaration invented by the generator
+// for `base`, which doesn't collide with any other declaration of the stub.
+func (pkg *Package) SynthesizedName(base string) string {
+	r, size := utf8.DecodeRuneInString(base)
+	name := synthesizedPrefix + string(unicode.ToUpper(r)) + base[size:]
+
+	candidate := name
+	for i := 1; pkg.declares(candidate); i++ {
+		candidate = name + strconv.Itoa(i)
+	}
+	return candidate
+}
+
+// declares reports whether the stub already contains a declaration named `name`.
+func (pkg *Package) declares(name string) bool {
+	if _, ok := pkg.Exports[name]; ok {
+		return true
+	}
+	for _, typ := range pkg.NamedTypes {
+		if named, ok := typ.(*NamedType); ok && named.Package == pkg.PkgPath && named.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (nt *NamedType) hasMethod(name string) bool {
+	for _, m := range nt.Methods {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addMarkerMethods records `stub`, the stub of the named type `t` of this
+// package, and adds the unexported methods of the sealed interfaces found so
+// far that `t` implements to it.
+func (pkg *Package) addMarkerMethods(stub *NamedType, t reflect.Type) {
+	pkg.stubbedTypes = append(pkg.stubbedTypes, stubbedType{typ: t, stub: stub})
+	for _, iface := range pkg.sealed {
+		pkg.addMarkers(stub, t, iface)
+	}
+}
+
+// addSealedInterface records the interface `t` of this package, with the
+// unexported methods `methods`, and adds them to the named types stubbed so
+// far that implement it.
+func (pkg *Package) addSealedInterface(t reflect.Type, methods []string) {
+	iface := sealedInterface{typ: t, methods: methods}
+	pkg.sealed = append(pkg.sealed, iface)
+	for _, stubbed := range pkg.stubbedTypes {
+		pkg.addMarkers(stubbed.stub, stubbed.typ, iface)
+	}
+}
+
+// addMarkers adds the unexported methods of `iface` to `stub`, the stub of
+// `t`, if `t` or a pointer to it implements `iface`, so that the values of
+// the stub can still be used as values of the interface.
+func (pkg *Package) addMarkers(stub *NamedType, t reflect.Type, iface sealedInterface) {
+	var recv Type
+	switch {
+	case t.Implements(iface.typ):
+		recv = stub
+	case reflect.PtrTo(t).Implements(iface.typ):
+		recv = &PointerType{Type: stub}
+	default:
+		return
+	}
+	for _, name := range iface.methods {
+		if stub.hasMethod(name) {
+			continue
+		}
+		stub.Methods = append(stub.Methods, &Method{
+			Name:   name,
+			Type:   &FuncType{In: []*Parameter{{Type: recv}}},
+			Marker: true,
+		})
+		pkg.Notes = append(pkg.Notes, fmt.Sprintf("added method %s.%s so that the stub still implements the sealed interface %s", stub.Name, name, iface.typ.Name()))
+	}
+}
+
 func (pkg *Package) unnamedTypeFromType(t reflect.Type) (Type, error) {
 	if t == byteType {
 		return PredeclaredType("byte"), nil
@@ -823,11 +1497,18 @@ func (pkg *Package) unnamedTypeFromType(t reflect.Type) (Type, error) {
 		}
 
 		methods := make([]*Method, 0, t.NumMethod())
+		var sealedBy []string
 
 		for i := 0; i < t.NumMethod(); i++ {
 			mt := t.Method(i)
 
-			if !isExported(mt.Name) {
+			if !isExported(mt.Name) && t.PkgPath() == pkg.PkgPath && mt.PkgPath == pkg.PkgPath {
+				methods = append(methods, &Method{Name: mt.Name, Type: &FuncType{}, Marker: true})
+				sealedBy = append(sealedBy, mt.Name)
+				continue
+			}
+
+			if !isExported(mt.Name) || !pkg.methodSelected(t, mt.Name) {
 				continue
 			}
 
@@ -844,6 +1525,9 @@ func (pkg *Package) unnamedTypeFromType(t reflect.Type) (Type, error) {
 			methods = append(methods, m)
 		}
 
+		if len(sealedBy) > 0 {
+			pkg.addSealedInterface(t, sealedBy)
+		}
 		return &InterfaceType{methods}, nil
 	case reflect.Map:
 		kt, err := pkg.typeFromType(t.Key())
@@ -917,7 +1601,12 @@ func impPath(imp string) string {
 
 func zeroOf(t Type, pm map[string]string, pkgOverride string) string {
 	switch t := t.(type) {
-	case *ArrayType, *ChanType, *FuncType, *InterfaceType, *MapType, *PointerType:
+	case *ArrayType:
+		if t.Len > -1 {
+			return t.String(pm, pkgOverride) + "{}"
+		}
+		return "nil"
+	case *ChanType, *FuncType, *InterfaceType, *MapType, *PointerType:
 		return "nil"
 	case *StructType:
 		return t.String(pm, pkgOverride) + "{}"
@@ -930,6 +1619,17 @@ func zeroOf(t Type, pm map[string]string, pkgOverride string) string {
 			}
 		}
 		return zeroOf(t.Underlying, pm, pkgOverride)
+	case *MappedType:
+		// Mapped types may be of any kind.
+		return "*new(" + t.String(pm, pkgOverride) + ")"
+	case *InstanceType:
+		switch t.Kind {
+		case reflect.Struct, reflect.Array:
+			return t.String(pm, pkgOverride) + "{}"
+		case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+			return "nil"
+		}
+		return "*new(" + t.String(pm, pkgOverride) + ")"
 	case PredeclaredType:
 		switch t {
 		case "bool":
@@ -946,6 +1646,26 @@ func zeroOf(t Type, pm map[string]string, pkgOverride string) string {
 	}
 }
 
+// compositeOf returns an empty composite literal of the type `t`, if it is
+// a map, slice, array or struct type, or "" otherwise. Variables holding
+// maps and slices, like tables of defaults, are initialized with them rather
+// than nil, so that code writing to them doesn't panic.
+func compositeOf(t Type, pm map[string]string, pkgOverride string) string {
+	switch u := t.(type) {
+	case *MapType, *ArrayType, *StructType:
+		return t.String(pm, pkgOverride) + "{}"
+	case *NamedType:
+		switch u.Underlying.(type) {
+		case *MapType, *ArrayType, *StructType:
+			if u.Package == "" {
+				return u.Name + "{}"
+			}
+			return u.String(pm, pkgOverride) + "{}"
+		}
+	}
+	return ""
+}
+
 // sanitize cleans up a string to make a suitable package name.
 func sanitize(s string) string {
 	t := ""
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The output of reflection programs starts with a header line of the form
+// "<WireMagic> <version> <encoding>", followed by the PackedPkg encoded
+// with the encoding. Older reflection programs write a bare gob stream.
+const (
+	WireMagic   = "depstubber-packedpkg"
+	WireVersion = 1
+
+	WireGob  = "gob"
+	WireJSON = "json" // for debugging
+)
+
+// WritePackedPkg writes `p` to `w` in the wire format, encoded with
+// `encoding`.
+func WritePackedPkg(w io.Writer, p *PackedPkg, encoding string) error {
+	if encoding != WireGob && encoding != WireJSON {
+		return fmt.Errorf("unknown encoding %q; expected %s or %s", encoding, WireGob, WireJSON)
+	}
+	if _, err := fmt.Fprintf(w, "%s %d %s\n", WireMagic, WireVersion, encoding); err != nil {
+		return err
+	}
+	if encoding == WireJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(p)
+	}
+	return gob.NewEncoder(w).Encode(p)
+}
+
+// ReadPackedPkg reads a PackedPkg written by WritePackedPkg, or by a
+// reflection program built with an older version of this package.
+func ReadPackedPkg(r io.Reader) (*PackedPkg, error) {
+	br := bufio.NewReader(r)
+	var p PackedPkg
+	if prefix, _ := br.Peek(len(WireMagic)); string(prefix) != WireMagic {
+		if err := gob.NewDecoder(br).Decode(&p); err != nil {
+			return nil, fmt.Errorf("the output is neither in the wire format nor a gob stream of a reflection program: %v", err)
+		}
+		return &p, nil
+	}
+
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("truncated wire format header: %v", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid wire format header %q", strings.TrimSpace(header))
+	}
+	version, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid wire format version %q", fields[1])
+	}
+	if version > WireVersion {
+		return nil, fmt.Errorf("the output has wire format version %d, but this version of depstubber only reads up to version %d; build the reflection program with the same version of depstubber", version, WireVersion)
+	}
+
+	switch fields[2] {
+	case WireGob:
+		err = gob.NewDecoder(br).Decode(&p)
+	case WireJSON:
+		err = json.NewDecoder(br).Decode(&p)
+	default:
+		return nil, fmt.Errorf("unknown wire format encoding %q", fields[2])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding the %s payload failed: %v", fields[2], err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+// This file contains the generation of stubs split by operating system, for
+// packages whose API differs from one to another.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/github/depstubber/model"
+	"github.com/github/depstubber/stubgen"
+)
+
+var platforms = flag.String("goos", "", "Comma-separated list of operating systems, like 'linux,windows'; write the declarations they have in common to the stub, and the others to a stub_<GOOS>.go file with a build constraint for each. Requires -destination or -vendor.")
+
+// platformStub is the part of a stub that is specific to an operating
+// system, or common to all of them if `goos` is empty.
+type platformStub struct {
+	goos string
+	pkg  *model.PackedPkg
+}
+
+// reflectPlatforms runs the reflection program for each of the operating
+// systems of -goos, and splits the models it returns into the declarations
+// common to all of them, first, and the declarations specific to each.
+func reflectPlatforms(ctx context.Context, importPath string, types []string, values []string) ([]platformStub, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load current directory: %v", err)
+	}
+	symbolsDir := wd
+	if currentLocalSource != nil {
+		symbolsDir = currentLocalSource.loadDir
+	}
+
+	base := extraEnv
+	defer func() { extraEnv = base }()
+
+	var models []platformStub
+	found := make(map[string]bool)
+	for _, goos := range split(*platforms) {
+		extraEnv = append(append(envOverrides(nil), base...), "GOOS="+goos)
+
+		// A symbol may not exist on every platform.
+		osTypes, osValues := types, values
+		if symbols, err := loadPackageSymbols(ctx, importPath, symbolsDir); err == nil {
+			osTypes, osValues = symbols.available(types), symbols.available(values)
+		}
+		for _, name := range append(append([]string{}, osTypes...), osValues...) {
+			found[name] = true
+		}
+		if ctx.Err() != nil {
+			return nil, errInterrupted
+		}
+
+		pkg, err := reflectMode(ctx, importPath, osTypes, osValues)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", goos, err)
+		}
+		if pkg.Body != "" {
+			return nil, fmt.Errorf("%s: the reflection program doesn't split its output into declarations", goos)
+		}
+		for _, note := range pkg.Notes {
+			log.Printf("%s (%s): %s", importPath, goos, note)
+		}
+		models = append(models, platformStub{goos: goos, pkg: pkg})
+	}
+	if len(models) == 0 {
+		return nil, fmt.Errorf("no operating system given with -goos")
+	}
+	for _, name := range append(append([]string{}, types...), values...) {
+		if !found[name] {
+			return nil, fmt.Errorf("%s does not declare %s on any of %s", importPath, name, *platforms)
+		}
+	}
+	return splitPlatforms(models), nil
+}
+
+// splitPlatforms returns the declarations that are the same in all `models`
+// as a stub without operating system, followed by the stub of each of
+// `models` with the rest of its declarations.
+func splitPlatforms(models []platformStub) []platformStub {
+	count := make(map[string]int)
+	for _, m := range models {
+		seen := make(map[string]bool)
+		for _, decl := range m.pkg.Decls {
+			if !seen[decl] {
+				seen[decl] = true
+				count[decl]++
+			}
+		}
+	}
+
+	first := models[0].pkg
+	common := &model.PackedPkg{Name: first.Name, PkgPath: first.PkgPath, Header: first.Header}
+	for _, decl := range first.Decls {
+		if count[decl] == len(models) {
+			common.Decls = append(common.Decls, decl)
+		}
+	}
+	result := []platformStub{{pkg: common}}
+	for _, m := range models {
+		specific := &model.PackedPkg{Name: m.pkg.Name, PkgPath: m.pkg.PkgPath, Header: m.pkg.Header}
+		for _, decl := range m.pkg.Decls {
+			if count[decl] != len(models) {
+				specific.Decls = append(specific.Decls, decl)
+			}
+		}
+		result = append(result, platformStub{goos: m.goos, pkg: specific})
+	}
+	return result
+}
+
+// platformDestination returns the file of the part of the stub in `dst`
+// that is specific to `goos`, like stub_linux.go for stub.go.
+func platformDestination(dst string, goos string) string {
+	if goos == "" {
+		return dst
+	}
+	return strings.TrimSuffix(dst, filepath.Ext(dst)) + "_" + goos + ".go"
+}
+
+// writePlatformStubs writes the parts of the stub of `packageName` generated
+// by `g` to the stub file `stubFile` and the files next to it, and returns
+// the files specific to an operating system.
+func writePlatformStubs(g *stubgen.Generator, stubs []platformStub, packageName string, stubFile string) ([]string, error) {
+	var files []string
+	for _, stub := range stubs {
+		dst := platformDestination(stubFile, stub.goos)
+		g.BuildConstraint = stub.goos
+		var src []byte
+		err := timeGeneration(g, func() (err error) {
+			src, err = g.Source(stub.pkg)
+			return err
+		})
+		if err != nil {
+			if outErr, ok := err.(*stubgen.OutputError); ok {
+				outErr.InvalidFile = writeInvalidSource(dst, outErr.Source)
+			}
+			return nil, fmt.Errorf("Failed generating stub for %s: %v", packageName, err)
+		}
+		if err := writeFile(dst, src, stubStdout, fileAction{Package: packageName}); err != nil {
+			return nil, fmt.Errorf("Failed writing to destination: %v", err)
+		}
+		if stub.goos != "" {
+			files = append(files, dst)
+		}
+	}
+	g.BuildConstraint = ""
+	return files, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+// This file contains the profiling of depstubber, and the measurement of the
+// time spent in each phase of a run.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/github/depstubber/stubgen"
+)
+
+var (
+	cpuProfile  = flag.String("profile", "", "Write a CPU profile to this file when depstubber finishes.")
+	traceOutput = flag.String("trace", "", "Write an execution trace to this file when depstubber finishes.")
+	showTimings = flag.Bool("timings", false, "Print the time spent in each phase, like the reflection build or the license detection, with the summary.")
+)
+
+// The phases of a run, in the order of the timing breakdown.
+const (
+	phaseDetection       = "detection"
+	phaseReflectionBuild = "reflection build"
+	phaseReflectionRun   = "reflection run"
+	phaseGeneration      = "generation"
+	phaseFormatting      = "formatting"
+	phaseLicenses        = "license detection"
+	phaseIO              = "IO"
+)
+
+var phases = []string{
+	phaseDetection,
+	phaseReflectionBuild,
+	phaseReflectionRun,
+	phaseGeneration,
+	phaseFormatting,
+	phaseLicenses,
+	phaseIO,
+}
+
+// phaseTimes holds the time spent in each phase so far.
+var phaseTimes = make(map[string]time.Duration)
+
+// runStart is the time depstubber started.
+var runStart = time.Now()
+
+// timePhase adds the time since `start` to `phase`, as in
+// `defer timePhase(phaseIO, time.Now())`.
+func timePhase(phase string, start time.Time) {
+	phaseTimes[phase] += time.Since(start)
+	phaseSpan(phase, start)
+}
+
+// timeGeneration runs `generate`, which generates stubs with `g`, and adds
+// the time it takes to the generation and formatting phases.
+func timeGeneration(g *stubgen.Generator, generate func() error) error {
+	var format time.Duration
+	g.FormatTime = &format
+	defer func() { g.FormatTime = nil }()
+
+	start := time.Now()
+	err := generate()
+	phaseTimes[phaseGeneration] += time.Since(start) - format
+	phaseTimes[phaseFormatting] += format
+	// The formatting is spread over the generation; its span covers the
+	// end of it.
+	phaseSpan(phaseGeneration, start)
+	phaseSpan(phaseFormatting, time.Now().Add(-format))
+	return err
+}
+
+// startProfiling starts the CPU profile and the execution trace requested
+// with -profile and -trace, and returns the function that stops them.
+func startProfiling() (func(), error) {
+	var stops []func()
+	stop := func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create the CPU profile: %v", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to start the CPU profile: %v", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			f.Close()
+		})
+	}
+	if *traceOutput != "" {
+		f, err := os.Create(*traceOutput)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("Unable to create the trace: %v", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			stop()
+			return nil, fmt.Errorf("Unable to start the trace: %v", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			f.Close()
+		})
+	}
+	return stop, nil
+}
+
+// printTimings writes the time spent in each phase to `w`, if requested
+// with -timings.
+func printTimings(w io.Writer) {
+	if !*showTimings {
+		return
+	}
+	parts := make([]string, 0, len(phases)+1)
+	for _, phase := range phases {
+		parts = append(parts, fmt.Sprintf("%s %s", phase, phaseTimes[phase].Round(time.Millisecond)))
+	}
+	parts = append(parts, fmt.Sprintf("total %s", time.Since(runStart).Round(time.Millisecond)))
+	fmt.Fprintf(w, "depstubber: time spent: %s\n", strings.Join(parts, ", "))
+}
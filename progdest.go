@@ -0,0 +1,79 @@
+package main
+
+// This file contains -prog_dest, which writes the reflection program with
+// the files needed to build it elsewhere.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var progDest = flag.String("prog_dest", "", "With -prog_only, write the reflection program to this directory instead of stdout, with the go.mod and go.sum files to build it with and a note on building it and passing it back with -exec_only.")
+
+// progNoteName is the name of the note on building the reflection program
+// written by -prog_dest.
+const progNoteName = "BUILDING.md"
+
+// writeProgramDir writes the reflection program `program` of the symbols
+// `typeNames` and `funcAndVarNames` of `pkgPath` to the directory `dir`,
+// with the module files it is built with and a note on building it.
+func writeProgramDir(dir string, pkgPath string, typeNames []string, funcAndVarNames []string, program []byte) error {
+	if currentLocalSource != nil {
+		// The go.mod file would refer to temporary copies of the source.
+		return fmt.Errorf("-prog_dest can't be combined with -from-dir")
+	}
+	if err := CreateFolderIfNotExists(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := writeBuildModule(dir); err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if modRoot := findModuleRoot(wd); modRoot != "" {
+		if err := copyGoSum(modRoot, dir); err != nil {
+			return err
+		}
+	}
+	if err := writeFile(filepath.Join(dir, "prog.go"), program, nil, fileAction{Package: pkgPath}); err != nil {
+		return err
+	}
+
+	binary := "prog.bin"
+	if goos, _ := targetPlatform(); goos == "windows" {
+		binary += ".exe"
+	}
+	flags, err := goBuildFlags()
+	if err != nil {
+		return err
+	}
+	buildArgs := []string{"go", "build", buildModFlag()}
+	for _, f := range flags {
+		buildArgs = append(buildArgs, shellQuote(f))
+	}
+	buildArgs = append(buildArgs, "-o", binary, "prog.go")
+	absBinary, err := filepath.Abs(filepath.Join(dir, binary))
+	if err != nil {
+		return err
+	}
+	goos, goarch := targetPlatform()
+
+	var note bytes.Buffer
+	fmt.Fprintf(&note, "# Reflection program for %s\n\n", pkgPath)
+	fmt.Fprintf(&note, "Written by `depstubber -prog_only -prog_dest`. Build it in this directory,\n")
+	fmt.Fprintf(&note, "for %s/%s, with the `go.mod` and `go.sum` files next to it:\n\n", goos, goarch)
+	fmt.Fprintf(&note, "    %s\n\n", strings.Join(buildArgs, " "))
+	fmt.Fprintf(&note, "Then copy `%s` back to where depstubber runs, and generate the stub from it\n", binary)
+	fmt.Fprintf(&note, "in the module the program was written for:\n\n")
+	fmt.Fprintf(&note, "    depstubber -exec_only %s%s\n\n", shellQuote(absBinary), strings.TrimPrefix(regenerationCommand(pkgPath, typeNames, funcAndVarNames), "depstubber"))
+	fmt.Fprintf(&note, "The program must be run for the same symbols and with a depstubber that reads\n")
+	fmt.Fprintf(&note, "its output; a program built with an incompatible version is rejected. Run it\n")
+	fmt.Fprintf(&note, "with `-format json` to inspect its output.\n")
+	return writeFile(filepath.Join(dir, progNoteName), note.Bytes(), nil, fileAction{Package: pkgPath})
+}
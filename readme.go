@@ -0,0 +1,91 @@
+package main
+
+// This file contains the emission of the files describing the origin of each
+// stub to the people who come across it.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var writeReadme = flag.Bool("write_readme", false, "Also write a "+stubReadmeName+" file next to the stub, stating the module, version and symbols it was generated from, and the command that regenerates it.")
+
+// stubReadmeName is the name of the file describing a stub.
+const stubReadmeName = "DEPSTUBBER.md"
+
+// writeStubReadme writes the file describing the stub of `pkgPath` in the
+// file `stubFile`, which declares `typeNames` and `funcAndVarNames` of the
+// module version `sum`, if known.
+func writeStubReadme(pkgPath string, stubFile string, typeNames []string, funcAndVarNames []string, sum *moduleSum, licenseExpression string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<!-- Code generated by depstubber. DO NOT EDIT. -->\n\n")
+	fmt.Fprintf(&buf, "# Stub of %s\n\n", pkgPath)
+	fmt.Fprintf(&buf, "The Go files of this directory are a stub of `%s`, generated by\n", pkgPath)
+	fmt.Fprintf(&buf, "[depstubber](https://github.com/github/depstubber) for use in testing. They\n")
+	fmt.Fprintf(&buf, "only declare the symbols listed below, and their functions do nothing.\n\n")
+	if sum != nil {
+		if sum.Replace != "" {
+			fmt.Fprintf(&buf, "- Module: `%s` `%s`, replaced by `%s`\n", sum.Path, sum.Version, sum.Replace)
+		} else if registry := sum.registryURL(); registry != "" {
+			fmt.Fprintf(&buf, "- Module: [`%s` `%s`](%s)\n", sum.Path, sum.Version, registry)
+		} else {
+			fmt.Fprintf(&buf, "- Module: `%s` `%s`\n", sum.Path, sum.Version)
+		}
+		if purl := sum.purl(); purl != "" {
+			fmt.Fprintf(&buf, "- Package URL: `%s`\n", purl)
+		}
+	}
+	if licenseExpression != "" {
+		fmt.Fprintf(&buf, "- License (SPDX): %s\n", licenseExpression)
+	}
+	fmt.Fprintf(&buf, "- Types: %s\n", symbolList(typeNames))
+	fmt.Fprintf(&buf, "- Functions, variables and constants: %s\n\n", symbolList(funcAndVarNames))
+	fmt.Fprintf(&buf, "To regenerate the stub, run this in the module containing the vendor\n")
+	fmt.Fprintf(&buf, "directory:\n\n")
+	fmt.Fprintf(&buf, "```sh\n%s\n```\n", regenerationCommand(pkgPath, typeNames, funcAndVarNames))
+	return writeFile(filepath.Join(filepath.Dir(stubFile), stubReadmeName), buf.Bytes(), nil, fileAction{Package: pkgPath})
+}
+
+// symbolList returns `names` as a Markdown list of code spans.
+func symbolList(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return "`" + strings.Join(names, "`, `") + "`"
+}
+
+// regenerationCommand returns the depstubber command that stubs `typeNames`
+// and `funcAndVarNames` of `pkgPath` again, with the flags that affect the
+// stub.
+func regenerationCommand(pkgPath string, typeNames []string, funcAndVarNames []string) string {
+	args := []string{"depstubber"}
+	if *vendor {
+		args = append(args, "-vendor")
+	} else if *destination != "" {
+		args = append(args, "-destination", shellQuote(*destination))
+	}
+	for _, name := range lockedFlags {
+		if value := lockedFlagValue(name); value != flag.Lookup(name).DefValue {
+			args = append(args, shellQuote("-"+name+"="+value))
+		}
+	}
+	args = append(args, shellQuote(pkgPath), shellQuote(strings.Join(typeNames, ",")))
+	if len(funcAndVarNames) > 0 {
+		args = append(args, shellQuote(strings.Join(funcAndVarNames, ",")))
+	}
+	return strings.Join(args, " ")
+}
+
+var shellSafeRegex = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+// shellQuote returns `s` quoted for POSIX shells, if it needs to be.
+func shellQuote(s string) string {
+	if shellSafeRegex.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -4,10 +4,11 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"context"
 	"flag"
 	"fmt"
 	"go/build"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -17,24 +18,70 @@ import (
 	"runtime"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/github/depstubber/model"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
 var (
 	progOnly    = flag.Bool("prog_only", false, "Only generate the reflection program; write it to stdout and exit.")
 	execOnly    = flag.String("exec_only", "", "If set, execute this reflection program.")
-	buildFlags  = flag.String("build_flags", "", "Additional flags for go build.")
+	buildFlags  = flag.String("build_flags", "", "Additional flags for go build, split like a POSIX shell does, so that values with spaces can be quoted, as in '-ldflags \"-X a=b c\"'.")
 	useExtTypes = flag.Bool("use_ext_types", false, "Don't use 'interface{}' for types not in this package or the standard library.")
+	enumStrings = flag.Bool("enum_strings", false, "Give String methods of stubbed enum types the results of the original String methods for the stubbed constants.")
+	fakes       = flag.Bool("fakes", false, "Also generate a no-op implementation of each stubbed interface, like FakeClient for Client, whose methods return zero values, for tests to use.")
+	lang        = flag.String("lang", "", "Go language version the stubs must compile with, like 'go1.16'; constructs of later versions, like generic types, are replaced.")
+	emptyIface  = flag.String("empty_interface", "auto", "How stubs spell the empty interface: 'any', 'interface{}', or 'auto' for 'any' if they may use Go 1.18 constructs, as given by -lang or else the go directive of the module.")
+	typeMap     = flag.String("type_map", "", "Comma-separated list of external types to stub as other types, like 'github.com/google/uuid.UUID=[16]byte'. They may be mapped to types of the standard library, like 'time.Time', or to type expressions without package qualifiers, like the name of a type declared next to the stub.")
+	modReadonly = flag.Bool("mod_readonly", false, "Build the reflection program with -mod=readonly, so that the build fails instead of resolving modules go.mod and go.sum don't record; the stubbed package and github.com/github/depstubber must already be required.")
 )
 
-func writeProgram(importPath string, types []string, values []string) ([]byte, error) {
+// buildModFlag returns the -mod flag the reflection programs are built with.
+func buildModFlag() string {
+	if *modReadonly {
+		return "-mod=readonly"
+	}
+	return "-mod=mod"
+}
+
+func writeProgram(importPath string, types []string, values []string, consts []constantValue, sigs []signatureValue, sigImports []signatureImport, deprecations map[string]string) ([]byte, error) {
+	// Never splice anything but exported identifiers into the program; the
+	// types of signatures come from the type checker.
+	constNames := make([]string, 0, len(consts)+len(sigs))
+	for _, c := range consts {
+		constNames = append(constNames, c.Name)
+	}
+	for _, sig := range sigs {
+		constNames = append(constNames, sig.Name)
+	}
+	if err := validateSymbolNames(types, append(constNames, values...), false); err != nil {
+		return nil, err
+	}
+	if *lang != "" && !langRegex.MatchString(*lang) {
+		return nil, fmt.Errorf("invalid -lang %q; expected a Go version like go1.16", *lang)
+	}
+	mappedTypes, err := parseTypeMap(*typeMap)
+	if err != nil {
+		return nil, err
+	}
+
 	var program bytes.Buffer
 	data := reflectData{
 		ImportPath:  importPath,
 		UseExtTypes: *useExtTypes,
-		Types:       types,
+		Types:       selectTypes(types),
 		Values:      values,
+		Consts:      consts,
+		Signatures:  sigs,
+		Imports:     sigImports,
+		EnumStrings: *enumStrings,
+		Fakes:       *fakes,
+		Lang:        *lang,
+
+		Deprecations: deprecations,
+		TypeMap:      mappedTypes,
 	}
 	if err := reflectProgram.Execute(&program, &data); err != nil {
 		return nil, err
@@ -43,7 +90,7 @@ func writeProgram(importPath string, types []string, values []string) ([]byte, e
 }
 
 // run the given program and parse the output as a model.Package.
-func run(program string) (*model.PackedPkg, error) {
+func run(ctx context.Context, program string) (*model.PackedPkg, error) {
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		return nil, err
@@ -56,12 +103,21 @@ func run(program string) (*model.PackedPkg, error) {
 	}
 
 	// Run the program.
-	cmd := exec.Command(program, "-output", filename)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	cmd, err := programCommand(ctx, program, "-output", filename)
+	if err != nil {
 		return nil, err
 	}
+	cmd.Env = childEnv()
+	// The output of the program goes to the file; anything it prints would
+	// mix with the stubs or the JSON of batch on stdout.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err = cmd.Run()
+	timePhase(phaseReflectionRun, start)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
 
 	f, err = os.Open(filename)
 	if err != nil {
@@ -69,21 +125,39 @@ func run(program string) (*model.PackedPkg, error) {
 	}
 
 	// Process output.
-	var pkg model.PackedPkg
-	if err := gob.NewDecoder(f).Decode(&pkg); err != nil {
-		return nil, err
+	pkg, err := model.ReadPackedPkg(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading the output of %s failed: %v", program, err)
 	}
 
 	if err := f.Close(); err != nil {
 		return nil, err
 	}
 
-	return &pkg, nil
+	return pkg, nil
+}
+
+// programCommand returns the command running the reflection program
+// `program` with `args`. A program built for another platform is run like
+// `go run` does, with the go_$GOOS_$GOARCH_exec program found in the PATH.
+func programCommand(ctx context.Context, program string, args ...string) (*exec.Cmd, error) {
+	goos, goarch := targetPlatform()
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return exec.CommandContext(ctx, program, args...), nil
+	}
+	execName := fmt.Sprintf("go_%s_%s_exec", goos, goarch)
+	wrapper, err := exec.LookPath(execName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run the reflection program for %s/%s: %s is not in the PATH", goos, goarch, execName)
+	}
+	return exec.CommandContext(ctx, wrapper, append([]string{program}, args...)...), nil
 }
 
 // runInDir writes the given program into the given dir, runs it there, and
-// parses the output as a model.Package.
-func runInDir(program []byte, dir string) (*model.PackedPkg, error) {
+// parses the output as a model.Package. It also records the version of the
+// module of `importPath` the program was built with.
+func runInDir(ctx context.Context, importPath string, program []byte, dir string) (*model.PackedPkg, error) {
 	// We use TempDir instead of TempFile so we can control the filename.
 	tmpDir, err := ioutil.TempDir(dir, "depstubber_reflect_")
 	if err != nil {
@@ -96,7 +170,7 @@ func runInDir(program []byte, dir string) (*model.PackedPkg, error) {
 	}()
 	const progSource = "prog.go"
 	var progBinary = "prog.bin"
-	if runtime.GOOS == "windows" {
+	if goos, _ := targetPlatform(); goos == "windows" {
 		// Windows won't execute a program unless it has a ".exe" suffix.
 		progBinary += ".exe"
 	}
@@ -105,111 +179,371 @@ func runInDir(program []byte, dir string) (*model.PackedPkg, error) {
 		return nil, err
 	}
 
-	{
-		// Copy go.mod into the build directory:
-		wd, err := os.Getwd()
-		if err != nil {
-			log.Fatalf("Unable to load current directory: %v", err)
-		}
-
-		modRoot := findModuleRoot(wd)
+	if err := writeBuildModule(tmpDir); err != nil {
+		log.Fatal(err)
+	}
 
-		if modRoot != "" {
-			MustCopyFile(filepath.Join(modRoot, "go.mod"), filepath.Join(tmpDir, "go.mod"))
+	cacheKey := buildCacheKey(tmpDir)
+	delete(buildModules, importPath)
+	if cached, ok := readCachedBuild(cacheKey); ok {
+		if cached.Module != nil {
+			buildModules[importPath] = cached.Module
 		}
+		return cached.Pkg, nil
 	}
 
-	cmdArgs := []string{"build", "-mod=mod"}
-	if *buildFlags != "" {
-		cmdArgs = append(cmdArgs, strings.Split(*buildFlags, " ")...)
+	flags, err := goBuildFlags()
+	if err != nil {
+		return nil, err
 	}
+	cmdArgs := append([]string{"build", buildModFlag()}, flags...)
 	cmdArgs = append(cmdArgs, "-o", progBinary, progSource)
 
 	// Build the program.
-	cmd := exec.Command("go", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "go", cmdArgs...)
 	cmd.Dir = tmpDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return nil, err
+	cmd.Env = childEnv()
+	cmd.Stdout = os.Stderr
+	// The output tells whether the module of the package can't be resolved.
+	var buildOutput bytes.Buffer
+	cmd.Stderr = io.MultiWriter(os.Stderr, &buildOutput)
+	start := time.Now()
+	err = cmd.Run()
+	if err == nil && currentLocalSource == nil {
+		// go.mod only records the minimum version of the module; the build
+		// may have selected a later one.
+		if resolved := lookupBuildModule(ctx, tmpDir, importPath); resolved != nil {
+			buildModules[importPath] = resolved
+		}
+	}
+	timePhase(phaseReflectionBuild, start)
+	if err != nil && *modReadonly && ctx.Err() == nil {
+		return nil, fmt.Errorf("%v; with -mod_readonly, go.mod and go.sum must already record the module of %s and github.com/github/depstubber", err, importPath)
+	} else if err != nil {
+		if unresolved := unresolvableBuild(importPath, buildOutput.String()); unresolved != nil && ctx.Err() == nil {
+			return nil, unresolved
+		}
+		return nil, ctxErr(ctx, err)
+	}
+
+	pkg, err := run(ctx, filepath.Join(tmpDir, progBinary))
+	if err == nil {
+		writeCachedBuild(cacheKey, pkg, buildModules[importPath])
+	}
+	return pkg, err
+}
+
+// writeBuildModule writes the go.mod file the reflection program is built
+// with into `dir`: a copy of that of the current module, with go.sum under
+// -mod_readonly, or one requiring the local source of -from-dir.
+func writeBuildModule(dir string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("Unable to load current directory: %v", err)
+	}
+
+	modRoot := findModuleRoot(wd)
+
+	if currentLocalSource != nil {
+		if err := currentLocalSource.writeGoMod(modRoot, dir); err != nil {
+			return fmt.Errorf("error writing go.mod requiring %s to %q: %s", currentLocalSource.dir, dir, err)
+		}
+	} else if modRoot != "" {
+		if err := copyGoMod(modRoot, dir); err != nil {
+			return fmt.Errorf("error copying %q to %q: %s", filepath.Join(modRoot, "go.mod"), dir, err)
+		}
+		if *modReadonly {
+			if err := copyGoSum(modRoot, dir); err != nil {
+				return fmt.Errorf("error copying %q to %q: %s", filepath.Join(modRoot, "go.sum"), dir, err)
+			}
+		}
+	}
+	return nil
+}
+
+// exportedIdRegex matches an exported identifier, optionally followed by
+// the selection of an exported method (`Type.Method`).
+var exportedIdRegex = regexp.MustCompile(`^\p{Lu}[\pL\pN_]*(\.\p{Lu}[\pL\pN_]*)?$`)
+
+// placeholderSelectionRegex matches the selection of an exported method of
+// an unexported type (`type.Method`), for which a placeholder is generated.
+var placeholderSelectionRegex = regexp.MustCompile(`^[\p{Ll}_][\pL\pN_]*\.\p{Lu}[\pL\pN_]*$`)
+
+// langRegex matches a Go language version, as in the go directive of go.mod
+// files, like `go1.16`.
+var langRegex = regexp.MustCompile(`^go1\.\d+(\.\d+)?$`)
+
+// useAny reports whether stubs spell the empty interface `any`, as set with
+// -empty_interface.
+func useAny() (bool, error) {
+	switch *emptyIface {
+	case "any":
+		return true, nil
+	case "interface{}":
+		return false, nil
+	case "auto":
+	default:
+		return false, fmt.Errorf("invalid -empty_interface %q; expected auto, any or interface{}", *emptyIface)
 	}
 
-	return run(filepath.Join(tmpDir, progBinary))
+	version := strings.TrimPrefix(*lang, "go")
+	if version == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return false, err
+		}
+		modRoot := findModuleRoot(wd)
+		if modRoot == "" {
+			return false, nil
+		}
+		if modFile := loadModFile(filepath.Join(modRoot, "go.mod")); modFile.Go != nil {
+			version = modFile.Go.Version
+		}
+	}
+	return version != "" && semver.Compare("v"+version, "v1.18") >= 0, nil
 }
 
-var exportedIdRegex = regexp.MustCompile(`(\p{Lu}(\pL|\pN)*)(\.\p{Lu}(\pL|\pN))*`)
+// typeMapKeyRegex matches an exported type of a package, like
+// `github.com/google/uuid.UUID`.
+var typeMapKeyRegex = regexp.MustCompile(`^[^\s=,]+\.\p{Lu}[\pL\pN_]*$`)
+
+// typeMapValueRegex matches the types external types may be mapped to: an
+// exported type of a standard library package, whose import paths have no
+// dots, or a type expression without package qualifiers, like `[16]byte`.
+var typeMapValueRegex = regexp.MustCompile(`^([a-z0-9/]+\.\p{Lu}[\pL\pN_]*|[\pL\pN_\[\]*{}]+)$`)
+
+// parseTypeMap parses the value of -type_map, a comma-separated list of
+// `type=mapped` entries.
+func parseTypeMap(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	mapped := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		i := strings.Index(entry, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid -type_map entry %q; expected an entry like github.com/google/uuid.UUID=[16]byte", entry)
+		}
+		typ, to := strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		if !typeMapKeyRegex.MatchString(typ) {
+			return nil, fmt.Errorf("invalid -type_map entry %q: %q is not an exported type of a package", entry, typ)
+		}
+		if !typeMapValueRegex.MatchString(to) {
+			return nil, fmt.Errorf("invalid -type_map entry %q: %q is neither a type of the standard library nor a type expression without package qualifiers", entry, to)
+		}
+		mapped[typ] = to
+	}
+	return mapped, nil
+}
 
+// exportedId reports whether `id` is an exported identifier.
 func exportedId(id string) bool {
-	return exportedIdRegex.MatchString(id)
+	return exportedIdRegex.MatchString(id) && !strings.Contains(id, ".")
 }
 
-// reflectMode generates mocks via reflection on an interface.
-func reflectMode(importPath string, types []string, values []string) (*model.PackedPkg, error) {
+// exportedSelection reports whether `id` is an exported identifier or
+// the selection of an exported method of a type (`Type.Method`), which
+// may be unexported.
+func exportedSelection(id string) bool {
+	return exportedIdRegex.MatchString(id) || placeholderSelectionRegex.MatchString(id)
+}
+
+// validateSymbolNames checks that the requested names can be spliced safely
+// into the reflection program. If `allowPatterns` is set, symbol patterns
+// are accepted as well.
+func validateSymbolNames(types []string, values []string, allowPatterns bool) error {
+	var errs []error
 	for _, t := range types {
-		if !exportedId(t) {
-			return nil, fmt.Errorf("%s is not a valid exported name.", t)
+		if !exportedSelection(t) && !(allowPatterns && isSymbolPattern(t)) {
+			errs = append(errs, fmt.Errorf("%q is not a valid exported type name or Type.Method selection", t))
 		}
 	}
-
 	for _, v := range values {
-		if !exportedId(v) {
-			return nil, fmt.Errorf("%s is not a valid exported name.", v)
+		if !exportedId(v) && !(allowPatterns && isSymbolPattern(v)) {
+			errs = append(errs, fmt.Errorf("%q is not a valid exported function, variable or constant name", v))
 		}
 	}
+	return CombineErrors(errs...)
+}
 
+// reflectMode generates mocks via reflection on an interface.
+func reflectMode(ctx context.Context, importPath string, types []string, values []string) (*model.PackedPkg, error) {
 	if *execOnly != "" {
-		return run(*execOnly)
+		return run(ctx, *execOnly)
+	}
+	if *progDest != "" && !*progOnly {
+		return nil, fmt.Errorf("-prog_dest requires -prog_only")
+	}
+
+	if err := module.CheckImportPath(importPath); err != nil {
+		return nil, err
+	}
+	if err := validateSymbolNames(types, values, true); err != nil {
+		return nil, err
+	}
+	requestedTypes, requestedValues := types, values
+
+	wd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("Unable to load current directory: %v", err)
+	}
+	if currentLocalSource == nil {
+		// The reflection program is built with a copy of go.mod, whose
+		// exclude directives the go command honors; report a requested
+		// version that they exclude rather than stub another one.
+		if err := checkNotExcluded(findModuleRoot(wd), importPath); err != nil {
+			return nil, err
+		}
+	}
+
+	symbolsDir := wd
+	if currentLocalSource != nil {
+		symbolsDir = currentLocalSource.loadDir
+	}
+	symbols, symbolsErr := loadPackageSymbols(ctx, importPath, symbolsDir)
+	if ctx.Err() != nil {
+		return nil, errInterrupted
+	}
+
+	if hasSymbolPatterns(types) || hasSymbolPatterns(values) || *matchSymbols != "" {
+		if symbolsErr != nil {
+			return nil, fmt.Errorf("unable to expand symbol patterns for %s: %s", importPath, symbolsErr)
+		}
+		types, values, err = symbols.expand(types, values, *matchSymbols)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check the requested symbols before building the reflection program, so
+	// that typos result in a helpful error instead of a compilation failure.
+	// If the package can't be loaded, leave it to the reflection program to
+	// report the problem.
+	var consts []constantValue
+	var sigs []signatureValue
+	var sigImports []signatureImport
+	var deprecations map[string]string
+	var generics *genericDecls
+	if symbolsErr == nil {
+		if err := symbols.validate(types, values); err != nil {
+			return nil, err
+		}
+		// Generic types and functions are declared from the type-checked
+		// package, as the reflection program only sees instantiations.
+		generics, types, values, err = symbols.generics(types, values)
+		if err != nil {
+			return nil, err
+		}
+		// Constants are stubbed with their exact values, which is not
+		// possible through reflection alone.
+		consts, values = symbols.constants(values)
+		// Functions implemented in assembly or with go:linkname are
+		// stubbed from their signatures, as referring to them can fail
+		// to link.
+		sigs, sigImports, values = symbols.signatures(values)
+		// Doc comments are lost to reflection, but linters should still
+		// see that deprecated APIs are used.
+		deprecations = symbols.deprecated
 	}
 
-	program, err := writeProgram(importPath, types, values)
+	program, err := writeProgram(importPath, types, values, consts, sigs, sigImports, deprecations)
 	if err != nil {
 		return nil, err
 	}
 
-	if *progOnly {
+	if *progOnly && *progDest != "" {
+		if err := writeProgramDir(*progDest, importPath, requestedTypes, requestedValues, program); err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	} else if *progOnly {
 		if _, err := os.Stdout.Write(program); err != nil {
 			return nil, err
 		}
 		os.Exit(0)
 	}
 
-	wd, err := os.Getwd()
+	pkg, err := runProgram(ctx, importPath, program, wd)
 	if err != nil {
-		log.Fatalf("Unable to load current directory: %v", err)
+		return nil, err
+	}
+	if err := generics.addTo(pkg); err != nil {
+		return nil, err
 	}
+	return pkg, nil
+}
 
+// runProgram runs the reflection program `program` for the package
+// `importPath`, trying the directory `wd`, the directory of the package, and
+// a temporary directory in turn.
+func runProgram(ctx context.Context, importPath string, program []byte, wd string) (*model.PackedPkg, error) {
 	// Try to run the reflection program  in the current working directory.
-	if p, err := runInDir(program, wd); err == nil {
-		return p, nil
+	if p, err := runInDir(ctx, importPath, program, wd); err == nil || err == errInterrupted {
+		return p, err
 	}
 
 	// Try to run the program in the same directory as the input package.
 	if p, err := build.Import(importPath, wd, build.FindOnly); err == nil {
 		dir := p.Dir
-		if p, err := runInDir(program, dir); err == nil {
-			return p, nil
+		if p, err := runInDir(ctx, importPath, program, dir); err == nil || err == errInterrupted {
+			return p, err
 		}
 	}
 
 	// Try to run it in a standard temp directory.
-	return runInDir(program, "")
+	return runInDir(ctx, importPath, program, "")
 }
 
 type reflectData struct {
 	ImportPath  string
 	UseExtTypes bool
-	Types       []string
+	Types       []selectedType
 	Values      []string
+	Consts      []constantValue
+	Signatures  []signatureValue
+	Imports     []signatureImport
+	EnumStrings bool
+	Fakes       bool
+	Lang        string
+
+	// Deprecations holds the deprecation notices of the symbols of the
+	// package, which reflection doesn't see.
+	Deprecations map[string]string
+
+	// TypeMap maps external types to the types stubbed in their place.
+	TypeMap map[string]string
+}
+
+// UsesPackage reports whether the program refers to the stubbed package by
+// name; untyped constants and placeholders don't need it.
+func (d *reflectData) UsesPackage() bool {
+	if len(d.Values) > 0 {
+		return true
+	}
+	for _, t := range d.Types {
+		if !t.Placeholder {
+			return true
+		}
+	}
+	for _, c := range d.Consts {
+		if c.Typed {
+			return true
+		}
+	}
+	for _, sig := range d.Signatures {
+		if sig.UsesPackage {
+			return true
+		}
+	}
+	return false
 }
 
-// This program reflects on an interface value, and prints the
-// gob encoding of a model.Package to standard output.
-// JSON doesn't work because of the model.Type interface.
+// This program reflects on an interface value, and prints the packed
+// model.Package to standard output, in the wire format of the model package.
 var reflectProgram = template.Must(template.New("program").Parse(`
 package main
 
 import (
-	"encoding/gob"
 	"flag"
 	"fmt"
 	"os"
@@ -217,10 +551,14 @@ import (
 
 	"github.com/github/depstubber/model"
 
-	pkg_ {{printf "%q" .ImportPath}}
+	{{if .UsesPackage}}pkg_{{else}}_{{end}} {{printf "%q" .ImportPath}}
+	{{range .Imports}}
+	{{.Name}} {{printf "%q" .Path}}
+	{{end}}
 )
 
 var output = flag.String("output", "", "The output file name, or empty to use stdout.")
+var format = flag.String("format", model.WireGob, "The encoding of the output: gob, or json for debugging.")
 
 func main() {
 	flag.Parse()
@@ -228,10 +566,19 @@ func main() {
 	types := []struct{
 		sym string
 		typ reflect.Type
+		methods []string
 	}{
-		{{range .Types}}
-		{ {{printf "%q" .}}, reflect.TypeOf((*pkg_.{{.}})(nil)).Elem() },
-		{{end}}
+		{{range .Types}}{{if not .Placeholder}}
+		{ {{printf "%q" .Name}}, reflect.TypeOf((*pkg_.{{.Name}})(nil)).Elem(), {{printf "%#v" .Methods}} },
+		{{end}}{{end}}
+	}
+
+	// Unexported types can't be named here, but get placeholders with
+	// the selected methods when they are encountered.
+	placeholders := map[string][]string{
+		{{range .Types}}{{if .Placeholder}}
+		{{printf "%q" .Name}}: {{printf "%#v" .Methods}},
+		{{end}}{{end}}
 	}
 
 	values := []struct{
@@ -241,12 +588,41 @@ func main() {
 		{{range .Values}}
 		{ {{printf "%q" .}}, reflect.ValueOf(pkg_.{{.}}) },
 		{{end}}
+		{{range .Signatures}}
+		{ {{printf "%q" .Name}}, reflect.Zero(reflect.TypeOf((*{{.Type}})(nil)).Elem()) },
+		{{end}}
+	}
+
+	consts := []struct{
+		sym string
+		val reflect.Value
+		lit string
+	}{
+		{{range .Consts}}
+		{ {{printf "%q" .Name}}, {{if .Typed}}reflect.ValueOf(pkg_.{{.Name}}){{else}}reflect.Value{}{{end}}, {{printf "%q" .Value}} },
+		{{end}}
 	}
 
 	// NOTE: This behaves contrary to documented behaviour if the
 	// package name is not the final component of the import path.
 	// The reflect package doesn't expose the package name, though.
 	pkg := model.NewPackage({{printf "%q" .ImportPath}}, {{.UseExtTypes}})
+	pkg.EnumStrings = {{.EnumStrings}}
+	pkg.Fakes = {{.Fakes}}
+	pkg.Lang = {{printf "%q" .Lang}}
+	pkg.Deprecations = {{printf "%#v" .Deprecations}}
+	{{- if .TypeMap}}
+	pkg.TypeMap = {{printf "%#v" .TypeMap}}
+	{{- end}}
+
+	for _, t := range types {
+		if t.methods != nil {
+			pkg.SelectMethods(t.sym, t.methods)
+		}
+	}
+	for name, methods := range placeholders {
+		pkg.SelectMethods(name, methods)
+	}
 
 	for _, t := range types {
 		err := pkg.AddType(t.sym, t.typ)
@@ -264,6 +640,14 @@ func main() {
 		}
 	}
 
+	for i, c := range consts {
+		err := pkg.AddConst(c.sym, c.val, c.lit, i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Reflection: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
 	outfile := os.Stdout
 	if len(*output) != 0 {
 		var err error
@@ -279,8 +663,8 @@ func main() {
 		}()
 	}
 
-	if err := gob.NewEncoder(outfile).Encode(model.PackPkg(pkg)); err != nil {
-		fmt.Fprintf(os.Stderr, "gob encode: %v\n", err)
+	if err := model.WritePackedPkg(outfile, model.PackPkg(pkg), *format); err != nil {
+		fmt.Fprintf(os.Stderr, "encode: %v\n", err)
 		os.Exit(1)
 	}
 }
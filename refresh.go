@@ -0,0 +1,138 @@
+package main
+
+// This file contains the `vendor` subcommand, which regenerates the stubs in
+// the vendor directory from the lockfile or the headers of the stubs.
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var onlyPackage = flag.String("only", "", "Make the vendor subcommand regenerate only the stub of this package.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"vendor"},
+		usage: "regenerate the stubs in the vendor directory with their recorded symbols",
+		run:   runVendor,
+	})
+}
+
+func runVendor(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("vendor must be run in a module")
+	}
+
+	recorded, err := recordedPackages(root)
+	if err != nil {
+		return err
+	}
+	if *onlyPackage != "" {
+		var only []lockedPackage
+		for _, locked := range recorded {
+			if locked.Package == *onlyPackage {
+				only = append(only, locked)
+			}
+		}
+		if len(only) == 0 {
+			return fmt.Errorf("no stub of %s is recorded in the lockfile or in vendor/%s/stub.go", *onlyPackage, *onlyPackage)
+		}
+		recorded = only
+	}
+	if len(recorded) == 0 {
+		return fmt.Errorf("no stubs recorded in %s", filepath.Join(root, "vendor"))
+	}
+
+	defer os.Chdir(wd)
+	base := captureFlags()
+	defer base.restore()
+	return replayInto(root, &lockfile{Version: lockfileVersion, Packages: recorded}, base)
+}
+
+// recordedPackages returns the stubs of the vendor directory of the module
+// in `root` as recorded in the lockfile, and for stubs missing from it, as
+// recorded in their headers.
+func recordedPackages(root string) ([]lockedPackage, error) {
+	vendorDir := filepath.Join(root, "vendor")
+	lock, err := readLockfile(filepath.Join(vendorDir, lockfileName))
+	if err != nil {
+		return nil, err
+	}
+	recorded := lock.Packages
+	locked := make(map[string]bool)
+	for _, pkg := range recorded {
+		locked[pkg.Package] = true
+	}
+
+	err = filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == vendorDir {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() != "stub.go" {
+			return nil
+		}
+		pkg, err := stubHeader(path)
+		if err != nil {
+			return err
+		}
+		if pkg != nil && !locked[pkg.Package] {
+			recorded = append(recorded, *pkg)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(recorded, func(i, j int) bool {
+		return recorded[i].Package < recorded[j].Package
+	})
+	return recorded, nil
+}
+
+var sourceHeaderRegex = regexp.MustCompile(`^// Source: (\S+) \(exports: ([^;]*); functions: ([^;)]*)(?:; excluded: ([^)]*))?\)$`)
+
+var moduleHeaderRegex = regexp.MustCompile(`^// Module: (\S+) (\S+) (?:=> (\S+)|(\S+))$`)
+
+// stubHeader returns the package and symbols recorded in the header of the
+// stub at `path`, or nil if it has no such header.
+func stubHeader(path string) (*lockedPackage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var sum *moduleSum
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := moduleHeaderRegex.FindStringSubmatch(scanner.Text()); m != nil {
+			sum = &moduleSum{Path: m[1], Version: m[2], Replace: m[3], Sum: m[4]}
+			continue
+		}
+		m := sourceHeaderRegex.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		pkg := &lockedPackage{Package: m[1], Types: split(m[2]), Values: split(m[3]), Module: sum}
+		if m[4] != "" {
+			pkg.Options = map[string]string{"exclude_symbols": m[4]}
+		}
+		return pkg, nil
+	}
+	return nil, scanner.Err()
+}
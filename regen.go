@@ -0,0 +1,113 @@
+package main
+
+// This file contains the `regen` subcommand, which regenerates the stubs of
+// -auto from a saved detection map without analysing the sources again.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/tools/go/packages"
+)
+
+var regenFrom = flag.String("from", "", "The detection map the regen subcommand stubs from; defaults to vendor/"+detectionMapName+" of the current module.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"regen"},
+		usage: "regenerate the stubs of -auto -vendor from a saved detection map",
+		run:   runRegen,
+	})
+}
+
+func runRegen(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("regen must be run in a module")
+	}
+	path := *regenFrom
+	if path == "" {
+		path = filepath.Join(root, "vendor", detectionMapName)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m detectionMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("invalid detection map %s: %s", path, err)
+	}
+
+	pkgPaths := make([]string, 0, len(m.Packages))
+	for pkgPath := range m.Packages {
+		pkgPaths = append(pkgPaths, pkgPath)
+	}
+	sort.Strings(pkgPaths)
+	modules, err := loadModules(root, pkgPaths)
+	if err != nil {
+		return err
+	}
+
+	*vendor = true
+	var prefetched []*packages.Module
+	for _, pkgPath := range pkgPaths {
+		prefetched = append(prefetched, modules[pkgPath]...)
+	}
+	prefetchLicenses(prefetched)
+
+	var errs []error
+	copiedLicenses := make(licenseCopies)
+	for _, pkgPath := range pkgPaths {
+		pkg := m.Packages[pkgPath]
+		if err := generateStubs(runContext, copiedLicenses, pkgPath, sortedKeys(pkg.Types), sortedKeys(pkg.Values), modules[pkgPath]); err != nil {
+			exitIfInterrupted(runContext)
+			errs = append(errs, err)
+		}
+	}
+	finishVendor()
+	return CombineErrors(errs...)
+}
+
+// loadModules returns the modules providing the packages `pkgPaths` in the
+// module in `dir`, for copying their licenses. Only the metadata of the
+// packages is loaded.
+func loadModules(dir string, pkgPaths []string) (map[string][]*packages.Module, error) {
+	config := &packages.Config{
+		Context: runContext,
+		Mode:    packages.NeedName | packages.NeedModule,
+		Dir:     dir,
+		Env:     childEnv(),
+	}
+	pkgs, err := packages.Load(config, pkgPaths...)
+	if err != nil {
+		return nil, fmt.Errorf("error while running packages.Load: %s", err)
+	}
+	modules := make(map[string][]*packages.Module)
+	for _, pkg := range pkgs {
+		if pkg.Module != nil {
+			modules[pkg.PkgPath] = []*packages.Module{pkg.Module}
+		}
+	}
+	return modules, nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,208 @@
+package main
+
+// This file contains the `remove` subcommand, which removes the stub of a
+// package from the vendor directory.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	registerCommand(&command{
+		names: []string{"remove"},
+		usage: "remove the stubs of the given packages from the vendor directory",
+		run:   runRemove,
+	})
+}
+
+// generatedMarker is the first line of the files depstubber generates.
+const generatedMarker = "// Code generated by depstubber. DO NOT EDIT."
+
+func runRemove(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected the import paths of the packages to remove")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("remove must be run in a module")
+	}
+	vendorDir := filepath.Join(root, "vendor")
+
+	var errs []error
+	var removed []string
+	for _, pkg := range args {
+		if err := removeStub(vendorDir, pkg); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, pkg)
+	}
+	if len(removed) > 0 {
+		if err := removeFromModulesTxt(vendorDir, removed); err != nil {
+			errs = append(errs, err)
+		}
+		if err := removeFromLockfile(vendorDir, removed); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return CombineErrors(errs...)
+}
+
+// removeStub removes the files depstubber generated for `pkg` in the vendor
+// directory, and the directories that are left empty. The license files are
+// kept if the directory also holds the stubs of other packages.
+func removeStub(vendorDir string, pkg string) error {
+	dir := vendorStubDir(vendorDir, pkg)
+	if !generatedByDepstubber(filepath.Join(dir, "stub.go")) {
+		return fmt.Errorf("%s has no stub generated by depstubber", dir)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var remove []string
+	var others bool
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		switch {
+		case info.IsDir():
+			others = true
+		case strings.HasSuffix(info.Name(), ".go"):
+			if !generatedByDepstubber(path) {
+				return fmt.Errorf("%s was not generated by depstubber; not removing %s", path, pkg)
+			}
+			remove = append(remove, path)
+		case info.Name() == stubReadmeName:
+			remove = append(remove, path)
+		}
+	}
+	if !others {
+		// Without stubs in subdirectories, the license files are no
+		// longer needed either.
+		remove = []string{dir}
+	}
+	for _, path := range remove {
+		if err := removeAll(path); err != nil {
+			return err
+		}
+	}
+
+	// Remove the parent directories that are left without stubs, like the
+	// module root holding only the license files.
+	for parent := filepath.Dir(dir); parent != vendorDir && strings.HasPrefix(parent, vendorDir); parent = filepath.Dir(parent) {
+		if planOnly || holdsStubs(parent) {
+			break
+		}
+		if err := removeAll(parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdsStubs reports whether the directory `dir` has Go files or
+// subdirectories, or can't be read.
+func holdsStubs(dir string) bool {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), ".go") {
+			return true
+		}
+	}
+	return false
+}
+
+// generatedByDepstubber reports whether the Go file at `path` was generated by depstubber.
+func generatedByDepstubber(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The marker follows the build constraints, if any.
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "//go:build ") && !strings.HasPrefix(line, "// +build ") {
+			return line == generatedMarker
+		}
+	}
+	return false
+}
+
+// removeFromModulesTxt removes the lines of the packages `pkgs` from the
+// modules.txt of the vendor directory, keeping the lines of the modules.
+func removeFromModulesTxt(vendorDir string, pkgs []string) error {
+	path := filepath.Join(vendorDir, "modules.txt")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, pkg := range pkgs {
+		removed[pkg] = true
+	}
+	var buf bytes.Buffer
+	var entries []string
+	changed := false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if removed[strings.TrimSuffix(line, "\n")] {
+			changed = true
+			continue
+		}
+		buf.WriteString(line)
+		if line = strings.TrimSuffix(line, "\n"); line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeFile(path, buf.Bytes(), nil, fileAction{Entries: entries})
+}
+
+// removeFromLockfile drops the packages `pkgs` from the lockfile of the
+// vendor directory.
+func removeFromLockfile(vendorDir string, pkgs []string) error {
+	path := filepath.Join(vendorDir, lockfileName)
+	if exists, err := FileExists(path); err != nil || !exists {
+		return err
+	}
+	lock, err := readLockfile(path)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[string]bool)
+	for _, pkg := range pkgs {
+		removed[pkg] = true
+	}
+	kept := make([]lockedPackage, 0, len(lock.Packages))
+	for _, locked := range lock.Packages {
+		if !removed[locked.Package] {
+			kept = append(kept, locked)
+		}
+	}
+	if len(kept) == len(lock.Packages) {
+		return nil
+	}
+	lock.Packages = kept
+	return writeLockfile(path, lock)
+}
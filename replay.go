@@ -0,0 +1,106 @@
+package main
+
+// This file contains the `replay` subcommand, which stubs the packages of a
+// lockfile into the vendor directories of other modules.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var lockfileFlag = flag.String("lockfile", "", "The lockfile replayed by the replay subcommand; defaults to vendor/"+lockfileName+" of the current module.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"replay"},
+		usage: "stub the packages of a lockfile into the vendor directory of each given module",
+		run:   runReplay,
+	})
+}
+
+func runReplay(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected the directories of the target modules")
+	}
+	path := *lockfileFlag
+	if path == "" {
+		path = lockfilePath()
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	lock, err := readLockfile(path)
+	if err != nil {
+		return err
+	}
+	if len(lock.Packages) == 0 {
+		return fmt.Errorf("no packages in lockfile %s", path)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	base := captureFlags()
+	defer base.restore()
+
+	var failures []string
+	for _, dir := range args {
+		if err := os.Chdir(wd); err != nil {
+			return err
+		}
+		if err := replayInto(dir, lock, base); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", dir, err))
+			fmt.Printf("FAIL  %s\n", dir)
+		} else {
+			fmt.Printf("ok    %s\n", dir)
+		}
+		exitIfInterrupted(runContext)
+	}
+
+	fmt.Printf("%d modules, %d failed\n", len(args), len(failures))
+	if len(failures) > 0 {
+		return fmt.Errorf("failed modules:\n\t%s", strings.Join(failures, "\n\t"))
+	}
+	return nil
+}
+
+// replayInto stubs the packages of `lock` into the vendor directory of the
+// module in `dir`.
+func replayInto(dir string, lock *lockfile, base *flagState) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(abs)
+	if root == "" {
+		return fmt.Errorf("not in a module")
+	}
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+
+	lockedPackages = nil
+	var errs []error
+	copiedLicenses := make(licenseCopies)
+	for _, locked := range lock.Packages {
+		base.restore()
+		for name, value := range locked.Options {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: option %s: %s", locked.Package, name, err)
+			}
+		}
+		*vendor = true
+		if err := generateStubs(runContext, copiedLicenses, locked.Package, locked.Types, locked.Values, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	base.restore()
+	finishVendor()
+	return CombineErrors(errs...)
+}
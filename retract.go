@@ -0,0 +1,74 @@
+package main
+
+// This file contains the detection of retracted versions of the modules
+// being stubbed.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+var rejectRetracted = flag.Bool("reject_retracted", false, "Fail instead of warning when the version of the module being stubbed is retracted by its authors.")
+
+// retractions holds the rationales of the retracted module versions looked
+// up so far, by module path and version.
+var retractions = make(map[string][]string)
+
+// checkRetracted warns, or fails with -reject_retracted, if the version
+// `sum` of the module being stubbed has been retracted by its authors, which
+// the go command finds in the go.mod of the latest version of the module.
+// Nothing is looked up with -offline, nor for modules replaced by
+// directories.
+func checkRetracted(ctx context.Context, modRoot string, sum *moduleSum) error {
+	if sum == nil || sum.Replace != "" || sum.Version == "" || *offline {
+		return nil
+	}
+	key := sum.Path + "@" + sum.Version
+	rationales, ok := retractions[key]
+	if !ok {
+		rationales = lookupRetractions(ctx, modRoot, key)
+		retractions[key] = rationales
+	}
+	if rationales == nil {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s %s is retracted by its authors", sum.Path, sum.Version)
+	if reasons := strings.Join(rationales, "; "); reasons != "" {
+		msg += ": " + reasons
+	}
+	if *rejectRetracted {
+		return fmt.Errorf("%s", msg)
+	}
+	log.Printf("WARNING: %s; the stub models an API that may be abandoned.", msg)
+	return nil
+}
+
+// lookupRetractions returns the rationales of the retraction of the module
+// version `modVersion` (`path@version`), with an empty rationale if none is
+// given, or nil if it is not retracted or the go command can't tell.
+func lookupRetractions(ctx context.Context, modRoot string, modVersion string) []string {
+	// The vendor directory of stubs doesn't list module versions.
+	cmd := exec.CommandContext(ctx, "go", "list", "-mod=mod", "-m", "-json", "-retracted", modVersion)
+	cmd.Dir = modRoot
+	cmd.Env = childEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	var mod struct {
+		Retracted []string
+	}
+	if err := json.Unmarshal(out, &mod); err != nil || mod.Retracted == nil {
+		return nil
+	}
+	for i, rationale := range mod.Retracted {
+		mod.Retracted[i] = strings.TrimSpace(rationale)
+	}
+	return mod.Retracted
+}
@@ -0,0 +1,146 @@
+package main
+
+// This file contains the spans of -spans, which record the time spent in
+// each phase of a run and on each package, in the style of OpenTelemetry
+// spans, so that the slow dependencies and flaky builds of many runs can be
+// found in aggregated CI telemetry.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var spansOutput = flag.String("spans", "", "Write a span for the run, each stubbed package and each phase of its generation to this file, as JSON lines in the style of OpenTelemetry spans.")
+
+// span is a timed operation of a run. Its JSON encoding follows the field
+// names of the OTLP JSON encoding, with the attributes as a plain object.
+type span struct {
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Start        string            `json:"startTimeUnixNano"`
+	End          string            `json:"endTimeUnixNano"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Status       spanStatus        `json:"status"`
+
+	start time.Time
+}
+
+type spanStatus struct {
+	Code    string `json:"code"` // "STATUS_CODE_OK" or "STATUS_CODE_ERROR"
+	Message string `json:"message,omitempty"`
+}
+
+var (
+	spansMu   sync.Mutex
+	spansFile *os.File
+	traceID   string
+
+	// runSpan and packageSpan are the spans of the run and of the package
+	// being stubbed, if any; the spans of the phases are their children.
+	runSpan     *span
+	packageSpan *span
+)
+
+// startSpans opens the file of -spans and starts the span of the run, if
+// they aren't already.
+func startSpans() error {
+	if *spansOutput == "" || spansFile != nil {
+		return nil
+	}
+	f, err := os.Create(*spansOutput)
+	if err != nil {
+		return fmt.Errorf("Unable to create the spans file: %v", err)
+	}
+	spansFile = f
+	traceID = randomID(16)
+	runSpan = startSpan(nil, "run", map[string]string{"args": fmt.Sprint(os.Args[1:])})
+	return nil
+}
+
+// finishSpans ends the span of the run, with the error `err` if it failed,
+// and closes the file of -spans.
+func finishSpans(err error) {
+	if spansFile == nil {
+		return
+	}
+	runSpan.end(err)
+	spansMu.Lock()
+	defer spansMu.Unlock()
+	spansFile.Close()
+	spansFile = nil
+}
+
+// startSpan starts a span named `name`, the child of `parent` if it isn't
+// nil. It returns nil without -spans.
+func startSpan(parent *span, name string, attributes map[string]string) *span {
+	return startSpanAt(parent, name, attributes, time.Now())
+}
+
+func startSpanAt(parent *span, name string, attributes map[string]string, start time.Time) *span {
+	if spansFile == nil {
+		return nil
+	}
+	s := &span{TraceID: traceID, SpanID: randomID(8), Name: name, Attributes: attributes, start: start}
+	if parent != nil {
+		s.ParentSpanID = parent.SpanID
+	}
+	return s
+}
+
+// end ends the span `s`, which failed with `err` if it isn't nil, and writes
+// it to the file of -spans.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.Start = strconv.FormatInt(s.start.UnixNano(), 10)
+	s.End = strconv.FormatInt(time.Now().UnixNano(), 10)
+	s.Status = spanStatus{Code: "STATUS_CODE_OK"}
+	if err != nil {
+		s.Status = spanStatus{Code: "STATUS_CODE_ERROR", Message: err.Error()}
+	}
+	data, marshalErr := json.Marshal(s)
+	if marshalErr != nil {
+		return
+	}
+
+	spansMu.Lock()
+	defer spansMu.Unlock()
+	if spansFile != nil {
+		spansFile.Write(append(data, '\n'))
+	}
+}
+
+// phaseSpan writes the span of `phase`, which started at `start`, as a
+// child of the span of the package being stubbed, or of the run.
+func phaseSpan(phase string, start time.Time) {
+	if spansFile == nil {
+		return
+	}
+	parent := runSpan
+	var attributes map[string]string
+	if packageSpan != nil {
+		parent = packageSpan
+		attributes = map[string]string{"package": packageSpan.Attributes["package"]}
+	}
+	startSpanAt(parent, phase, attributes, start).end(nil)
+}
+
+// randomID returns a random ID of `n` bytes in hexadecimal.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// The IDs only need to be unique within the traces of a CI system.
+		return fmt.Sprintf("%0*x", 2*n, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
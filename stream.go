@@ -0,0 +1,89 @@
+package main
+
+// This file contains the streaming of the stubs of several packages to one
+// output, when they have no destination files.
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+var archive = flag.String("archive", "", "Write the stubs that have no destination as a tar archive of vendor/<PKGPATH>/stub.go files to this file, or to stdout if '-'.")
+
+// stubStream writes the stubs of several packages to one output, either
+// separated by file markers or as a tar archive.
+type stubStream struct {
+	out io.Writer
+
+	// archive is the path of the tar archive, if any.
+	archive string
+	tarBuf  bytes.Buffer
+	tw      *tar.Writer
+}
+
+func newStubStream(out io.Writer, archive string) *stubStream {
+	s := &stubStream{out: out, archive: archive}
+	if archive != "" {
+		s.tw = tar.NewWriter(&s.tarBuf)
+	}
+	return s
+}
+
+// streamPath returns the path of the stub of `pkgPath` in the stream.
+func streamPath(pkgPath string) string {
+	return path.Join("vendor", pkgPath, "stub.go")
+}
+
+// add writes the stub `src` of `pkgPath` to the stream.
+func (s *stubStream) add(pkgPath string, src []byte) error {
+	if s.tw == nil {
+		_, err := fmt.Fprintf(s.out, "// -- file: %s --\n%s", streamPath(pkgPath), src)
+		return err
+	}
+	hdr := &tar.Header{
+		Name: streamPath(pkgPath),
+		Mode: 0644,
+		Size: int64(len(src)),
+	}
+	if err := s.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := s.tw.Write(src)
+	return err
+}
+
+// close finishes the stream, writing the tar archive if there is one.
+func (s *stubStream) close() error {
+	if s.tw == nil {
+		return nil
+	}
+	if err := s.tw.Close(); err != nil {
+		return err
+	}
+	if s.archive == "-" {
+		_, err := s.out.Write(s.tarBuf.Bytes())
+		return err
+	}
+	return writeFile(s.archive, s.tarBuf.Bytes(), nil, fileAction{})
+}
+
+// currentStream is the stream of the stubs of this run, if they are streamed.
+var currentStream *stubStream
+
+// startStream starts streaming the stubs to stdout if there are several
+// and they have no destination, or if -archive is set.
+func startStream() {
+	if *destination != "" || *vendor {
+		return
+	}
+	if *archive != "" || *modeAutoDetection {
+		currentStream = newStubStream(os.Stdout, *archive)
+		// Keep the messages about copied licenses out of the stream.
+		progress = os.Stderr
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+// This file contains the shared cache of stubs, which is kept in the user
+// cache directory so that modules stubbing the same symbols of the same
+// module version don't each run a reflection program for them.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var stubCache = flag.Bool("stub_cache", false, "Reuse the stubs of module versions generated earlier with the same symbols and flags, from the user cache directory, and cache the stubs generated.")
+
+// stubCacheVersion is changed when the format of the cached stubs changes.
+const stubCacheVersion = 1
+
+// cachedStub holds the files of a stub directory, by name, and the module
+// version they were generated from.
+type cachedStub struct {
+	Version int               `json:"version"`
+	Module  *moduleSum        `json:"module,omitempty"`
+	Files   map[string][]byte `json:"files"`
+}
+
+var (
+	executableHashOnce sync.Once
+	executableHash     string
+	goVersionOnce      sync.Once
+	goVersion          string
+)
+
+// cachedGoVersion returns the version of the go command, or "" if it can't
+// be determined.
+func cachedGoVersion() string {
+	goVersionOnce.Do(func() {
+		goVersion, _ = goEnv("GOVERSION")
+	})
+	return goVersion
+}
+
+// stubCacheKey returns the key of the stub of the symbols of `pkgPath`
+// required by the module in `modRoot` and written to `dst`, or "" if it
+// can't be cached: only stubs of module versions with a hash in go.sum,
+// written to a file, are.
+// Besides the symbols and the module version, the key covers everything
+// else the stub depends on: the depstubber and go binaries, the target
+// platform and the flags recorded in the lockfile.
+func stubCacheKey(modRoot string, pkgPath string, dst string, typeNames []string, funcAndVarNames []string) string {
+	if !*stubCache || planOnly || currentLocalSource != nil || dst == "" || *execOnly != "" {
+		return ""
+	}
+	sum := lookupModuleSum(modRoot, pkgPath)
+	if sum == nil || sum.Sum == "" {
+		return ""
+	}
+
+	executableHashOnce.Do(func() {
+		if path, err := os.Executable(); err == nil {
+			executableHash, _ = hashFile(path)
+		}
+	})
+	goVersion := cachedGoVersion()
+	if executableHash == "" || goVersion == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	goos, goarch := targetPlatform()
+	fmt.Fprintf(h, "depstubber %s\ngo %s\nplatform %s/%s\n", executableHash, goVersion, goos, goarch)
+	fmt.Fprintf(h, "module %s\npackage %s\ntypes %s\nvalues %s\n", sum, pkgPath, strings.Join(typeNames, ","), strings.Join(funcAndVarNames, ","))
+	for _, name := range lockedFlags {
+		fmt.Fprintf(h, "-%s=%s\n", name, lockedFlagValue(name))
+	}
+	for _, name := range []string{"offline", "license_lookup"} {
+		fmt.Fprintf(h, "-%s=%s\n", name, flag.Lookup(name).Value.String())
+	}
+	// With -empty_interface auto, the spelling depends on the module.
+	if spellAny, err := useAny(); err == nil {
+		fmt.Fprintf(h, "any %t\n", spellAny)
+	}
+	if *copyrightFile != "" {
+		header, err := hashFile(*copyrightFile)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintf(h, "copyright %s\n", header)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hashFile returns the SHA-256 hash of the contents of the file `path`.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stubCachePath returns the file caching the stub with the key `key`, or ""
+// if there is no user cache directory.
+func stubCachePath(key string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "depstubber", "stubs", key[:2], key+".json")
+}
+
+// restoreCachedStub writes the cached stub with the key `key` of `pkgPath`
+// to the directory of the stub file `dst` and reports whether there was one.
+func restoreCachedStub(key string, pkgPath string, dst string) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+	path := stubCachePath(key)
+	if path == "" {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, nil
+	}
+	var cached cachedStub
+	if err := json.Unmarshal(data, &cached); err != nil || cached.Version != stubCacheVersion || len(cached.Files) == 0 {
+		return false, nil
+	}
+
+	names := make([]string, 0, len(cached.Files))
+	for name := range cached.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stubDir := filepath.Dir(dst)
+	for _, name := range names {
+		path, action := filepath.Join(stubDir, name), fileAction{Package: pkgPath}
+		var err error
+		if strings.HasSuffix(name, exampleSuffix) {
+			// The example may have been edited since it was cached.
+			err = writeNewFile(path, cached.Files[name], action)
+		} else {
+			err = writeFile(path, cached.Files[name], nil, action)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if cached.Module != nil {
+		buildModules[pkgPath] = cached.Module
+	}
+	return true, nil
+}
+
+// writeCachedStub caches the files written to the directory of the stub
+// file `dst` for the stub of `pkgPath` with the key `key`, generated from
+// the module version `sum`. Failing to write the cache is not an error.
+func writeCachedStub(key string, pkgPath string, dst string, sum *moduleSum) {
+	path := stubCachePath(key)
+	if path == "" {
+		return
+	}
+	stubDir := filepath.Dir(dst)
+	cached := cachedStub{Version: stubCacheVersion, Module: sum, Files: make(map[string][]byte)}
+	for _, action := range recordedActions {
+		if action.Action != "write" || action.Package != pkgPath || filepath.Dir(action.Path) != stubDir {
+			continue
+		}
+		data, err := ioutil.ReadFile(action.Path)
+		if err != nil {
+			return
+		}
+		cached.Files[filepath.Base(action.Path)] = data
+	}
+	if len(cached.Files) == 0 {
+		return
+	}
+	data, err := json.Marshal(&cached)
+	if err != nil {
+		return
+	}
+	writeCacheFile(path, data)
+}
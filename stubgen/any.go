@@ -0,0 +1,38 @@
+package stubgen
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"reflect"
+)
+
+// useAny replaces the empty interface types of `f` with `any`, which Go 1.18
+// declares as an alias of `interface{}`.
+func useAny(f *ast.File) {
+	rewriteFields(reflect.ValueOf(f), func(expr ast.Expr) ast.Expr {
+		it, ok := expr.(*ast.InterfaceType)
+		if ok && (it.Methods == nil || len(it.Methods.List) == 0) {
+			return &ast.Ident{NamePos: it.Pos(), Name: "any"}
+		}
+		return expr
+	})
+}
+
+// withAny returns the formatted source `src` with its empty interface types
+// replaced with `any`.
+func withAny(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	useAny(f)
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,283 @@
+package stubgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/github/depstubber/model"
+	"golang.org/x/tools/imports"
+)
+
+// APICheckTag is the build tag of the files written by APICheck.
+const APICheckTag = "depstubber_apicheck"
+
+// upstreamName is the name under which APICheck files import the real package.
+const upstreamName = "upstream"
+
+// APICheck returns the source of a file for the package of the stub `src`
+// of the package `importPath`, which asserts that the symbols of the stub
+// match those of the real package. The file is guarded by APICheckTag, and
+// type-checks only if the real package has the stubbed symbols with the
+// same types. Declarations that refer to placeholders, or to types replaced
+// by `interface{}`, can't be compared and are left out.
+func APICheck(importPath string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &apiChecker{fset: fset, declared: make(map[string]bool), fakes: make(map[string]bool), generic: genericNames(f)}
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+			for _, spec := range gen.Specs {
+				c.declared[spec.(*ast.TypeSpec).Name.Name] = true
+				if isFake(gen.Doc) {
+					c.fakes[spec.(*ast.TypeSpec).Name.Name] = true
+				}
+			}
+		}
+	}
+	for _, decl := range f.Decls {
+		c.decl(decl)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by depstubber. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "//go:build %s\n// +build %s\n\n", APICheckTag, APICheckTag)
+	fmt.Fprintf(&buf, "// This file checks the stub of %s against the real package;\n", importPath)
+	fmt.Fprintf(&buf, "// it only builds with -tags %s when the real package is available.\n\n", APICheckTag)
+	fmt.Fprintf(&buf, "package %s\n\n", f.Name.Name)
+	fmt.Fprintf(&buf, "import (\n\t%s %s\n", upstreamName, strconv.Quote(importPath))
+	for _, imp := range f.Imports {
+		if imp.Name != nil {
+			fmt.Fprintf(&buf, "\t%s %s\n", imp.Name.Name, imp.Path.Value)
+		} else {
+			fmt.Fprintf(&buf, "\t%s\n", imp.Path.Value)
+		}
+	}
+	fmt.Fprintf(&buf, ")\n\n")
+	for _, check := range c.checks {
+		fmt.Fprintf(&buf, "%s\n", check)
+	}
+
+	out, err := imports.Process("", buf.Bytes(), nil)
+	if err != nil {
+		return nil, newOutputError(buf.Bytes(), err)
+	}
+	return out, nil
+}
+
+type apiChecker struct {
+	fset     *token.FileSet
+	declared map[string]bool // the types declared by the stub
+	fakes    map[string]bool // the fakes of interfaces, which only the stub declares
+	generic  map[string]bool // the types and functions that need type arguments
+	checks   []string
+}
+
+// isFake reports whether the doc comment `doc` is that of a fake generated
+// with model.Package.Fakes.
+func isFake(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, comment := range doc.List {
+		if comment.Text == model.FakeDirective {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *apiChecker) add(format string, args ...interface{}) {
+	c.checks = append(c.checks, fmt.Sprintf(format, args...))
+}
+
+func (c *apiChecker) decl(decl ast.Decl) {
+	switch decl := decl.(type) {
+	case *ast.FuncDecl:
+		if !decl.Name.IsExported() {
+			return
+		}
+		if decl.Recv == nil && c.generic[decl.Name.Name] {
+			// Generic functions can't be assigned without instantiating them.
+			return
+		}
+		if decl.Recv == nil {
+			if typ, ok := c.typeString(decl.Type); ok {
+				c.add("var _ %s = %s.%s", typ, upstreamName, decl.Name.Name)
+			}
+			return
+		}
+		// A method expression has the receiver as its first parameter.
+		recv := decl.Recv.List[0].Type
+		if ident, ok := recv.(*ast.Ident); ok && c.fakes[ident.Name] || genericReceiver(recv) {
+			return
+		}
+		method := withReceiver(recv, decl.Type)
+		typ, ok := c.typeString(method)
+		recvString, recvOK := c.typeString(recv)
+		if ok && recvOK {
+			c.add("var _ %s = (%s).%s", typ, recvString, decl.Name.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range decl.Specs {
+			switch spec := spec.(type) {
+			case *ast.TypeSpec:
+				c.typeSpec(spec)
+			case *ast.ValueSpec:
+				c.valueSpec(decl.Tok, spec)
+			}
+		}
+	}
+}
+
+func (c *apiChecker) typeSpec(spec *ast.TypeSpec) {
+	name := spec.Name.Name
+	if !spec.Name.IsExported() || c.fakes[name] || c.generic[name] {
+		return
+	}
+	c.add("var _ *%s.%s", upstreamName, name)
+
+	switch typ := spec.Type.(type) {
+	case *ast.StructType:
+		for _, field := range typ.Fields.List {
+			fieldType, ok := c.typeString(field.Type)
+			if !ok {
+				continue
+			}
+			names := field.Names
+			if len(names) == 0 {
+				// The name of an embedded field is that of its type.
+				embedded := field.Type
+				if star, ok := embedded.(*ast.StarExpr); ok {
+					embedded = star.X
+				}
+				if sel, ok := embedded.(*ast.SelectorExpr); ok {
+					embedded = sel.Sel
+				}
+				if ident, ok := embedded.(*ast.Ident); ok {
+					names = []*ast.Ident{ident}
+				}
+			}
+			for _, fieldName := range names {
+				if fieldName.IsExported() {
+					c.add("var _ %s = (&%s.%s{}).%s", fieldType, upstreamName, name, fieldName.Name)
+				}
+			}
+		}
+	case *ast.InterfaceType:
+		for _, method := range typ.Methods.List {
+			funcType, ok := method.Type.(*ast.FuncType)
+			if !ok || len(method.Names) == 0 {
+				continue
+			}
+			expr := withReceiver(ast.NewIdent(name), funcType)
+			if typ, ok := c.typeString(expr); ok && method.Names[0].IsExported() {
+				c.add("var _ %s = %s.%s.%s", typ, upstreamName, name, method.Names[0].Name)
+			}
+		}
+	}
+}
+
+func (c *apiChecker) valueSpec(tok token.Token, spec *ast.ValueSpec) {
+	for i, name := range spec.Names {
+		if !name.IsExported() {
+			continue
+		}
+		if tok == token.VAR {
+			typ, ok := c.typeString(spec.Type)
+			switch spec.Type.(type) {
+			case nil:
+			case *ast.MapType, *ast.ArrayType:
+				// Maps and slices of named types that aren't stubbed are
+				// stubbed with their underlying type, which the real
+				// value is only assignable to.
+				if ok {
+					c.add("var _ %s = %s.%s", typ, upstreamName, name.Name)
+				}
+			default:
+				if ok {
+					c.add("var _ *%s = &%s.%s", typ, upstreamName, name.Name)
+				}
+			}
+			continue
+		}
+		if ident, ok := spec.Type.(*ast.Ident); spec.Type == nil || ok && !c.declared[ident.Name] {
+			// Constants of unexported types are stubbed with their basic
+			// type, so only the value can be compared.
+			c.add("const _ = %s.%s", upstreamName, name.Name)
+		} else if typ, ok := c.typeString(spec.Type); ok {
+			c.add("var _ %s = %s.%s", typ, upstreamName, name.Name)
+		}
+		if i < len(spec.Values) && integerLiteral(spec.Values[i]) {
+			// The length of an array type must not be negative, and the
+			// array types only match if the values are the same.
+			c.add("var _ [0]struct{} = [%s.%s - (%s)]struct{}{}", upstreamName, name.Name, c.exprString(spec.Values[i]))
+		}
+	}
+}
+
+// withReceiver returns the type of the method expression for a method of
+// type `funcType` with the receiver `recv`.
+func withReceiver(recv ast.Expr, funcType *ast.FuncType) *ast.FuncType {
+	field := &ast.Field{Type: recv}
+	if params := funcType.Params.List; len(params) > 0 && len(params[0].Names) > 0 {
+		// Parameters must be either all named or all unnamed.
+		field.Names = []*ast.Ident{ast.NewIdent("_")}
+	}
+	params := append([]*ast.Field{field}, funcType.Params.List...)
+	return &ast.FuncType{Params: &ast.FieldList{List: params}, Results: funcType.Results}
+}
+
+// typeString returns the source of the type `expr`, with the types declared
+// by the stub referring to the real package. It reports false if the type
+// can't be compared with that of the real package.
+func (c *apiChecker) typeString(expr ast.Expr) (string, bool) {
+	ok := true
+	qualified := rewrite(expr, func(expr ast.Expr) ast.Expr {
+		switch node := expr.(type) {
+		case *ast.InterfaceType:
+			if len(node.Methods.List) == 0 {
+				// Types not in the stubbed package are replaced by interface{}.
+				ok = false
+			}
+		case *ast.Ident:
+			if node.Name == "any" && !c.declared[node.Name] {
+				// The empty interface, spelled `any` with UseAny.
+				ok = false
+			} else if !node.IsExported() && c.declared[node.Name] {
+				ok = false
+			} else if c.declared[node.Name] {
+				return &ast.SelectorExpr{X: ast.NewIdent(upstreamName), Sel: ast.NewIdent(node.Name)}
+			}
+		}
+		return expr
+	})
+	if !ok {
+		return "", false
+	}
+	return c.exprString(qualified), true
+}
+
+func (c *apiChecker) exprString(expr ast.Expr) string {
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, c.fset, expr)
+	return strings.TrimSpace(buf.String())
+}
+
+// integerLiteral reports whether `expr` is a possibly negated integer literal.
+func integerLiteral(expr ast.Expr) bool {
+	if unary, ok := expr.(*ast.UnaryExpr); ok && unary.Op == token.SUB {
+		expr = unary.X
+	}
+	lit, ok := expr.(*ast.BasicLit)
+	return ok && lit.Kind == token.INT
+}
@@ -0,0 +1,221 @@
+package stubgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/imports"
+)
+
+// ExampleMarker is the first line of the files written by Example. Unlike
+// the stubs, they are meant to be edited.
+const ExampleMarker = "// Code generated by depstubber as a starting point for tests; edit it as needed."
+
+// Example returns the source of an external test file for the stub `src` of
+// the package `importPath`, with a test for each stubbed type that
+// constructs its zero value and calls the functions returning it with zero
+// arguments. It is a skeleton for the test cases of queries using the stub,
+// so the calls don't need to make sense at run time; they only type-check.
+func Example(importPath string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exampler{fset: fset, pkgName: f.Name.Name, types: make(map[string]*ast.TypeSpec)}
+	generic := genericNames(f)
+	var types []*ast.TypeSpec
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.TYPE {
+			for _, spec := range gen.Specs {
+				spec := spec.(*ast.TypeSpec)
+				e.types[spec.Name.Name] = spec
+				if spec.Name.IsExported() && !isFake(gen.Doc) && !generic[spec.Name.Name] {
+					types = append(types, spec)
+				}
+			}
+		}
+	}
+	// The constructors of a type are the functions returning it.
+	constructors := make(map[string][]*ast.FuncDecl)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || !fn.Name.IsExported() || fn.Type.Results == nil || generic[fn.Name.Name] {
+			continue
+		}
+		for _, result := range fn.Type.Results.List {
+			if ident, ok := unpointer(result.Type).(*ast.Ident); ok && e.types[ident.Name] != nil {
+				constructors[ident.Name] = append(constructors[ident.Name], fn)
+				break
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s\n\n", ExampleMarker)
+	fmt.Fprintf(&buf, "package %s_test\n\n", f.Name.Name)
+	fmt.Fprintf(&buf, "import (\n\t\"testing\"\n")
+	for _, imp := range f.Imports {
+		if imp.Name != nil {
+			fmt.Fprintf(&buf, "\t%s %s\n", imp.Name.Name, imp.Path.Value)
+		} else {
+			fmt.Fprintf(&buf, "\t%s\n", imp.Path.Value)
+		}
+	}
+	if path.Base(importPath) == f.Name.Name {
+		fmt.Fprintf(&buf, "\n\t%s\n)\n", strconv.Quote(importPath))
+	} else {
+		fmt.Fprintf(&buf, "\n\t%s %s\n)\n", f.Name.Name, strconv.Quote(importPath))
+	}
+	for _, spec := range types {
+		name := spec.Name.Name
+		fmt.Fprintf(&buf, "\nfunc Test%s(t *testing.T) {\n", name)
+		if zero, ok := e.zero(ast.NewIdent(name)); ok && strings.HasSuffix(zero, "{}") {
+			fmt.Fprintf(&buf, "\t_ = %s\n", zero)
+		} else {
+			fmt.Fprintf(&buf, "\tvar _ %s.%s\n", e.pkgName, name)
+		}
+		for _, fn := range constructors[name] {
+			if call, ok := e.call(fn); ok {
+				fmt.Fprintf(&buf, "\t%s\n", call)
+			}
+		}
+		fmt.Fprintf(&buf, "}\n")
+	}
+
+	out, err := imports.Process("", buf.Bytes(), nil)
+	if err != nil {
+		return nil, newOutputError(buf.Bytes(), err)
+	}
+	return out, nil
+}
+
+type exampler struct {
+	fset    *token.FileSet
+	pkgName string
+	types   map[string]*ast.TypeSpec // the types declared by the stub
+}
+
+// call returns a statement calling the function `fn` with zero arguments,
+// discarding its results. It reports false if an argument can't be written
+// outside of the package.
+func (e *exampler) call(fn *ast.FuncDecl) (string, bool) {
+	var args []string
+	for _, param := range fn.Type.Params.List {
+		if _, ok := param.Type.(*ast.Ellipsis); ok {
+			// Variadic parameters may be left out.
+			continue
+		}
+		zero, ok := e.zero(param.Type)
+		if !ok {
+			return "", false
+		}
+		for i := 0; i < len(param.Names) || i == 0 && len(param.Names) == 0; i++ {
+			args = append(args, zero)
+		}
+	}
+	results := 0
+	for _, result := range fn.Type.Results.List {
+		if len(result.Names) == 0 {
+			results++
+		}
+		results += len(result.Names)
+	}
+	call := fmt.Sprintf("%s.%s(%s)", e.pkgName, fn.Name.Name, strings.Join(args, ", "))
+	return strings.Repeat("_, ", results-1) + "_ = " + call, true
+}
+
+// zero returns the zero value of the type `typ` of the stub, as written
+// outside of the package. It reports false if it can't be written there,
+// like that of an unexported struct type.
+func (e *exampler) zero(typ ast.Expr) (string, bool) {
+	switch t := typ.(type) {
+	case *ast.ParenExpr:
+		return e.zero(t.X)
+	case *ast.StarExpr, *ast.MapType, *ast.FuncType, *ast.InterfaceType, *ast.ChanType:
+		return "nil", true
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return "nil", true
+		}
+	case *ast.Ident:
+		switch t.Name {
+		case "bool":
+			return "false", true
+		case "string":
+			return `""`, true
+		case "error", "any":
+			if e.types[t.Name] == nil {
+				return "nil", true
+			}
+		}
+		spec := e.types[t.Name]
+		if spec == nil {
+			// The other predeclared types are numeric.
+			return "0", true
+		}
+		zero, ok := e.zero(spec.Type)
+		switch _, isStruct := spec.Type.(*ast.StructType); {
+		case isStruct && t.IsExported():
+			// Composite literals may leave out unexported fields.
+			return e.pkgName + "." + t.Name + "{}", true
+		case ok && !strings.HasSuffix(zero, "{}") && !strings.HasPrefix(zero, "*new("):
+			// Untyped constants and nil are assignable to the named type.
+			return zero, true
+		case !t.IsExported():
+			return "", false
+		case ok && strings.HasSuffix(zero, "{}"):
+			return e.pkgName + "." + t.Name + "{}", true
+		}
+		return fmt.Sprintf("*new(%s.%s)", e.pkgName, t.Name), true
+	}
+	// The zero value of any other type, like those of other packages.
+	if typeString, ok := e.typeString(typ); ok {
+		switch typ.(type) {
+		case *ast.ArrayType, *ast.StructType:
+			return typeString + "{}", true
+		}
+		// Like `pkg.T` or `List[int]`, whose underlying type isn't known.
+		return fmt.Sprintf("*new(%s)", typeString), true
+	}
+	return "", false
+}
+
+// typeString returns the source of the type `expr` outside of the package,
+// with the types declared by the stub qualified with its name. It reports
+// false if the type refers to unexported types of the stub.
+func (e *exampler) typeString(expr ast.Expr) (string, bool) {
+	ok := true
+	qualified := rewrite(expr, func(expr ast.Expr) ast.Expr {
+		if ident, isIdent := expr.(*ast.Ident); isIdent && e.types[ident.Name] != nil {
+			if !ident.IsExported() {
+				ok = false
+			} else {
+				return &ast.SelectorExpr{X: ast.NewIdent(e.pkgName), Sel: ast.NewIdent(ident.Name)}
+			}
+		}
+		return expr
+	})
+	if !ok {
+		return "", false
+	}
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, e.fset, qualified)
+	return strings.TrimSpace(buf.String()), true
+}
+
+// unpointer returns the type `typ` points to, or `typ` if it isn't a pointer.
+func unpointer(typ ast.Expr) ast.Expr {
+	if star, ok := typ.(*ast.StarExpr); ok {
+		return star.X
+	}
+	return typ
+}
@@ -0,0 +1,68 @@
+package stubgen
+
+import (
+	"go/ast"
+	"go/token"
+)
+
+// genericNames returns the names of the types and functions declared by `f`
+// that can't be used without type arguments: generic types and functions,
+// and constraint interfaces, which can only be used as constraints.
+func genericNames(f *ast.File) map[string]bool {
+	generic := make(map[string]bool)
+	interfaces := make(map[string]*ast.InterfaceType)
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv == nil && funcTypeParams(decl.Type).NumFields() > 0 {
+				generic[decl.Name.Name] = true
+			}
+		case *ast.GenDecl:
+			if decl.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range decl.Specs {
+				spec := spec.(*ast.TypeSpec)
+				if typeParams(spec).NumFields() > 0 {
+					generic[spec.Name.Name] = true
+				} else if iface, ok := spec.Type.(*ast.InterfaceType); ok {
+					interfaces[spec.Name.Name] = iface
+				}
+			}
+		}
+	}
+	var isConstraint func(iface *ast.InterfaceType, seen map[string]bool) bool
+	isConstraint = func(iface *ast.InterfaceType, seen map[string]bool) bool {
+		for _, elem := range iface.Methods.List {
+			switch t := elem.Type.(type) {
+			case *ast.BinaryExpr, *ast.UnaryExpr:
+				// A union, like `~int | ~string`.
+				return true
+			case *ast.Ident:
+				if t.Name == "comparable" && interfaces[t.Name] == nil {
+					return true
+				}
+				if embedded := interfaces[t.Name]; embedded != nil && !seen[t.Name] {
+					seen[t.Name] = true
+					if isConstraint(embedded, seen) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+	for name, iface := range interfaces {
+		if isConstraint(iface, map[string]bool{name: true}) {
+			generic[name] = true
+		}
+	}
+	return generic
+}
+
+// genericReceiver reports whether the receiver type `recv` of a method is
+// that of a generic type, like `*List[T]`.
+func genericReceiver(recv ast.Expr) bool {
+	_, ok := unpointer(recv).(*ast.Ident)
+	return !ok
+}
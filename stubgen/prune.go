@@ -0,0 +1,183 @@
+package stubgen
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+
+	"golang.org/x/tools/imports"
+)
+
+// prune removes the unexported declarations of `f` that nothing exported
+// refers to, like placeholder types left behind when the symbols using them
+// were excluded, and the methods of the types it removes. It reports
+// whether it removed anything.
+func prune(fset *token.FileSet, f *ast.File) bool {
+	// The declarations of each top-level name, and the methods of each
+	// type; a method is declared by its receiver type.
+	byName := make(map[string][]ast.Node)
+	var roots []ast.Node
+	declare := func(node ast.Node, names ...*ast.Ident) {
+		root := false
+		for _, name := range names {
+			byName[name.Name] = append(byName[name.Name], node)
+			root = root || !prunable(name.Name)
+		}
+		if root {
+			roots = append(roots, node)
+		}
+	}
+	for _, decl := range f.Decls {
+		switch decl := decl.(type) {
+		case *ast.FuncDecl:
+			if decl.Recv != nil && len(decl.Recv.List) == 1 {
+				declare(decl, receiverName(decl.Recv.List[0].Type))
+			} else {
+				declare(decl, decl.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range decl.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					declare(spec, spec.Name)
+				case *ast.ValueSpec:
+					declare(spec, spec.Names...)
+				}
+			}
+		}
+	}
+
+	live := make(map[ast.Node]bool)
+	for len(roots) > 0 {
+		node := roots[len(roots)-1]
+		roots = roots[:len(roots)-1]
+		if live[node] {
+			continue
+		}
+		live[node] = true
+		// Names are compared regardless of scope, so a field or parameter
+		// named like an unexported declaration keeps it.
+		ast.Inspect(node, func(n ast.Node) bool {
+			if ident, ok := n.(*ast.Ident); ok {
+				roots = append(roots, byName[ident.Name]...)
+			}
+			return true
+		})
+	}
+
+	// The ranges of the removed declarations, with their comments.
+	var removed [][2]token.Pos
+	remove := func(node ast.Node) {
+		removed = append(removed, [2]token.Pos{declStart(node), node.End()})
+	}
+	decls := f.Decls[:0]
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok != token.IMPORT {
+			whole := [2]token.Pos{declStart(gen), gen.End()}
+			specs := gen.Specs[:0]
+			for _, spec := range gen.Specs {
+				if live[spec] {
+					specs = append(specs, spec)
+				} else {
+					remove(spec)
+				}
+			}
+			gen.Specs = specs
+			if len(specs) == 0 {
+				removed = append(removed, whole)
+				continue
+			}
+		} else if fn, ok := decl.(*ast.FuncDecl); ok && !live[fn] {
+			remove(fn)
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	f.Decls = decls
+	if len(removed) == 0 {
+		return false
+	}
+
+	// Drop the comments of the removed declarations, including those on
+	// their last line, which would otherwise be left in their place.
+	comments := f.Comments[:0]
+	for _, group := range f.Comments {
+		inRemoved := false
+		for _, r := range removed {
+			inRemoved = inRemoved || (group.Pos() >= r[0] &&
+				(group.End() <= r[1] || fset.Position(group.Pos()).Line == fset.Position(r[1]).Line))
+		}
+		if !inRemoved {
+			comments = append(comments, group)
+		}
+	}
+	f.Comments = comments
+	return true
+}
+
+// prunable reports whether the top-level name `name` may be removed if
+// nothing refers to it.
+func prunable(name string) bool {
+	return !ast.IsExported(name) && name != "_" && name != "init"
+}
+
+// receiverName returns the name of the type of the method receiver `typ`.
+func receiverName(typ ast.Expr) *ast.Ident {
+	for {
+		switch t := typ.(type) {
+		case *ast.StarExpr:
+			typ = t.X
+		case *ast.ParenExpr:
+			typ = t.X
+		case *ast.Ident:
+			return t
+		default:
+			if x := indexOperand(typ); x != nil {
+				// The receiver of a method of a generic type, like `List[T]`.
+				typ = x
+				continue
+			}
+			return &ast.Ident{Name: "_"}
+		}
+	}
+}
+
+// declStart returns the position of the declaration `node`, including its
+// doc comment.
+func declStart(node ast.Node) token.Pos {
+	var doc *ast.CommentGroup
+	switch node := node.(type) {
+	case *ast.FuncDecl:
+		doc = node.Doc
+	case *ast.GenDecl:
+		doc = node.Doc
+	case *ast.TypeSpec:
+		doc = node.Doc
+	case *ast.ValueSpec:
+		doc = node.Doc
+	}
+	if doc != nil {
+		return doc.Pos()
+	}
+	return node.Pos()
+}
+
+// pruned returns the formatted source `src` without the declarations prune
+// removes, and without the imports they alone used.
+func pruned(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	if !prune(fset, f) {
+		return src, nil
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return imports.Process("", buf.Bytes(), nil)
+}
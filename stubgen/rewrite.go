@@ -0,0 +1,55 @@
+package stubgen
+
+import (
+	"go/ast"
+	"reflect"
+)
+
+var (
+	exprType   = reflect.TypeOf((*ast.Expr)(nil)).Elem()
+	objectType = reflect.TypeOf((*ast.Object)(nil))
+	scopeType  = reflect.TypeOf((*ast.Scope)(nil))
+)
+
+// rewrite returns `expr`, or its replacement, with the expressions under it
+// replaced by `replace`. Like astutil.Apply, it calls `replace` on the
+// expressions from the root down, which returns either the expression or its
+// replacement, whose expressions aren't visited; names, like those of fields
+// and selected identifiers, aren't visited either. Unlike the vendored
+// astutil, it knows the nodes of generic code, like type parameter lists and
+// instantiations with several type arguments, as it walks the nodes with
+// reflection.
+func rewrite(expr ast.Expr, replace func(ast.Expr) ast.Expr) ast.Expr {
+	if replaced := replace(expr); replaced != expr {
+		return replaced
+	}
+	rewriteFields(reflect.ValueOf(expr), replace)
+	return expr
+}
+
+// rewriteFields rewrites the expressions under the node or list of nodes
+// `v` with `replace`.
+func rewriteFields(v reflect.Value, replace func(ast.Expr) ast.Expr) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() || v.Type() == objectType || v.Type() == scopeType {
+			// Objects and scopes refer back to the declarations.
+			return
+		}
+		if v.Type() == exprType && v.CanSet() {
+			v.Set(reflect.ValueOf(rewrite(v.Interface().(ast.Expr), replace)))
+			return
+		}
+		rewriteFields(v.Elem(), replace)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			rewriteFields(v.Index(i), replace)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				rewriteFields(v.Field(i), replace)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package stubgen
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/github/depstubber/model"
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/imports"
+)
+
+// StreamThreshold is the size of the unformatted source of a stub from
+// which it is better written with Stream than with Source.
+const StreamThreshold = 4 << 20
+
+// chunkSize is the size of the declarations Stream formats at once.
+const chunkSize = 256 << 10
+
+// Stream writes the formatted source of the stub of `pkg` to `w`, like
+// Generate. Instead of formatting the whole source at once, which takes
+// several times its size in memory for very large packages, the
+// declarations are formatted in chunks, which are spooled to a temporary
+// file until the imports they use are known. Unlike Source, Stream only
+// removes unused imports, never adds missing ones and doesn't prune.
+func (g *Generator) Stream(pkg *model.PackedPkg, w io.Writer) error {
+	if pkg.Body != "" {
+		// The source from an older reflection program can't be split.
+		return g.Generate(pkg, w)
+	}
+
+	spool, err := ioutil.TempFile("", "depstubber_stream_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	used := make(map[string]bool)
+	var chunk bytes.Buffer
+	first := true
+	flush := func() error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+		start := time.Now()
+		formatted, err := formatDecls(pkg.Name, chunk.Bytes(), used, g.UseAny)
+		g.addFormatTime(start)
+		if err != nil {
+			return err
+		}
+		if !first {
+			formatted = append([]byte("\n"), formatted...)
+		}
+		first = false
+		chunk.Reset()
+		_, err = spool.Write(formatted)
+		return err
+	}
+	for _, decl := range pkg.Decls {
+		chunk.WriteString(decl)
+		if chunk.Len() >= chunkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	head, err := g.head(pkg, used)
+	g.addFormatTime(start)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(head); err != nil {
+		return err
+	}
+	if !first {
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, spool)
+	return err
+}
+
+// formatDecls returns the formatted source of the declarations `decls` of
+// the package `name`, with `any` for the empty interface if `spellAny` is set,
+// and adds the names of the packages they refer to to `used`.
+func formatDecls(name string, decls []byte, used map[string]bool, spellAny bool) ([]byte, error) {
+	clause := "package " + name + "\n\n"
+	src := append([]byte(clause), decls...)
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, newOutputError(src, err)
+	}
+	ast.Inspect(f, func(node ast.Node) bool {
+		if sel, ok := node.(*ast.SelectorExpr); ok {
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Obj == nil {
+				used[ident.Name] = true
+			}
+		}
+		return true
+	})
+	if spellAny {
+		useAny(f)
+	}
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(buf.Bytes(), []byte(clause)), nil
+}
+
+// head returns the formatted header, package clause and imports of the
+// stub of `pkg`, keeping only the imports whose names are in `used`.
+func (g *Generator) head(pkg *model.PackedPkg, used map[string]bool) ([]byte, error) {
+	var buf bytes.Buffer
+	g.writeHeader(&buf)
+	buf.WriteString(pkg.Header)
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", buf.Bytes(), parser.ParseComments)
+	if err != nil {
+		return nil, newOutputError(buf.Bytes(), err)
+	}
+	// Deleting imports changes f.Imports.
+	specs := append([]*ast.ImportSpec(nil), f.Imports...)
+	for _, spec := range specs {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Name != nil && !used[spec.Name.Name] {
+			astutil.DeleteNamedImport(fset, f, spec.Name.Name, path)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := format.Node(&out, fset, f); err != nil {
+		return nil, err
+	}
+	// Sort and group the imports like Source does.
+	return imports.Process("", out.Bytes(), &imports.Options{FormatOnly: true, Comments: true, TabIndent: true, TabWidth: 8})
+}
@@ -0,0 +1,234 @@
+// Package stubgen writes the source of stubs from the model of a package
+// built by depstubber's reflection program.
+package stubgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/github/depstubber/model"
+	"golang.org/x/tools/imports"
+)
+
+// Generator writes the stub of a package. The fields other than UseAny and
+// Prune only affect the header of the stub.
+type Generator struct {
+	// Package is the import path of the stubbed package.
+	Package string
+
+	// Types, Values and Excluded are the symbols the stub was requested
+	// for, and the symbols that were left out.
+	Types, Values, Excluded []string
+
+	// CopyrightHeader is the license of the stubbed package, to be copied
+	// into the header; if empty, the header refers to the LICENSE file.
+	CopyrightHeader string
+
+	// LicenseExpression is the SPDX expression for the license of the
+	// stubbed package; may be empty.
+	LicenseExpression string
+
+	// ModuleSum is the path, version and go.sum hash of the module the stub
+	// was generated from, separated by spaces; may be empty.
+	ModuleSum string
+
+	// BuildConstraint is the expression of the //go:build line of the stub,
+	// like `linux`; may be empty.
+	BuildConstraint string
+
+	// LintDirectives are comment lines, like `//nolint:all`, written right
+	// before the package clause so that linters skip the stub.
+	LintDirectives []string
+
+	// UseAny spells the empty interface `any` rather than `interface{}`;
+	// the stub then requires Go 1.18.
+	UseAny bool
+
+	// Prune removes the unexported declarations that nothing exported in
+	// the stub refers to, and the imports only they used. Stream doesn't
+	// prune.
+	Prune bool
+
+	// FormatTime, if not nil, accumulates the time spent formatting the
+	// source of stubs.
+	FormatTime *time.Duration
+}
+
+// Source returns the formatted source of the stub of `pkg`. If the generated
+// source is invalid, the returned error is an *OutputError.
+func (g *Generator) Source(pkg *model.PackedPkg) ([]byte, error) {
+	var buf bytes.Buffer
+	g.writeHeader(&buf)
+	if _, err := pkg.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+
+	// Format source and add or remove import statements as necessary:
+	start := time.Now()
+	src, err := imports.Process("", buf.Bytes(), nil)
+	if err == nil && g.Prune {
+		src, err = pruned(src)
+	}
+	if err == nil && g.UseAny {
+		src, err = withAny(src)
+	}
+	g.addFormatTime(start)
+	if err != nil {
+		return nil, newOutputError(buf.Bytes(), err)
+	}
+	return src, nil
+}
+
+// addFormatTime adds the time since `start` to g.FormatTime.
+func (g *Generator) addFormatTime(start time.Time) {
+	if g.FormatTime != nil {
+		*g.FormatTime += time.Since(start)
+	}
+}
+
+// writeHeader writes the comments at the top of the stub to `buf`.
+func (g *Generator) writeHeader(buf *bytes.Buffer) {
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(buf, format+"\n", args...)
+	}
+
+	if g.BuildConstraint != "" {
+		p("//go:build %s", g.BuildConstraint)
+		p("// +build %s", g.BuildConstraint)
+		p("")
+	}
+
+	p("// Code generated by depstubber. DO NOT EDIT.")
+
+	p("// This is a simple stub for %s, strictly for use in testing.", g.Package)
+	p("")
+
+	if g.CopyrightHeader != "" {
+		p("// See the license below for information about the licensing of the original library.")
+		p("")
+
+		lines := strings.Split(g.CopyrightHeader, "\n")
+		for _, line := range lines {
+			p("// %s", line)
+		}
+		p("")
+	} else {
+		// if no copyright file was specified, assume there is a LICENSE file
+		p("// See the LICENSE file for information about the licensing of the original library.")
+	}
+	if g.LicenseExpression != "" {
+		p("// License of the original library (SPDX): %s", g.LicenseExpression)
+	}
+
+	if g.ModuleSum != "" {
+		p("// Module: %s", g.ModuleSum)
+	}
+
+	exports, functions := strings.Join(g.Types, ","), strings.Join(g.Values, ",")
+	if len(g.Excluded) > 0 {
+		p("// Source: %s (exports: %s; functions: %s; excluded: %s)", g.Package, exports, functions, strings.Join(g.Excluded, ","))
+	} else {
+		p("// Source: %s (exports: %s; functions: %s)", g.Package, exports, functions)
+	}
+	p("")
+
+	p("")
+
+	for _, directive := range g.LintDirectives {
+		p("%s", directive)
+	}
+}
+
+// Generate writes the formatted source of the stub of `pkg` to `w`. Nothing
+// is written if the generated source is invalid.
+func (g *Generator) Generate(pkg *model.PackedPkg, w io.Writer) error {
+	src, err := g.Source(pkg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// SourceError is a problem at a position of the generated source.
+type SourceError struct {
+	Pos    token.Position
+	Symbol string // the declaration containing Pos, if known
+	Msg    string
+}
+
+func (e *SourceError) Error() string {
+	if e.Symbol == "" {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s (in the declaration of %s)", e.Pos, e.Msg, e.Symbol)
+}
+
+// OutputError is returned when the generated source is not valid Go.
+type OutputError struct {
+	Errs   []error
+	Source []byte // the unformatted source
+
+	// InvalidFile is where the unformatted source was saved, if anywhere.
+	InvalidFile string
+}
+
+func (e *OutputError) Error() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("the generated source is invalid")
+	if e.InvalidFile != "" {
+		fmt.Fprintf(buf, " (the unformatted source was saved to %s)", e.InvalidFile)
+	}
+	buf.WriteString(":")
+	for _, err := range e.Errs {
+		buf.WriteString("\n - " + err.Error())
+	}
+	return buf.String()
+}
+
+// newOutputError collects the problems reported by `err` for the generated
+// source `src`, annotating each with the declaration it occurs in.
+func newOutputError(src []byte, err error) *OutputError {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return &OutputError{Errs: []error{err}, Source: src}
+	}
+
+	lines := strings.Split(string(src), "\n")
+	outErr := &OutputError{Source: src}
+	for _, e := range list {
+		outErr.Errs = append(outErr.Errs, &SourceError{
+			Pos:    e.Pos,
+			Symbol: enclosingDeclaration(lines, e.Pos.Line),
+			Msg:    e.Msg,
+		})
+	}
+	return outErr
+}
+
+var declarationRegex = regexp.MustCompile(`^(?:func|type|var|const)\s+(?:\(\w*\s*\*?(\w+)\)\s*)?(\w+)`)
+
+// enclosingDeclaration returns the name of the top-level declaration that
+// contains the 1-based line `line` of the source split into `lines`, with
+// methods named as `Type.Method`.
+func enclosingDeclaration(lines []string, line int) string {
+	if line > len(lines) {
+		line = len(lines)
+	}
+	for i := line - 1; i >= 0; i-- {
+		if m := declarationRegex.FindStringSubmatch(lines[i]); m != nil {
+			if m[1] != "" {
+				return m[1] + "." + m[2]
+			}
+			return m[2]
+		}
+	}
+	return ""
+}
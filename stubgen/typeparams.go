@@ -0,0 +1,28 @@
+//go:build go1.18
+// +build go1.18
+
+package stubgen
+
+import "go/ast"
+
+// typeParams returns the type parameters of the type declared by `spec`.
+func typeParams(spec *ast.TypeSpec) *ast.FieldList {
+	return spec.TypeParams
+}
+
+// funcTypeParams returns the type parameters of the function type `fn`.
+func funcTypeParams(fn *ast.FuncType) *ast.FieldList {
+	return fn.TypeParams
+}
+
+// indexOperand returns the generic type of the instantiation `expr`, like
+// `List` in `List[T]` or `Map` in `Map[K, V]`, or nil if it isn't one.
+func indexOperand(expr ast.Expr) ast.Expr {
+	switch expr := expr.(type) {
+	case *ast.IndexExpr:
+		return expr.X
+	case *ast.IndexListExpr:
+		return expr.X
+	}
+	return nil
+}
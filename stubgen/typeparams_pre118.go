@@ -0,0 +1,25 @@
+//go:build !go1.18
+// +build !go1.18
+
+package stubgen
+
+import "go/ast"
+
+// typeParams returns nil: before Go 1.18 there are no type parameters.
+func typeParams(spec *ast.TypeSpec) *ast.FieldList {
+	return nil
+}
+
+// funcTypeParams returns nil: before Go 1.18 there are no type parameters.
+func funcTypeParams(fn *ast.FuncType) *ast.FieldList {
+	return nil
+}
+
+// indexOperand returns the operand of the index expression `expr`, or nil
+// if it isn't one.
+func indexOperand(expr ast.Expr) ast.Expr {
+	if expr, ok := expr.(*ast.IndexExpr); ok {
+		return expr.X
+	}
+	return nil
+}
@@ -0,0 +1,594 @@
+package main
+
+// This file contains the validation of requested symbols against the
+// exported identifiers of the package being stubbed.
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/github/depstubber/autodetect"
+	"golang.org/x/tools/go/packages"
+)
+
+// packageSymbols holds the exported package-level identifiers of a package.
+type packageSymbols struct {
+	path  string
+	scope *types.Scope
+
+	// bodyless holds the functions declared without a body, which are
+	// implemented in assembly or with go:linkname.
+	bodyless map[string]bool
+
+	// deprecated holds the deprecation notices of the symbols, with methods
+	// named as `Type.Method`.
+	deprecated map[string]string
+}
+
+// loadPackageSymbols type-checks the package with the given import path,
+// resolving it from `dir`, and returns its exported identifiers.
+func loadPackageSymbols(ctx context.Context, importPath string, dir string) (*packageSymbols, error) {
+	config := &packages.Config{
+		Context: ctx,
+		Mode:    packages.NeedName | packages.NeedTypes | packages.NeedSyntax,
+		Dir:     dir,
+		Env:     childEnv(),
+	}
+	if currentLocalSource != nil && dir == currentLocalSource.loadDir {
+		// The go.sum of the copy lacks the dependencies of the local module.
+		config.BuildFlags = []string{"-mod=mod"}
+	}
+
+	pkgs, err := packages.Load(config, importPath)
+	if err != nil {
+		return nil, fmt.Errorf("error while running packages.Load: %s", err)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("expected exactly one package for %s, got %d", importPath, len(pkgs))
+	}
+	pkg := pkgs[0]
+	if loadErr := autodetect.PackageErrors(pkg, dir); loadErr != nil {
+		return nil, fmt.Errorf("error while loading %s: %s", importPath, loadErr)
+	} else if pkg.Types == nil {
+		return nil, fmt.Errorf("error while loading %s: no type information", importPath)
+	}
+
+	bodyless := make(map[string]bool)
+	deprecated := make(map[string]string)
+	addDeprecated := func(name string, docs ...*ast.CommentGroup) {
+		for _, doc := range docs {
+			if notice := deprecationNotice(doc); notice != "" {
+				deprecated[name] = notice
+				return
+			}
+		}
+	}
+	for _, f := range pkg.Syntax {
+		for _, decl := range f.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil {
+					if decl.Body == nil {
+						bodyless[decl.Name.Name] = true
+					}
+					addDeprecated(decl.Name.Name, decl.Doc)
+				} else if recv := receiverTypeName(decl.Recv); recv != "" {
+					addDeprecated(recv+"."+decl.Name.Name, decl.Doc)
+				}
+			case *ast.GenDecl:
+				// A notice on a group of declarations applies to all of them.
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						addDeprecated(spec.Name.Name, spec.Doc, decl.Doc)
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							addDeprecated(name.Name, spec.Doc, decl.Doc)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return &packageSymbols{
+		path:       pkg.PkgPath,
+		scope:      pkg.Types.Scope(),
+		bodyless:   bodyless,
+		deprecated: deprecated,
+	}, nil
+}
+
+// deprecationNotice returns the paragraph of the doc comment `doc` that
+// starts with "Deprecated: ", or "" if there is none.
+func deprecationNotice(doc *ast.CommentGroup) string {
+	if doc == nil {
+		return ""
+	}
+	for _, paragraph := range strings.Split(doc.Text(), "\n\n") {
+		if strings.HasPrefix(paragraph, "Deprecated: ") {
+			return strings.TrimSpace(paragraph)
+		}
+	}
+	return ""
+}
+
+// receiverTypeName returns the name of the type of the receiver `recv`, or
+// "" if it can't be told.
+func receiverTypeName(recv *ast.FieldList) string {
+	if len(recv.List) != 1 {
+		return ""
+	}
+	typ := recv.List[0].Type
+	if star, ok := typ.(*ast.StarExpr); ok {
+		typ = star.X
+	}
+	if x := indexOperand(typ); x != nil {
+		typ = x
+	}
+	if ident, ok := typ.(*ast.Ident); ok {
+		return ident.Name
+	}
+	return ""
+}
+
+// names returns the sorted exported identifiers of the package.
+func (ps *packageSymbols) names() []string {
+	names := make([]string, 0)
+	for _, name := range ps.scope.Names() {
+		if ps.scope.Lookup(name).Exported() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// wildcardSymbol stands for all exported symbols of the relevant kind.
+const wildcardSymbol = "*"
+
+// isSymbolPattern reports whether `name` selects several symbols: it is
+// either the wildcard, or a regular expression enclosed in slashes
+// (e.g. `/^New.*/`).
+func isSymbolPattern(name string) bool {
+	return name == wildcardSymbol || (len(name) >= 2 && strings.HasPrefix(name, "/") && strings.HasSuffix(name, "/"))
+}
+
+func hasSymbolPatterns(names []string) bool {
+	for _, name := range names {
+		if isSymbolPattern(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileSymbolPattern returns the regular expression that matches the
+// symbols selected by the pattern `name`.
+func compileSymbolPattern(name string) (*regexp.Regexp, error) {
+	if name == wildcardSymbol {
+		return regexp.MustCompile(``), nil
+	}
+	re, err := regexp.Compile(name[1 : len(name)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid symbol pattern %s: %s", name, err)
+	}
+	return re, nil
+}
+
+// expand replaces the patterns in `typeNames` and `valueNames` with the
+// matching exported types and the matching exported functions, variables
+// and constants of the package, respectively. If `match` is not empty, all
+// exported symbols matching that regular expression are selected as well.
+// Excluded symbols are left out.
+func (ps *packageSymbols) expand(typeNames []string, valueNames []string, match string) ([]string, []string, error) {
+	var allTypes, allValues []string
+	for _, name := range ps.names() {
+		if _, ok := ps.scope.Lookup(name).(*types.TypeName); ok {
+			allTypes = append(allTypes, name)
+		} else {
+			allValues = append(allValues, name)
+		}
+	}
+
+	expandList := func(names []string, all []string) ([]string, error) {
+		if match != "" {
+			names = append(names, "/"+match+"/")
+		}
+		result := make([]string, 0, len(names))
+		for _, name := range names {
+			if !isSymbolPattern(name) {
+				result = append(result, name)
+				continue
+			}
+			re, err := compileSymbolPattern(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range all {
+				if re.MatchString(candidate) {
+					result = append(result, candidate)
+				}
+			}
+		}
+		return removeExcluded(DeduplicateStrings(result)), nil
+	}
+
+	expandedTypes, err := expandList(typeNames, allTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+	expandedValues, err := expandList(valueNames, allValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return expandedTypes, expandedValues, nil
+}
+
+// removeExcluded returns a new slice without the symbols listed
+// in the -exclude_symbols flag.
+func removeExcluded(names []string) []string {
+	excluded := make(map[string]bool)
+	for _, name := range split(*excludeSymbols) {
+		excluded[strings.TrimSpace(name)] = true
+	}
+
+	result := []string{}
+	for _, name := range names {
+		if !excluded[name] {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// validate checks that all `typeNames` are exported types, and that all
+// `valueNames` are exported functions, variables or constants of the package.
+func (ps *packageSymbols) validate(typeNames []string, valueNames []string) error {
+	var errs []error
+	for _, name := range typeNames {
+		name, method := splitMethodSelection(name)
+		switch obj := ps.scope.Lookup(name).(type) {
+		case *types.TypeName:
+			if !obj.Exported() && method == "" {
+				errs = append(errs, ps.unknownSymbol(name))
+			} else if method != "" {
+				if err := ps.validateMethod(obj, method); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		case nil:
+			errs = append(errs, ps.unknownSymbol(name))
+		default:
+			errs = append(errs, fmt.Errorf("%s.%s is a %s, not a type; list it with the functions and variables", ps.path, name, objectKind(obj)))
+		}
+	}
+	for _, name := range valueNames {
+		switch obj := ps.scope.Lookup(name).(type) {
+		case *types.Func, *types.Var, *types.Const:
+			if !obj.Exported() {
+				errs = append(errs, ps.unknownSymbol(name))
+			}
+		case nil:
+			errs = append(errs, ps.unknownSymbol(name))
+		default:
+			errs = append(errs, fmt.Errorf("%s.%s is a %s, not a function or variable; list it with the types", ps.path, name, objectKind(obj)))
+		}
+	}
+	return CombineErrors(errs...)
+}
+
+// available returns the `names` of types, or of types and methods, functions,
+// variables and constants, that the package declares. Symbol patterns are
+// kept.
+func (ps *packageSymbols) available(names []string) []string {
+	result := []string{}
+	for _, name := range names {
+		typeName, _ := splitMethodSelection(name)
+		if isSymbolPattern(name) || ps.scope.Lookup(typeName) != nil {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// validateMethod checks that the type `obj` (or a pointer to it) has an
+// exported method named `method`.
+func (ps *packageSymbols) validateMethod(obj *types.TypeName, method string) error {
+	if found, _, _ := types.LookupFieldOrMethod(obj.Type(), true, obj.Pkg(), method); found != nil {
+		if _, ok := found.(*types.Func); ok && found.Exported() {
+			return nil
+		}
+	}
+
+	methodSet := types.NewMethodSet(types.NewPointer(obj.Type()))
+	methods := make([]string, 0, methodSet.Len())
+	for i := 0; i < methodSet.Len(); i++ {
+		if name := methodSet.At(i).Obj().Name(); token.IsExported(name) {
+			methods = append(methods, name)
+		}
+	}
+
+	msg := fmt.Sprintf("%s.%s has no exported method named %q", ps.path, obj.Name(), method)
+	if suggestions := closeMatches(method, methods); len(suggestions) > 0 {
+		msg += fmt.Sprintf("; did you mean '%s'?", strings.Join(suggestions, "', '"))
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func (ps *packageSymbols) unknownSymbol(name string) error {
+	msg := fmt.Sprintf("%s does not export a symbol named %q", ps.path, name)
+	if suggestions := ps.suggest(name); len(suggestions) > 0 {
+		msg += fmt.Sprintf("; did you mean '%s'?", strings.Join(suggestions, "', '"))
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// maxSuggestions is the maximum number of close matches suggested for an
+// unknown symbol.
+const maxSuggestions = 3
+
+// suggest returns the exported identifiers of the package that are close
+// matches for `name`, closest first.
+func (ps *packageSymbols) suggest(name string) []string {
+	return closeMatches(name, ps.names())
+}
+
+// closeMatches returns the elements of `names` that are close matches
+// for `name`, closest first.
+func closeMatches(name string, names []string) []string {
+	type candidate struct {
+		name     string
+		distance int
+	}
+
+	// Allow more edits for longer names, but never so many that
+	// every short identifier matches.
+	maxDistance := len(name) / 3
+	if maxDistance < 2 {
+		maxDistance = 2
+	}
+
+	candidates := make([]candidate, 0)
+	for _, other := range names {
+		distance := levenshtein(strings.ToLower(name), strings.ToLower(other))
+		if distance <= maxDistance {
+			candidates = append(candidates, candidate{other, distance})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	suggestions := make([]string, 0)
+	for i := 0; i < len(candidates) && i < maxSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+	return suggestions
+}
+
+// objectKind returns a human-readable description of the kind of `obj`.
+func objectKind(obj types.Object) string {
+	switch obj.(type) {
+	case *types.TypeName:
+		return "type"
+	case *types.Func:
+		return "function"
+	case *types.Var:
+		return "variable"
+	case *types.Const:
+		return "constant"
+	default:
+		return "symbol"
+	}
+}
+
+// selectedType is a type to stub, optionally restricted to some
+// of its methods.
+type selectedType struct {
+	Name    string
+	Methods []string // nil if all methods are selected
+
+	// Placeholder is set for unexported types, which are stubbed as local
+	// types with only the selected methods where they are used.
+	Placeholder bool
+}
+
+// splitMethodSelection splits a `Type.Method` selection into the type name
+// and the method name. The method name is empty for plain type names.
+func splitMethodSelection(name string) (string, string) {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// selectTypes groups `typeNames`, which may contain `Type.Method`
+// selections, by type. A type that is also listed on its own has all
+// of its methods selected.
+func selectTypes(typeNames []string) []selectedType {
+	selected := make([]selectedType, 0, len(typeNames))
+	index := make(map[string]int)
+	for _, name := range typeNames {
+		name, method := splitMethodSelection(name)
+
+		i, ok := index[name]
+		if !ok {
+			i = len(selected)
+			index[name] = i
+			selected = append(selected, selectedType{
+				Name:        name,
+				Methods:     []string{},
+				Placeholder: !token.IsExported(name),
+			})
+		}
+
+		if method == "" {
+			selected[i].Methods = nil
+		} else if selected[i].Methods != nil {
+			selected[i].Methods = append(selected[i].Methods, method)
+		}
+	}
+	return selected
+}
+
+// constantValue is a constant to stub, with its exact value.
+type constantValue struct {
+	Name  string
+	Value string // Go source literal of the value
+	Typed bool
+}
+
+// constants splits `valueNames` into the constants of the package, in the
+// order they are declared in, and the remaining names.
+func (ps *packageSymbols) constants(valueNames []string) ([]constantValue, []string) {
+	var consts []*types.Const
+	rest := make([]string, 0, len(valueNames))
+	for _, name := range valueNames {
+		if c, ok := ps.scope.Lookup(name).(*types.Const); ok {
+			consts = append(consts, c)
+		} else {
+			rest = append(rest, name)
+		}
+	}
+	sort.SliceStable(consts, func(i, j int) bool {
+		return consts[i].Pos() < consts[j].Pos()
+	})
+
+	values := make([]constantValue, 0, len(consts))
+	for _, c := range consts {
+		basic, isBasic := c.Type().(*types.Basic)
+		values = append(values, constantValue{
+			Name:  c.Name(),
+			Value: constantLiteral(c.Val()),
+			Typed: !isBasic || basic.Info()&types.IsUntyped == 0,
+		})
+	}
+	return values, rest
+}
+
+// constantLiteral returns a Go literal for the constant value `val`.
+func constantLiteral(val constant.Value) string {
+	if val.Kind() != constant.Float {
+		return val.ExactString()
+	}
+
+	f, _ := constant.Float64Val(val)
+	lit := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(lit, ".eE") {
+		// Keep untyped float constants floating-point.
+		lit += ".0"
+	}
+	return lit
+}
+
+// signatureValue is a function stubbed from its signature alone, without
+// referring to the function itself in the reflection program.
+type signatureValue struct {
+	Name string
+	Type string // Go source of the function type
+
+	// UsesPackage is set if the type refers to the stubbed package.
+	UsesPackage bool
+}
+
+// signatureImport is a package imported by the reflection program for the
+// types of signatureValues.
+type signatureImport struct {
+	Name string
+	Path string
+}
+
+// signatures splits `valueNames` into the functions declared without a body,
+// whose reflection can fail to link, and the remaining names. Functions whose
+// types can't be written in another package are left to the reflection.
+func (ps *packageSymbols) signatures(valueNames []string) ([]signatureValue, []signatureImport, []string) {
+	var sigs []signatureValue
+	var imports []signatureImport
+	importNames := make(map[string]string)
+	rest := make([]string, 0, len(valueNames))
+	for _, name := range valueNames {
+		fn, ok := ps.scope.Lookup(name).(*types.Func)
+		if !ok || !ps.bodyless[name] || !nameable(fn.Type(), make(map[types.Type]bool)) {
+			rest = append(rest, name)
+			continue
+		}
+
+		sig := signatureValue{Name: name}
+		sig.Type = types.TypeString(fn.Type(), func(p *types.Package) string {
+			if p.Path() == ps.path {
+				sig.UsesPackage = true
+				return "pkg_"
+			}
+			if _, ok := importNames[p.Path()]; !ok {
+				importNames[p.Path()] = fmt.Sprintf("dep_%d", len(imports))
+				imports = append(imports, signatureImport{importNames[p.Path()], p.Path()})
+			}
+			return importNames[p.Path()]
+		})
+		sigs = append(sigs, sig)
+	}
+	return sigs, imports, rest
+}
+
+// nameable reports whether the type `t` can be written in another package.
+func nameable(t types.Type, seen map[types.Type]bool) bool {
+	if seen[t] {
+		return true
+	}
+	seen[t] = true
+
+	switch t := t.(type) {
+	case *types.Basic:
+		return t.Kind() != types.UnsafePointer && t.Info()&types.IsUntyped == 0
+	case *types.Named:
+		obj := t.Obj()
+		if obj.Pkg() == nil {
+			// The predeclared error type.
+			return true
+		}
+		return obj.Exported() && obj.Parent() == obj.Pkg().Scope()
+	case *types.Pointer:
+		return nameable(t.Elem(), seen)
+	case *types.Slice:
+		return nameable(t.Elem(), seen)
+	case *types.Array:
+		return nameable(t.Elem(), seen)
+	case *types.Map:
+		return nameable(t.Key(), seen) && nameable(t.Elem(), seen)
+	case *types.Chan:
+		return nameable(t.Elem(), seen)
+	case *types.Signature:
+		return nameable(t.Params(), seen) && nameable(t.Results(), seen)
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			if !nameable(t.At(i).Type(), seen) {
+				return false
+			}
+		}
+		return true
+	case *types.Struct:
+		for i := 0; i < t.NumFields(); i++ {
+			if !t.Field(i).Exported() || !nameable(t.Field(i).Type(), seen) {
+				return false
+			}
+		}
+		return true
+	case *types.Interface:
+		for i := 0; i < t.NumMethods(); i++ {
+			if !t.Method(i).Exported() || !nameable(t.Method(i).Type(), seen) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// This file contains the handling of the tool directives of go.mod files,
+// added in Go 1.24, which the version of the modfile package depstubber is
+// built with doesn't know.
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// parseModFile parses the go.mod file `filename` with contents `data`. The
+// tool directives are left out of the result, and their packages returned
+// separately.
+func parseModFile(filename string, data []byte) (*modfile.File, []string, error) {
+	data, tools := cutToolDirectives(data)
+	file, err := modfile.Parse(filename, data, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, tools, nil
+}
+
+// formatModFile returns the formatted `file`, followed by the tool
+// directives of the packages `tools`.
+func formatModFile(file *modfile.File, tools []string) ([]byte, error) {
+	data, err := file.Format()
+	if err != nil || len(tools) == 0 {
+		return data, err
+	}
+	buf := bytes.NewBuffer(data)
+	buf.WriteString("\ntool (\n")
+	for _, tool := range tools {
+		fmt.Fprintf(buf, "\t%s\n", tool)
+	}
+	buf.WriteString(")\n")
+	return buf.Bytes(), nil
+}
+
+// cutToolDirectives returns the go.mod file `data` with the lines of its
+// tool directives, single or in blocks, blanked out, and the packages they
+// list.
+func cutToolDirectives(data []byte) ([]byte, []string) {
+	lines := strings.Split(string(data), "\n")
+	var tools []string
+	inBlock, inOtherBlock := false, false
+	for i, line := range lines {
+		code := line
+		if j := strings.Index(code, "//"); j >= 0 {
+			code = code[:j]
+		}
+		fields := strings.Fields(code)
+		switch {
+		case inOtherBlock:
+			// Like `require (`, whose lines may start with a module `tool`.
+			inOtherBlock = len(fields) != 1 || fields[0] != ")"
+			continue
+		case inBlock:
+			if len(fields) == 1 && fields[0] == ")" {
+				inBlock = false
+			} else if len(fields) == 1 {
+				tools = append(tools, unquoteToolPath(fields[0]))
+			}
+		case strings.Join(fields, "") == "tool(":
+			inBlock = true
+		case len(fields) > 0 && strings.HasSuffix(fields[len(fields)-1], "("):
+			inOtherBlock = true
+			continue
+		case len(fields) == 2 && fields[0] == "tool":
+			tools = append(tools, unquoteToolPath(fields[1]))
+		default:
+			continue
+		}
+		lines[i] = ""
+	}
+	return []byte(strings.Join(lines, "\n")), tools
+}
+
+// unquoteToolPath returns the package path `path` of a tool directive
+// without quotes.
+func unquoteToolPath(path string) string {
+	if unquoted, err := strconv.Unquote(path); err == nil {
+		return unquoted
+	}
+	return path
+}
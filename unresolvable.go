@@ -0,0 +1,112 @@
+package main
+
+// This file contains the handling of dependencies that can't be resolved,
+// like private modules without credentials, retracted or deleted versions,
+// and modules that can't be downloaded without network access.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+var skipUnresolvable = flag.Bool("skip_unresolvable", false, "Skip the packages whose modules can't be downloaded, like private modules without credentials, instead of failing; they are listed in the summary and recorded as unresolved in the lockfile.")
+
+// unresolvableError is returned when the reflection program of a package
+// can't be built because the module of the package can't be downloaded.
+type unresolvableError struct {
+	Package string
+	Reason  string
+	Hint    string
+}
+
+func (e *unresolvableError) Error() string {
+	return fmt.Sprintf("the module of %s can't be resolved, as %s. %s, or pass -skip_unresolvable to stub the other packages",
+		e.Package, e.Reason, e.Hint)
+}
+
+// unresolvableCauses are the messages of the go command for modules it
+// can't download, with the reason they are reported with and the guidance
+// on fixing them.
+var unresolvableCauses = []struct {
+	messages []string
+	reason   string
+	hint     string
+}{
+	{
+		messages: []string{"terminal prompts disabled", "could not read Username", "could not read Password", "Authentication failed", "401 Unauthorized", "403 Forbidden", "netrc"},
+		reason:   "authentication failed",
+		hint:     "Check the credentials for the host in ~/.netrc or the program GIT_ASKPASS names, set GOPRIVATE to the module path so that it isn't fetched from the proxy, then run depstubber again",
+	},
+	{
+		messages: []string{"410 Gone", "404 Not Found", "unknown revision", "invalid version", "no matching versions", "repository not found"},
+		reason:   "its version is not available",
+		hint:     "Check that the version in go.mod still exists, or require one that does, then run depstubber again",
+	},
+	{
+		messages: []string{"dial tcp", "i/o timeout", "no such host", "connection refused", "TLS handshake timeout", "GOPROXY=off"},
+		reason:   "it can't be downloaded",
+		hint:     "Check the network access to GOPROXY, or download the module into the module cache with 'go mod download' where the network is available, then run depstubber again",
+	},
+}
+
+// unresolvableBuild returns the error for the failed build of the
+// reflection program of `pkgPath` if the output of the go command, `output`,
+// shows that the module of the package can't be resolved, or nil.
+func unresolvableBuild(pkgPath string, output string) *unresolvableError {
+	for _, cause := range unresolvableCauses {
+		for _, message := range cause.messages {
+			if strings.Contains(output, message) {
+				return &unresolvableError{Package: pkgPath, Reason: cause.reason, Hint: cause.hint}
+			}
+		}
+	}
+	return nil
+}
+
+// unresolvedPackage records a package that was skipped with
+// -skip_unresolvable.
+type unresolvedPackage struct {
+	Package string `json:"package"`
+	Reason  string `json:"reason"`
+}
+
+// unresolvedPackages holds the packages skipped during this run.
+var unresolvedPackages []unresolvedPackage
+
+// skipUnresolved records the package of `err` as unresolved and reports
+// true if it is an unresolvableError and -skip_unresolvable is set.
+func skipUnresolved(err error) bool {
+	unresolved, ok := err.(*unresolvableError)
+	if !ok || !*skipUnresolvable {
+		return false
+	}
+	log.Printf("WARNING: skipping %s, as its module can't be resolved: %s", unresolved.Package, unresolved.Reason)
+	unresolvedPackages = append(unresolvedPackages, unresolvedPackage{Package: unresolved.Package, Reason: unresolved.Reason})
+	return true
+}
+
+// mergeUnresolved returns the unresolved packages of the lockfile `earlier`
+// with those of this run, without the packages stubbed in this run.
+func mergeUnresolved(earlier []unresolvedPackage) []unresolvedPackage {
+	byPackage := make(map[string]unresolvedPackage)
+	for _, unresolved := range earlier {
+		byPackage[unresolved.Package] = unresolved
+	}
+	for _, unresolved := range unresolvedPackages {
+		byPackage[unresolved.Package] = unresolved
+	}
+	for _, locked := range lockedPackages {
+		delete(byPackage, locked.Package)
+	}
+	merged := make([]unresolvedPackage, 0, len(byPackage))
+	for _, unresolved := range byPackage {
+		merged = append(merged, unresolved)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		return merged[i].Package < merged[j].Package
+	})
+	return merged
+}
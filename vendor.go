@@ -4,24 +4,57 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	neturl "net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"golang.org/x/mod/modfile"
 	"golang.org/x/mod/module"
 	"golang.org/x/mod/semver"
 )
 
+var (
+	moduleRoot = flag.String("module_root", "", "Root directory of the module whose vendor directory, lockfile and modules.txt are written; defaults to the module the go command selects for the current directory.")
+	strict     = flag.Bool("strict", false, "Fail instead of warning when stubs of the vendor directory were generated from other module versions than go.mod requires.")
+)
+
 func findModuleRoot(dir string) (root string) {
 	if dir == "" {
 		log.Fatal("dir not set")
 	}
 
+	nearest := nearestModuleRoot(realDir(dir))
+	if selected, wdNearest := selectModuleRoot(); selected != "" && nearest == wdNearest {
+		// `dir` is in the same module as the current directory.
+		return selected
+	}
+	return nearest
+}
+
+// realDir returns the cleaned `dir` with the symlinks resolved, as the go
+// commands run by depstubber see it, so that the vendor directory ends up in
+// the real module root even if it is reached through symlinks.
+func realDir(dir string) string {
 	dir = filepath.Clean(dir)
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return dir
+}
 
+// nearestModuleRoot returns the nearest directory containing a go.mod file
+// among `dir` and its parents, or "" if there is none.
+func nearestModuleRoot(dir string) string {
 	// Look for enclosing go.mod.
 	for {
 		if fi, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil && !fi.IsDir() {
@@ -38,17 +71,333 @@ func findModuleRoot(dir string) (root string) {
 }
 
 func loadModFile(filename string) *modfile.File {
+	file, _ := loadModFileTools(filename)
+	return file
+}
+
+// loadModFileTools is like loadModFile, but also returns the packages of
+// the tool directives of the go.mod file.
+func loadModFileTools(filename string) (*modfile.File, []string) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		panic(err)
 	}
 
-	file, err := modfile.Parse(filename, data, nil)
+	file, tools, err := parseModFile(filename, data)
 	if err != nil {
 		panic(err)
 	}
 
-	return file
+	return file, tools
+}
+
+// copyGoMod copies the go.mod file of the module in `modRoot` to the
+// directory `dir`, with the directories of replacements made absolute so
+// that they still refer to the same modules from there.
+func copyGoMod(modRoot string, dir string) error {
+	path := filepath.Join(modRoot, "go.mod")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	file, tools, err := parseModFile(path, data)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, r := range file.Replace {
+		if r.New.Version != "" || !modfile.IsDirectoryPath(r.New.Path) || filepath.IsAbs(r.New.Path) {
+			continue
+		}
+		abs := filepath.Join(modRoot, filepath.FromSlash(r.New.Path))
+		if err := file.AddReplace(r.Old.Path, r.Old.Version, abs, ""); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		if data, err = formatModFile(file, tools); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "go.mod"), data, 0644)
+}
+
+// copyGoSum copies the go.sum file of the module in `modRoot`, if any, into
+// `dir`.
+func copyGoSum(modRoot string, dir string) error {
+	data, err := ioutil.ReadFile(filepath.Join(modRoot, "go.sum"))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "go.sum"), data, 0644)
+}
+
+// moduleSum identifies the version of a module stubs were generated from.
+type moduleSum struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"` // the hash in go.sum
+
+	// Replace is the directory replacing the module, which has no hash.
+	Replace string `json:"replace,omitempty"`
+}
+
+func (m *moduleSum) String() string {
+	if m.Replace != "" {
+		return fmt.Sprintf("%s %s => %s", m.Path, m.Version, m.Replace)
+	}
+	return fmt.Sprintf("%s %s %s", m.Path, m.Version, m.Sum)
+}
+
+// purl returns the package URL of the module version, like
+// `pkg:golang/github.com/my/module@v1.2.3`, or "" if the version is unknown.
+func (m *moduleSum) purl() string {
+	if m.Version == "" {
+		return ""
+	}
+	segments := strings.Split(m.Path, "/")
+	for i, segment := range segments {
+		segments[i] = neturl.PathEscape(segment)
+	}
+	return "pkg:golang/" + strings.Join(segments, "/") + "@" + neturl.PathEscape(m.Version)
+}
+
+// registryURL returns the page of the module version on deps.dev, or "" if
+// the version is unknown.
+func (m *moduleSum) registryURL() string {
+	if m.Version == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s/go/%s/%s", depsDevHost, neturl.PathEscape(m.Path), neturl.PathEscape(m.Version))
+}
+
+// requiredModule returns the module required by `modFile` that provides
+// `pkgPath`, or the zero module.Version if there is none.
+func requiredModule(modFile *modfile.File, pkgPath string) module.Version {
+	var mod module.Version
+	for _, r := range modFile.Require {
+		if (pkgPath == r.Mod.Path || strings.HasPrefix(pkgPath, r.Mod.Path+"/")) && len(r.Mod.Path) > len(mod.Path) {
+			mod = r.Mod
+		}
+	}
+	return mod
+}
+
+// excluded reports whether `modFile` excludes the version `mod`.
+func excluded(modFile *modfile.File, mod module.Version) bool {
+	for _, x := range modFile.Exclude {
+		if x.Mod == mod {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotExcluded returns an error if the go.mod of the module in `modRoot`
+// requires a version of the module providing `pkgPath` that it also
+// excludes: the go command never selects that version, so the stub would
+// not be of the requested one.
+func checkNotExcluded(modRoot string, pkgPath string) error {
+	if modRoot == "" {
+		return nil
+	}
+	modFile := loadModFile(filepath.Join(modRoot, "go.mod"))
+	if mod := requiredModule(modFile, pkgPath); mod.Path != "" && excluded(modFile, mod) {
+		return fmt.Errorf("go.mod requires %s %s, which it also excludes; require a version that is not excluded", mod.Path, mod.Version)
+	}
+	return nil
+}
+
+// resolvedModule returns the module version providing `pkgPath` in the build
+// list of `modFile`, after replacements, or the required module and the
+// directory replacing it.
+func resolvedModule(modFile *modfile.File, pkgPath string) (module.Version, string) {
+	mod := requiredModule(modFile, pkgPath)
+	if mod.Path == "" {
+		return mod, ""
+	}
+	for _, r := range modFile.Replace {
+		if r.Old.Path == mod.Path && (r.Old.Version == "" || r.Old.Version == mod.Version) {
+			if r.New.Version == "" {
+				return mod, r.New.Path
+			}
+			mod = r.New
+		}
+	}
+	return mod, ""
+}
+
+// checkStubVersions warns, or fails with -strict, about the stubs of the
+// vendor directory of the module in `modRoot` that were generated from
+// another module, or an older version of their module than go.mod requires.
+// A later version may be the one the build selected. The stubs written
+// during this run are not checked.
+func checkStubVersions(modRoot string) error {
+	if modRoot == "" {
+		return nil
+	}
+	recorded, err := recordedPackages(modRoot)
+	if err != nil {
+		return nil
+	}
+	written := make(map[string]bool)
+	for _, action := range recordedActions {
+		written[action.Package] = true
+	}
+	modFile := loadModFile(filepath.Join(modRoot, "go.mod"))
+
+	var conflicts []error
+	for _, pkg := range recorded {
+		stubbed := pkg.Module
+		if stubbed == nil || stubbed.Replace != "" || written[pkg.Package] {
+			continue
+		}
+		required, replaceDir := resolvedModule(modFile, pkg.Package)
+		if required.Path == "" || replaceDir != "" || (required.Path == stubbed.Path && semver.Compare(stubbed.Version, required.Version) >= 0) {
+			continue
+		}
+		err := fmt.Errorf("the stub of %s was generated from %s %s, but go.mod requires %s %s; regenerate it with `depstubber vendor -only %s`",
+			pkg.Package, stubbed.Path, stubbed.Version, required.Path, required.Version, pkg.Package)
+		if !*strict {
+			log.Printf("WARNING: %v", err)
+		}
+		conflicts = append(conflicts, err)
+	}
+	if *strict {
+		return CombineErrors(conflicts...)
+	}
+	return nil
+}
+
+// lookupModuleSum returns the module providing `pkgPath` in the module in
+// `modRoot`, with its hash in go.sum or the directory replacing it, or nil
+// if neither is recorded.
+func lookupModuleSum(modRoot string, pkgPath string) *moduleSum {
+	if modRoot == "" {
+		return nil
+	}
+	modFile := loadModFile(filepath.Join(modRoot, "go.mod"))
+
+	mod, replaceDir := resolvedModule(modFile, pkgPath)
+	if mod.Path == "" {
+		return nil
+	}
+	if replaceDir != "" {
+		return &moduleSum{Path: mod.Path, Version: mod.Version, Replace: replaceDir}
+	}
+
+	if sum := goSumHash(modRoot, mod); sum != "" {
+		return &moduleSum{Path: mod.Path, Version: mod.Version, Sum: sum}
+	}
+	return nil
+}
+
+// goSumHash returns the hash of the module version `mod` in the go.sum file
+// of the module in `modRoot`, or "" if it has none.
+func goSumHash(modRoot string, mod module.Version) string {
+	data, err := ioutil.ReadFile(filepath.Join(modRoot, "go.sum"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == mod.Path && fields[1] == mod.Version {
+			return fields[2]
+		}
+	}
+	return ""
+}
+
+// buildModules holds the module versions the reflection programs were built
+// with, by stubbed package.
+var buildModules = make(map[string]*moduleSum)
+
+// lookupBuildModule returns the module version providing `pkgPath` in the
+// build list of the module in `buildDir`, in which a reflection program was
+// just built, with its hash. It returns nil for modules replaced by
+// directories, or if the go command can't tell.
+func lookupBuildModule(ctx context.Context, buildDir string, pkgPath string) *moduleSum {
+	cmd := exec.CommandContext(ctx, "go", "list", buildModFlag(), "-m", "-json", "all")
+	cmd.Dir = buildDir
+	cmd.Env = childEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	type listedModule struct {
+		Path    string
+		Version string
+		Main    bool
+		Replace *listedModule
+	}
+	var found *listedModule
+	decoder := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var mod listedModule
+		if err := decoder.Decode(&mod); err != nil {
+			break
+		}
+		if !mod.Main && (pkgPath == mod.Path || strings.HasPrefix(pkgPath, mod.Path+"/")) && (found == nil || len(mod.Path) > len(found.Path)) {
+			found = &mod
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	resolved := module.Version{Path: found.Path, Version: found.Version}
+	if found.Replace != nil {
+		if found.Replace.Version == "" {
+			return nil
+		}
+		resolved = module.Version{Path: found.Replace.Path, Version: found.Replace.Version}
+	}
+	// The build records the hashes it checked in its own go.sum.
+	sum := goSumHash(buildDir, resolved)
+	if sum == "" {
+		return nil
+	}
+	return &moduleSum{Path: resolved.Path, Version: resolved.Version, Sum: sum}
+}
+
+// stubbedPackages returns the sorted packages stubbed into the vendor
+// directory of the module in `modRoot`, including during this run, and the
+// packages of its tool directives `tools`, by the path of the module of
+// `modFile` that provides them.
+func stubbedPackages(modRoot string, modFile *modfile.File, tools []string) map[string][]string {
+	recorded, err := recordedPackages(modRoot)
+	if err != nil {
+		log.Fatalf("Unable to list the stubbed packages: %v", err)
+	}
+	pkgs := append([]string{}, tools...)
+	for _, locked := range recorded {
+		// The lockfile may still list stubs that were removed since.
+		if infos, err := ioutil.ReadDir(bundledStubDir(filepath.Join(modRoot, "vendor"), locked)); err == nil && len(infos) > 0 {
+			pkgs = append(pkgs, locked.Package)
+		}
+	}
+	for _, locked := range lockedPackages {
+		pkgs = append(pkgs, locked.Package)
+	}
+	seen := make(map[string]bool)
+	byModule := make(map[string][]string)
+	for _, pkg := range pkgs {
+		if seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+
+		if mod := requiredModule(modFile, pkg); mod.Path != "" {
+			byModule[mod.Path] = append(byModule[mod.Path], pkg)
+		}
+	}
+	for _, pkgs := range byModule {
+		sort.Strings(pkgs)
+	}
+	return byModule
 }
 
 func moduleLine(m, r module.Version) string {
@@ -71,6 +420,134 @@ func moduleLine(m, r module.Version) string {
 	return b.String()
 }
 
+var (
+	selectModuleRootOnce sync.Once
+	selectedModuleRoot   string
+	workDirModuleRoot    string
+)
+
+// selectModuleRoot returns the root of the module of the current directory
+// if it isn't the nearest one with a go.mod file, with that nearest one:
+// the -module_root, or the module the go command builds the package in the
+// current directory in, like with a go.work file or a nested go.mod file the
+// go command doesn't use. It returns "" otherwise.
+func selectModuleRoot() (string, string) {
+	selectModuleRootOnce.Do(func() {
+		wd, err := os.Getwd()
+		if err != nil {
+			return
+		}
+		wd = realDir(wd)
+		workDirModuleRoot = nearestModuleRoot(wd)
+
+		if *moduleRoot != "" {
+			root, err := filepath.Abs(*moduleRoot)
+			if err != nil {
+				log.Fatalf("Invalid -module_root %q: %v", *moduleRoot, err)
+			}
+			root = realDir(root)
+			if fi, err := os.Stat(filepath.Join(root, "go.mod")); err != nil || fi.IsDir() {
+				log.Fatalf("No go.mod found in the module root %s", root)
+			}
+			selectedModuleRoot = root
+			return
+		}
+
+		goMod, err := goEnv("GOMOD")
+		if err != nil || goMod == "" || goMod == os.DevNull {
+			return
+		}
+		owner := realDir(filepath.Dir(goMod))
+		if workDirModuleRoot != "" && workDirModuleRoot != owner {
+			log.Printf("WARNING: the nearest go.mod file is in %s, but the go command builds the package in %s in the module in %s; using the latter, pass -module_root to choose another", workDirModuleRoot, wd, owner)
+			selectedModuleRoot = owner
+		}
+	})
+	return selectedModuleRoot, workDirModuleRoot
+}
+
+var (
+	moduleCacheOnce sync.Once
+	moduleCache     string
+)
+
+// moduleGoVersion returns the version of the go directive of the module
+// `mod`, as declared in its go.mod file in the module cache, or in the
+// directory `replacement` replaces it with relative to `modRoot`. It
+// reports whether the go.mod file was found; the version is "" if it has no
+// go directive.
+func moduleGoVersion(modRoot string, mod module.Version, replacement module.Version) (string, bool) {
+	var goModPath string
+	if replacement.Path != "" && replacement.Version == "" {
+		dir := filepath.FromSlash(replacement.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(modRoot, dir)
+		}
+		goModPath = filepath.Join(dir, "go.mod")
+	} else {
+		if replacement.Path != "" {
+			mod = replacement
+		}
+		moduleCacheOnce.Do(func() {
+			moduleCache, _ = moduleCacheDir()
+		})
+		escapedPath, err := module.EscapePath(mod.Path)
+		if err != nil || moduleCache == "" {
+			return "", false
+		}
+		escapedVersion, err := module.EscapeVersion(mod.Version)
+		if err != nil {
+			return "", false
+		}
+		goModPath = filepath.Join(moduleCache, "cache", "download", filepath.FromSlash(escapedPath), "@v", escapedVersion+".mod")
+	}
+	data, err := ioutil.ReadFile(goModPath)
+	if err != nil {
+		return "", false
+	}
+	file, err := modfile.ParseLax(goModPath, data, nil)
+	if err != nil {
+		return "", false
+	}
+	if file.Go == nil {
+		return "", true
+	}
+	return file.Go.Version, true
+}
+
+// mainGoVersion returns the go version the main module `modFile` declares.
+func mainGoVersion(modFile *modfile.File) string {
+	// Without a go directive, the go command assumes go 1.16.
+	if modFile.Go == nil {
+		return "1.16"
+	}
+	return modFile.Go.Version
+}
+
+// explicitAnnotation returns the line of vendor/modules.txt marking the
+// module `mod`, replaced by `replacement`, as required by the go.mod of the
+// module in `modRoot`, which declares `goVersion`.
+func explicitAnnotation(modRoot string, goVersion string, mod module.Version, replacement module.Version) string {
+	// From go 1.17, modules.txt records the go version of each module,
+	// which the packages of the module are compiled with.
+	if semver.Compare("v"+goVersion, "v1.17") < 0 {
+		return "## explicit"
+	}
+	// Stubs may use constructs of the go version of the main module, so it
+	// is assumed if the go.mod file of the module isn't available.
+	modGoVersion, found := moduleGoVersion(modRoot, mod, replacement)
+	if !found {
+		modGoVersion = goVersion
+	}
+	if modGoVersion == "" {
+		return "## explicit"
+	}
+	return "## explicit; go " + modGoVersion
+}
+
+// stubModulesTxt writes the vendor/modules.txt of the module, listing the
+// modules it requires, for -write_module_txt and -vendor. It isn't written if
+// there are no stubs to list.
 func stubModulesTxt() {
 	wd, err := os.Getwd()
 	if err != nil {
@@ -78,58 +555,79 @@ func stubModulesTxt() {
 	}
 
 	modRoot := findModuleRoot(wd)
-
 	if modRoot == "" {
-		// no go.mod was found, so we don't need to stub modules.txt
-		return
+		log.Fatalf("No go.mod found in %s or any of its parent directories; run -write_module_txt in the module, or point at it with -module_root", wd)
 	}
 
-	modFile := loadModFile(filepath.Join(modRoot, "go.mod"))
+	modFile, tools := loadModFileTools(filepath.Join(modRoot, "go.mod"))
 
 	vdir := filepath.Join(modRoot, "vendor")
 
-	if gv := modFile.Go; gv != nil && semver.Compare("v"+gv.Version, "v1.14") >= 0 {
-		// If the Go version is at least 1.14, generate a dummy modules.txt using only the information
-		// in the go.mod file
-
-		generated := make(map[module.Version]bool)
-		var buf bytes.Buffer
-		for _, r := range modFile.Require {
-			// TODO: support replace lines
-			generated[r.Mod] = true
-			line := moduleLine(r.Mod, module.Version{})
-			buf.WriteString(line)
-
-			buf.WriteString("## explicit\n")
-
-			buf.WriteString(r.Mod.Path + "\n")
+	goVersion := mainGoVersion(modFile)
+	if semver.Compare("v"+goVersion, "v1.14") < 0 {
+		log.Printf("go.mod declares go %s, whose go command doesn't check vendor/modules.txt; not writing it", goVersion)
+		return
+	}
+	// Generate a dummy modules.txt using only the information in the go.mod file.
+	stubbed := stubbedPackages(modRoot, modFile, tools)
+	if len(stubbed) == 0 {
+		log.Println("No stubs in the vendor directory; not writing modules.txt")
+		return
+	}
+	generated := make(map[module.Version]bool)
+	var buf bytes.Buffer
+	for _, r := range modFile.Require {
+		if excluded(modFile, r.Mod) {
+			log.Printf("WARNING: go.mod requires %s %s, which it also excludes; the go command ignores that requirement.", r.Mod.Path, r.Mod.Version)
 		}
-
-		// Record unused and wildcard replacements at the end of the modules.txt file:
-		// without access to the complete build list, the consumer of the vendor
-		// directory can't otherwise determine that those replacements had no effect.
-		for _, r := range modFile.Replace {
-			if generated[r.Old] {
-				// We we already recorded this replacement in the entry for the replaced
-				// module with the packages it provides.
-				continue
+		// Record the replacement of a required module with its entry, as
+		// the go command does, e.g. for modules replaced by directories.
+		// Wildcard replacements are still recorded at the end.
+		var replacement module.Version
+		for _, rep := range modFile.Replace {
+			if rep.Old.Path == r.Mod.Path && (rep.Old.Version == "" || rep.Old.Version == r.Mod.Version) {
+				generated[rep.Old] = rep.Old.Version != ""
+				replacement = rep.New
 			}
-
-			line := moduleLine(r.Old, r.New)
-			buf.WriteString(line)
 		}
+		generated[r.Mod] = true
+		line := moduleLine(r.Mod, replacement)
+		buf.WriteString(line)
 
-		if buf.Len() == 0 {
-			log.Println("go: no dependencies to vendor")
-			return
-		}
+		buf.WriteString(explicitAnnotation(modRoot, goVersion, r.Mod, replacement) + "\n")
 
-		if err := os.MkdirAll(vdir, 0777); err != nil {
-			log.Fatalf("go mod vendor: %v", err)
+		// Without stubs of the module yet, list the module path, so
+		// that a stub at the module root can be added later.
+		pkgs := stubbed[r.Mod.Path]
+		if len(pkgs) == 0 {
+			pkgs = []string{r.Mod.Path}
 		}
+		for _, pkg := range pkgs {
+			buf.WriteString(pkg + "\n")
+		}
+	}
 
-		if err := ioutil.WriteFile(filepath.Join(vdir, "modules.txt"), buf.Bytes(), 0666); err != nil {
-			log.Fatalf("go mod vendor: %v", err)
+	// Record unused and wildcard replacements at the end of the modules.txt file:
+	// without access to the complete build list, the consumer of the vendor
+	// directory can't otherwise determine that those replacements had no effect.
+	for _, r := range modFile.Replace {
+		if generated[r.Old] {
+			// We we already recorded this replacement in the entry for the replaced
+			// module with the packages it provides.
+			continue
 		}
+
+		line := moduleLine(r.Old, r.New)
+		buf.WriteString(line)
+	}
+
+	if buf.Len() == 0 {
+		log.Println("go: no dependencies to vendor")
+		return
+	}
+
+	entries := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if err := writeFile(filepath.Join(vdir, "modules.txt"), buf.Bytes(), nil, fileAction{Entries: entries}); err != nil {
+		log.Fatalf("go mod vendor: %v", err)
 	}
 }
@@ -0,0 +1,312 @@
+package main
+
+// This file contains the check of the vendor directory against the
+// consistency checks of the go command, which fixes up vendor/modules.txt
+// until the go command accepts it.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+var vendorVerify = flag.Bool("vendor_verify", false, "With -vendor, check the vendor directory like 'go build -mod=vendor' does, fix up vendor/modules.txt until the go command accepts it, and build the stubbed packages with -mod=vendor.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"vendor-verify"},
+		usage: "check the vendor directory like 'go build -mod=vendor' does, fixing up modules.txt",
+		run:   runVendorVerify,
+	})
+}
+
+// maxVendorFixes is the number of times vendor/modules.txt is fixed up
+// before giving up; each round fixes all the problems the go command
+// reports, which may reveal others.
+const maxVendorFixes = 5
+
+func runVendorVerify(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("vendor-verify must be run in a module")
+	}
+	return verifyVendoring(root)
+}
+
+// verifyVendoring checks the vendor directory of the module in `modRoot`
+// like the go command does with -mod=vendor, fixes up its modules.txt until
+// the go command accepts it, and builds the stubbed packages.
+func verifyVendoring(modRoot string) error {
+	for i := 0; ; i++ {
+		problems, err := vendorInconsistencies(modRoot)
+		if err != nil {
+			return err
+		}
+		if len(problems) == 0 {
+			break
+		}
+		if i == maxVendorFixes {
+			return fmt.Errorf("vendor/modules.txt is still inconsistent after %d rounds of fixes:\n\t%s", maxVendorFixes, strings.Join(vendorProblemStrings(problems), "\n\t"))
+		}
+		fixed, err := fixModulesTxt(modRoot, problems)
+		if err != nil {
+			return err
+		}
+		if !fixed || planOnly {
+			return fmt.Errorf("the go command rejects vendor/modules.txt:\n\t%s", strings.Join(vendorProblemStrings(problems), "\n\t"))
+		}
+	}
+
+	modFile, tools := loadModFileTools(filepath.Join(modRoot, "go.mod"))
+	var pkgs []string
+	for _, modPkgs := range stubbedPackages(modRoot, modFile, tools) {
+		pkgs = append(pkgs, modPkgs...)
+	}
+	if len(pkgs) == 0 {
+		return nil
+	}
+	sort.Strings(pkgs)
+	if out, err := vendorGoCommand(modRoot, append([]string{"build"}, pkgs...)...); err != nil {
+		return fmt.Errorf("go build -mod=vendor of the stubbed packages failed: %s\n%s", err, out)
+	}
+	return nil
+}
+
+// vendorGoCommand runs the go command with `args` and -mod=vendor in
+// `modRoot`, outside of any workspace, and returns its output.
+func vendorGoCommand(modRoot string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(runContext, "go", append([]string{args[0], "-mod=vendor"}, args[1:]...)...)
+	cmd.Dir = modRoot
+	cmd.Env = append(childEnv(), "GOWORK=off")
+	out, err := cmd.CombinedOutput()
+	return out, ctxErr(runContext, err)
+}
+
+// vendorProblem is an inconsistency between go.mod and vendor/modules.txt
+// reported by the go command.
+type vendorProblem struct {
+	Mod    module.Version
+	Detail string
+}
+
+func vendorProblemStrings(problems []vendorProblem) []string {
+	lines := make([]string, len(problems))
+	for i, problem := range problems {
+		mod := problem.Mod.Path
+		if problem.Mod.Version != "" {
+			mod += "@" + problem.Mod.Version
+		}
+		lines[i] = mod + ": " + problem.Detail
+	}
+	return lines
+}
+
+// vendorInconsistencies returns the inconsistencies of the vendor directory
+// of the module in `modRoot` that the go command reports.
+func vendorInconsistencies(modRoot string) ([]vendorProblem, error) {
+	out, err := vendorGoCommand(modRoot, "list", "-m")
+	if err == nil {
+		return nil, nil
+	}
+	if err == errInterrupted || !bytes.Contains(out, []byte("inconsistent vendoring")) {
+		return nil, fmt.Errorf("go list -mod=vendor failed: %s\n%s", err, out)
+	}
+	return parseVendorProblems(string(out)), nil
+}
+
+// parseVendorProblems returns the inconsistencies listed in the output `out`
+// of a go command failing with "inconsistent vendoring".
+func parseVendorProblems(out string) []vendorProblem {
+	// The problems are listed on indented lines of the form
+	// `path@version: detail`, before the advice separated by an empty line.
+	var problems []vendorProblem
+	lines := strings.Split(out, "\n")
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		i := strings.Index(line, ": ")
+		if i < 0 {
+			continue
+		}
+		var mod module.Version
+		mod.Path = strings.TrimSpace(line[:i])
+		if at := strings.LastIndex(mod.Path, "@"); at >= 0 {
+			mod.Path, mod.Version = mod.Path[:at], mod.Path[at+1:]
+		}
+		problems = append(problems, vendorProblem{Mod: mod, Detail: line[i+2:]})
+	}
+	return problems
+}
+
+// modulesTxtEntry is the entry of a module in vendor/modules.txt: its
+// `# path version [=> replacement]` line, followed by the `## ` annotations
+// and the packages vendored from it.
+type modulesTxtEntry struct {
+	mod, replacement module.Version
+	annotations      []string
+	pkgs             []string
+}
+
+// fixModulesTxt fixes the `problems` of the vendor/modules.txt of the module
+// in `modRoot`, as the go.mod file dictates. It reports whether it fixed
+// any.
+func fixModulesTxt(modRoot string, problems []vendorProblem) (bool, error) {
+	path := filepath.Join(modRoot, "vendor", "modules.txt")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	entries := parseModulesTxt(string(data))
+	modFile := loadModFile(filepath.Join(modRoot, "go.mod"))
+	goVersion := mainGoVersion(modFile)
+
+	// The entries of replacements of all versions have no version; those
+	// of other versions of a required module are updated.
+	lookup := func(mod module.Version, anyVersion bool) *modulesTxtEntry {
+		for _, entry := range entries {
+			if entry.mod == mod {
+				return entry
+			}
+		}
+		for _, entry := range entries {
+			if anyVersion && entry.mod.Path == mod.Path && entry.mod.Version != "" {
+				return entry
+			}
+		}
+		return nil
+	}
+	replacementOf := func(mod module.Version) module.Version {
+		var replacement module.Version
+		for _, r := range modFile.Replace {
+			if r.Old.Path == mod.Path && (r.Old.Version == "" || r.Old.Version == mod.Version) {
+				replacement = r.New
+			}
+		}
+		return replacement
+	}
+
+	fixed := false
+	for _, problem := range problems {
+		explicit := strings.HasPrefix(problem.Detail, "is explicitly required in ")
+		entry := lookup(problem.Mod, explicit)
+		switch {
+		case explicit:
+			if entry == nil {
+				entry = &modulesTxtEntry{mod: problem.Mod, replacement: replacementOf(problem.Mod)}
+				entries = append(entries, entry)
+			}
+			entry.mod.Version = problem.Mod.Version
+			entry.annotations = append(withoutExplicit(entry.annotations), explicitAnnotation(modRoot, goVersion, entry.mod, entry.replacement))
+			fixed = true
+		case strings.HasPrefix(problem.Detail, "is replaced in "), strings.HasPrefix(problem.Detail, "is replaced by "):
+			if entry == nil {
+				entry = &modulesTxtEntry{mod: problem.Mod}
+				entries = append(entries, entry)
+			}
+			entry.replacement = replacementOf(problem.Mod)
+			fixed = true
+		case strings.HasPrefix(problem.Detail, "is marked as explicit in vendor/modules.txt"):
+			if entry != nil {
+				entry.annotations = withoutExplicit(entry.annotations)
+				fixed = true
+			}
+		case strings.HasPrefix(problem.Detail, "is marked as replaced in vendor/modules.txt"):
+			if entry != nil {
+				entry.replacement = module.Version{}
+				fixed = true
+			}
+		}
+	}
+	if !fixed {
+		return false, nil
+	}
+
+	var buf bytes.Buffer
+	var lines []string
+	for _, entry := range entries {
+		if len(entry.pkgs) == 0 && len(entry.annotations) == 0 && entry.replacement.Path == "" {
+			// Nothing is left to record for the module.
+			continue
+		}
+		buf.WriteString(moduleLine(entry.mod, entry.replacement))
+		for _, line := range append(append([]string(nil), entry.annotations...), entry.pkgs...) {
+			buf.WriteString(line + "\n")
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return true, writeFile(path, buf.Bytes(), nil, fileAction{Entries: lines})
+}
+
+// parseModulesTxt returns the entries of the vendor/modules.txt `data`.
+func parseModulesTxt(data string) []*modulesTxtEntry {
+	var entries []*modulesTxtEntry
+	for _, line := range strings.Split(data, "\n") {
+		switch {
+		case strings.HasPrefix(line, "## "):
+			if len(entries) > 0 {
+				entry := entries[len(entries)-1]
+				entry.annotations = append(entry.annotations, line)
+			}
+		case strings.HasPrefix(line, "# "):
+			entry := &modulesTxtEntry{}
+			old, replacement := line[len("# "):], ""
+			if i := strings.Index(old, " => "); i >= 0 {
+				old, replacement = old[:i], old[i+len(" => "):]
+			}
+			entry.mod = parseModuleVersion(old)
+			if replacement != "" {
+				entry.replacement = parseModuleVersion(replacement)
+			}
+			entries = append(entries, entry)
+		case line != "" && len(entries) > 0:
+			entry := entries[len(entries)-1]
+			entry.pkgs = append(entry.pkgs, line)
+		}
+	}
+	return entries
+}
+
+// parseModuleVersion parses `path [version]`.
+func parseModuleVersion(s string) module.Version {
+	fields := strings.Fields(s)
+	mod := module.Version{}
+	if len(fields) > 0 {
+		mod.Path = fields[0]
+	}
+	if len(fields) > 1 {
+		mod.Version = fields[1]
+	}
+	return mod
+}
+
+// withoutExplicit returns the `annotations` of a module in vendor/modules.txt
+// without the one marking it as explicitly required.
+func withoutExplicit(annotations []string) []string {
+	var kept []string
+	for _, annotation := range annotations {
+		if annotation != "## explicit" && !strings.HasPrefix(annotation, "## explicit;") {
+			kept = append(kept, annotation)
+		}
+	}
+	return kept
+}
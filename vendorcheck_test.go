@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/mod/module"
+)
+
+func TestParseVendorProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []vendorProblem
+	}{
+		{
+			name: "problems and advice",
+			out: "go: inconsistent vendoring in /src/app:\n" +
+				"\texample.com/a@v1.0.0: is explicitly required in go.mod, but not marked as explicit in vendor/modules.txt\n" +
+				"\texample.com/b@v1.2.0: is replaced in go.mod, but not marked as replaced in vendor/modules.txt\n" +
+				"\texample.com/c: is replaced in go.mod, but not marked as replaced in vendor/modules.txt\n" +
+				"\n" +
+				"\tTo ignore the vendor directory, use -mod=readonly or -mod=mod.\n" +
+				"\tTo sync the vendor directory, run:\n" +
+				"\t\tgo mod vendor\n",
+			want: []vendorProblem{
+				{Mod: module.Version{Path: "example.com/a", Version: "v1.0.0"}, Detail: "is explicitly required in go.mod, but not marked as explicit in vendor/modules.txt"},
+				{Mod: module.Version{Path: "example.com/b", Version: "v1.2.0"}, Detail: "is replaced in go.mod, but not marked as replaced in vendor/modules.txt"},
+				{Mod: module.Version{Path: "example.com/c"}, Detail: "is replaced in go.mod, but not marked as replaced in vendor/modules.txt"},
+			},
+		},
+		{
+			name: "pseudo-version and detail with colon",
+			out: "go: inconsistent vendoring in /src/app:\n" +
+				"\texample.com/d@v0.0.0-20201211185031-d93e913c1a58: is marked as explicit in vendor/modules.txt, but not explicitly required in go.mod: see go.mod\n",
+			want: []vendorProblem{
+				{Mod: module.Version{Path: "example.com/d", Version: "v0.0.0-20201211185031-d93e913c1a58"}, Detail: "is marked as explicit in vendor/modules.txt, but not explicitly required in go.mod: see go.mod"},
+			},
+		},
+		{
+			name: "lines without detail",
+			out: "go: inconsistent vendoring in /src/app:\n" +
+				"\tsomething unexpected\n" +
+				"\texample.com/e@v1.0.0: is replaced by ../e in vendor/modules.txt\n",
+			want: []vendorProblem{
+				{Mod: module.Version{Path: "example.com/e", Version: "v1.0.0"}, Detail: "is replaced by ../e in vendor/modules.txt"},
+			},
+		},
+		{
+			name: "no problems",
+			out:  "go: inconsistent vendoring in /src/app:\n\n\tTo ignore the vendor directory, use -mod=readonly or -mod=mod.\n",
+		},
+	}
+	for _, test := range tests {
+		if got := parseVendorProblems(test.out); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseVendorProblems() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseModulesTxt(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []*modulesTxtEntry
+	}{
+		{
+			name: "empty",
+			data: "",
+		},
+		{
+			name: "modules",
+			data: "# example.com/a v1.0.0\n" +
+				"## explicit; go 1.14\n" +
+				"example.com/a\n" +
+				"example.com/a/sub\n" +
+				"# example.com/b v1.2.0 => example.com/fork/b v1.2.1\n" +
+				"## explicit\n" +
+				"example.com/b\n" +
+				"# example.com/c => ../c\n" +
+				"example.com/c\n" +
+				"# example.com/d v0.1.0\n",
+			want: []*modulesTxtEntry{
+				{
+					mod:         module.Version{Path: "example.com/a", Version: "v1.0.0"},
+					annotations: []string{"## explicit; go 1.14"},
+					pkgs:        []string{"example.com/a", "example.com/a/sub"},
+				},
+				{
+					mod:         module.Version{Path: "example.com/b", Version: "v1.2.0"},
+					replacement: module.Version{Path: "example.com/fork/b", Version: "v1.2.1"},
+					annotations: []string{"## explicit"},
+					pkgs:        []string{"example.com/b"},
+				},
+				{
+					mod:         module.Version{Path: "example.com/c"},
+					replacement: module.Version{Path: "../c"},
+					pkgs:        []string{"example.com/c"},
+				},
+				{
+					mod: module.Version{Path: "example.com/d", Version: "v0.1.0"},
+				},
+			},
+		},
+		{
+			name: "lines before the first module",
+			data: "## explicit\nexample.com/orphan\n\n# example.com/a v1.0.0\nexample.com/a\n",
+			want: []*modulesTxtEntry{
+				{
+					mod:  module.Version{Path: "example.com/a", Version: "v1.0.0"},
+					pkgs: []string{"example.com/a"},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		got := parseModulesTxt(test.data)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: parseModulesTxt() =", test.name)
+			for _, entry := range got {
+				t.Errorf("\t%+v", *entry)
+			}
+			t.Errorf("want")
+			for _, entry := range test.want {
+				t.Errorf("\t%+v", *entry)
+			}
+		}
+	}
+}
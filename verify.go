@@ -0,0 +1,76 @@
+package main
+
+// This file contains the `verify` subcommand, which checks whether the
+// modules of the stubs changed since the stubs were generated.
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+var strictEnv = flag.Bool("strict_env", false, "Make verify warn about the stubs generated with another Go version, GOFLAGS or platform than the current ones, and warn when a stub is regenerated in such an environment.")
+
+func init() {
+	registerCommand(&command{
+		names: []string{"verify"},
+		usage: "warn about stubs whose modules changed in go.sum since they were generated",
+		run:   runVerify,
+	})
+}
+
+func runVerify(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments: %v", args)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := findModuleRoot(wd)
+	if root == "" {
+		return fmt.Errorf("verify must be run in a module")
+	}
+	recorded, err := recordedPackages(root)
+	if err != nil {
+		return err
+	}
+
+	outdated, otherEnv := 0, 0
+	for _, locked := range recorded {
+		if *strictEnv && locked.Env.differsMaterially(currentGenerationEnv()) {
+			otherEnv++
+			fmt.Fprintf(stderr, "warning: the stub of %s was generated with %s, but the go environment is now %s; regenerating it may change it\n",
+				locked.Package, locked.Env, currentGenerationEnv())
+		}
+		if locked.Module == nil || locked.Options["from-dir"] != "" {
+			// Stubs of local directories have nothing to compare against.
+			continue
+		}
+		current := lookupModuleSum(root, locked.Package)
+		if current != nil && *current == *locked.Module {
+			continue
+		}
+		if current != nil && current.Path == locked.Module.Path && semver.Compare(locked.Module.Version, current.Version) > 0 &&
+			goSumHash(root, module.Version{Path: locked.Module.Path, Version: locked.Module.Version}) == locked.Module.Sum {
+			// The build selected a later version than go.mod requires.
+			continue
+		}
+		outdated++
+		now := "no hash in go.sum"
+		if current != nil {
+			now = current.String()
+		}
+		fmt.Fprintf(stderr, "warning: the stub of %s was generated from %s, but now %s; regenerate it with 'depstubber vendor --only %s'\n",
+			locked.Package, locked.Module, now, locked.Package)
+	}
+	if *strictEnv {
+		fmt.Printf("%d stubs, %d may be out of date, %d were generated in another environment\n", len(recorded), outdated, otherEnv)
+		return nil
+	}
+	fmt.Printf("%d stubs, %d may be out of date\n", len(recorded), outdated)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+// This file contains the handling of -versions, which stubs several versions
+// of the module of a package in one invocation, each into its own module,
+// for tests that must compile against each of them.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+var (
+	stubVersions = flag.String("versions", "", "Comma-separated list of versions of the module of the package to stub, like 'v1.8.0,v2.3.1', or of 'path@version' for those with another import path; each is stubbed into the module in the directory -version_root gives for it.")
+	versionRoot  = flag.String("version_root", "", "With -versions, a template of the directory of the module each version is stubbed into, like 'testdata/{{.Major}}', with the fields .Path, .Version and .Major.")
+)
+
+// stubVersion is a version of -versions, with the fields available to the
+// template of -version_root.
+type stubVersion struct {
+	Path    string // the import path of the package in that version
+	Version string
+	Major   string // like "v2"
+}
+
+// unversionedFlags are the flags that aren't passed on to the runs stubbing
+// each version: those of -versions itself, -C, whose directory the roots are
+// relative to, and those whose values are passed on in other ways or that
+// would write the same file for each run.
+var unversionedFlags = map[string]bool{
+	"versions":     true,
+	"version_root": true,
+	"C":            true,
+	"env":          true,
+	"build_flag":   true,
+	"spans":        true,
+	"profile":      true,
+	"trace":        true,
+}
+
+// parseStubVersions returns the versions of -versions for the package
+// `pkgPath`.
+func parseStubVersions(pkgPath string, value string) ([]stubVersion, error) {
+	var versions []stubVersion
+	for _, s := range split(value) {
+		v := stubVersion{Path: pkgPath, Version: s}
+		if i := strings.LastIndex(s, "@"); i >= 0 {
+			v.Path, v.Version = s[:i], s[i+1:]
+			if err := module.CheckImportPath(v.Path); err != nil {
+				return nil, fmt.Errorf("invalid -versions entry %q: %v", s, err)
+			}
+		}
+		if !semver.IsValid(v.Version) {
+			return nil, fmt.Errorf("invalid -versions entry %q: %q is not a semantic version", s, v.Version)
+		}
+		v.Major = semver.Major(v.Version)
+		versions = append(versions, v)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("-versions lists no versions")
+	}
+	return versions, nil
+}
+
+// versionRoots returns the directories -version_root gives for `versions`.
+func versionRoots(versions []stubVersion) ([]string, error) {
+	if *versionRoot == "" {
+		return nil, fmt.Errorf("-versions requires -version_root")
+	}
+	tmpl, err := template.New("version_root").Parse(*versionRoot)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -version_root: %v", err)
+	}
+	roots := make([]string, len(versions))
+	byRoot := make(map[string]stubVersion)
+	for i, v := range versions {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, v); err != nil {
+			return nil, fmt.Errorf("invalid -version_root: %v", err)
+		}
+		root, err := filepath.Abs(buf.String())
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := byRoot[root]; ok {
+			return nil, fmt.Errorf("-version_root gives %s for both %s and %s; it must tell the versions apart, like with {{.Major}} or {{.Version}}", root, other.Version, v.Version)
+		}
+		byRoot[root] = v
+		roots[i] = root
+	}
+	return roots, nil
+}
+
+// stubVersionsInRoots stubs the package `pkgPath` in each version of
+// -versions, with the symbols given as the arguments `symbolArgs`. Each
+// version is required by the module in its root, and stubbed there by a run
+// of depstubber with the other flags, so that the vendor directory,
+// lockfile and manifests of each root only describe its version.
+func stubVersionsInRoots(pkgPath string, symbolArgs []string) error {
+	if planOnly {
+		return fmt.Errorf("-versions can't be planned, as it updates the go.mod file of each root")
+	}
+	if !*vendor && *destination == "" {
+		return fmt.Errorf("-versions requires -destination or -vendor")
+	}
+	versions, err := parseStubVersions(pkgPath, *stubVersions)
+	if err != nil {
+		return err
+	}
+	roots, err := versionRoots(versions)
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !unversionedFlags[f.Name] {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	for _, f := range extraBuildFlags {
+		args = append(args, "-build_flag="+f)
+	}
+
+	for i, v := range versions {
+		root := roots[i]
+		if fi, err := os.Stat(filepath.Join(root, "go.mod")); err != nil || fi.IsDir() {
+			return fmt.Errorf("no go.mod found in %s, the root of %s; each version is stubbed into a module", root, v.Version)
+		}
+		log.Printf("Stubbing %s@%s into %s", v.Path, v.Version, root)
+
+		// Require the version, so that the reflection program is built with
+		// it and the module records the version its stubs are of.
+		get := exec.Command("go", "get", v.Path+"@"+v.Version)
+		get.Dir = root
+		get.Env = append(childEnv(), "GOFLAGS=-mod=mod")
+		if out, err := get.CombinedOutput(); err != nil {
+			return fmt.Errorf("requiring %s@%s in %s failed: %s\n%s", v.Path, v.Version, root, err, out)
+		}
+
+		cmd := exec.CommandContext(runContext, self, append(append(append([]string(nil), args...), v.Path), symbolArgs...)...)
+		cmd.Dir = root
+		cmd.Env = childEnv()
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("stubbing %s@%s into %s failed: %v", v.Path, v.Version, root, ctxErr(runContext, err))
+		}
+	}
+	return nil
+}